@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"linux_service_manager/internal/db"
+	"linux_service_manager/internal/lifecycle"
+)
+
+func printCheckUsage() {
+	fmt.Println("Usage: lsm check <subcommand> [flags]")
+	fmt.Println("       lsm check --name <service>   Run a service's checks and show each result")
+	fmt.Println("Subcommands:")
+	fmt.Println("  add [flags]                     Add a named check to a service")
+	fmt.Println("  list [--name <service>]         List checks")
+	fmt.Println("  remove --name <service> --check-name <name>")
+	fmt.Println("                                  Remove a named check")
+	fmt.Println("\nAdd Flags:")
+	fmt.Println("  --name        Service name")
+	fmt.Println("  --check-name  Name of the check, unique per service (e.g. 'http')")
+	fmt.Println("  --command     Command to run (exit != 0 means failed)")
+	fmt.Println("  --timeout     Timeout of this check (default: the service's --timeout)")
+	fmt.Println("  --weight      Weight with --check-mode quorum (default 1)")
+	fmt.Println("\nA service's --check command counts as a check named 'check' with weight 1.")
+	fmt.Println("Checks are combined by the service's --check-mode: all (default), any, or quorum,")
+	fmt.Println("which needs the weights of the passing checks to add up to --check-quorum.")
+}
+
+func runCheck(args []string) {
+	if len(args) < 1 {
+		printCheckUsage()
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "run":
+		runCheckRun(args[1:])
+	case "add":
+		runCheckAdd(args[1:])
+	case "list":
+		runCheckList(args[1:])
+	case "remove":
+		runCheckRemove(args[1:])
+	default:
+		if strings.HasPrefix(args[0], "-") {
+			runCheckRun(args)
+			return
+		}
+		printCheckUsage()
+		os.Exit(1)
+	}
+}
+
+// runCheckRun runs a service's checks once, the way the monitor does, and
+// exits non-zero if the service is unhealthy.
+func runCheckRun(args []string) {
+	cmd := flag.NewFlagSet("check", flag.ExitOnError)
+	name := cmd.String("name", "", "Service name")
+	cmd.Parse(args)
+
+	if *name == "" {
+		fmt.Println("Error: --name is required.")
+		os.Exit(1)
+	}
+	svc, err := store.GetService(*name)
+	if err != nil {
+		log.Fatalf("Failed to get service '%s' (does it exist?): %v", *name, err)
+	}
+
+	h := lifecycle.RunChecks(context.Background(), *svc)
+	if len(h.Results) == 0 {
+		fmt.Printf("Service '%s' has no checks.\n", *name)
+		return
+	}
+
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 2, '\t', 0)
+	fmt.Fprintln(w, "Check\tWeight\tResult\tDuration\tOutput")
+	for _, r := range h.Results {
+		result := "ok"
+		if !r.Passed {
+			result = fmt.Sprintf("FAIL (exit %d)", r.ExitCode)
+			if r.ExitCode < 0 {
+				result = fmt.Sprintf("FAIL (%v)", r.Err)
+			}
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%v\t%s\n", r.Name, max(r.Weight, 1), result, r.Duration.Round(time.Millisecond), firstLine(r.Output))
+	}
+	w.Flush()
+
+	state := "healthy"
+	if !h.Healthy {
+		state = "UNHEALTHY"
+	}
+	fmt.Printf("\n%s (mode %s, %d/%d passed)\n", state, h.Mode, h.Passed, h.Needed)
+	if !h.Healthy {
+		os.Exit(1)
+	}
+}
+
+// firstLine shortens command output to its first line for a table cell.
+func firstLine(s string) string {
+	line, _, cut := strings.Cut(s, "\n")
+	if len(line) > 60 {
+		line, cut = line[:60], true
+	}
+	if cut {
+		line += "..."
+	}
+	return line
+}
+
+func runCheckAdd(args []string) {
+	cmd := flag.NewFlagSet("check add", flag.ExitOnError)
+	name := cmd.String("name", "", "Service name")
+	checkName := cmd.String("check-name", "", "Name of the check")
+	command := cmd.String("command", "", "Command to run")
+	timeout := cmd.Duration("timeout", 0, "Timeout of this check (0 = the service's timeout)")
+	weight := cmd.Int("weight", 1, "Weight with --check-mode quorum")
+	cmd.Parse(args)
+
+	if *name == "" || *checkName == "" || *command == "" {
+		fmt.Println("Error: --name, --check-name and --command are required.")
+		cmd.PrintDefaults()
+		os.Exit(1)
+	}
+
+	svc, err := store.GetService(*name)
+	if err != nil {
+		log.Fatalf("Failed to get service '%s' (does it exist?): %v", *name, err)
+	}
+	svc.Checks.Checks = append(svc.Checks.Checks, db.Check{
+		Name:    *checkName,
+		Command: *command,
+		Timeout: *timeout,
+		Weight:  *weight,
+	})
+	validateCommands(*svc)
+	validateChecks(*svc)
+
+	if err := store.UpdateService(*svc); err != nil {
+		log.Fatalf("Failed to update service: %v", err)
+	}
+	fmt.Printf("Check '%s' added to service '%s'. The daemon runs it from the next check on.\n", *checkName, *name)
+}
+
+func runCheckList(args []string) {
+	cmd := flag.NewFlagSet("check list", flag.ExitOnError)
+	name := cmd.String("name", "", "Only list checks of this service")
+	cmd.Parse(args)
+
+	var services []db.Service
+	if *name != "" {
+		svc, err := store.GetService(*name)
+		if err != nil {
+			log.Fatalf("Failed to get service '%s' (does it exist?): %v", *name, err)
+		}
+		services = []db.Service{*svc}
+	} else {
+		var err error
+		if services, err = store.ListServices(); err != nil {
+			log.Fatalf("Failed to list services: %v", err)
+		}
+	}
+
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 2, '\t', 0)
+	fmt.Fprintln(w, "Service\tMode\tCheck\tWeight\tTimeout\tCommand")
+	for _, s := range services {
+		mode := s.Checks.Mode
+		if mode == "" {
+			mode = db.CheckModeAll
+		}
+		if mode == db.CheckModeQuorum {
+			mode = fmt.Sprintf("quorum %d", s.Checks.Quorum)
+		}
+		for _, c := range lifecycle.Checks(s) {
+			timeout := "-"
+			if c.Timeout > 0 {
+				timeout = c.Timeout.String()
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", s.Name, mode, c.Name, max(c.Weight, 1), timeout, c.Command)
+		}
+	}
+	w.Flush()
+}
+
+func runCheckRemove(args []string) {
+	cmd := flag.NewFlagSet("check remove", flag.ExitOnError)
+	name := cmd.String("name", "", "Service name")
+	checkName := cmd.String("check-name", "", "Name of the check")
+	cmd.Parse(args)
+
+	if *name == "" || *checkName == "" {
+		fmt.Println("Error: --name and --check-name are required.")
+		os.Exit(1)
+	}
+
+	svc, err := store.GetService(*name)
+	if err != nil {
+		log.Fatalf("Failed to get service '%s' (does it exist?): %v", *name, err)
+	}
+	var kept []db.Check
+	for _, c := range svc.Checks.Checks {
+		if c.Name != *checkName {
+			kept = append(kept, c)
+		}
+	}
+	if len(kept) == len(svc.Checks.Checks) {
+		fmt.Printf("Error: service '%s' has no check named '%s'.\n", *name, *checkName)
+		os.Exit(1)
+	}
+	svc.Checks.Checks = kept
+	validateChecks(*svc)
+	warnUnchecked(*svc)
+
+	if err := store.UpdateService(*svc); err != nil {
+		log.Fatalf("Failed to update service: %v", err)
+	}
+	fmt.Printf("Check '%s' removed from service '%s'. The daemon stops running it at the next check.\n", *checkName, *name)
+}
+
+// validateChecks exits with an error if the service's check settings are unusable.
+func validateChecks(s db.Service) {
+	if err := checkSettingsError(s); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// checkSettingsError reports the first problem with the check mode and named
+// checks of s. It is shared with lint.
+func checkSettingsError(s db.Service) error {
+	cs := s.Checks
+	if !db.ValidCheckMode(cs.Mode) {
+		return fmt.Errorf("unknown check mode '%s' (expected all, any or quorum)", cs.Mode)
+	}
+	if cs.Mode == db.CheckModeQuorum && cs.Quorum < 1 {
+		return fmt.Errorf("--check-quorum must be at least 1 with --check-mode quorum")
+	}
+
+	seen := map[string]bool{"check": s.CheckCommand != ""}
+	total := 0
+	if s.CheckCommand != "" {
+		total = 1
+	}
+	for _, c := range cs.Checks {
+		if c.Name == "" || c.Command == "" {
+			return fmt.Errorf("checks need a name and a command")
+		}
+		if seen[c.Name] {
+			if c.Name == "check" {
+				return fmt.Errorf("the name 'check' is taken by the service's --check command")
+			}
+			return fmt.Errorf("duplicate check name '%s'", c.Name)
+		}
+		seen[c.Name] = true
+		if c.Timeout < 0 || c.Weight < 0 {
+			return fmt.Errorf("check '%s': timeout and weight must not be negative", c.Name)
+		}
+		total += max(c.Weight, 1)
+	}
+	if cs.Mode == db.CheckModeQuorum && cs.Quorum > total {
+		return fmt.Errorf("--check-quorum %d is more than the total weight %d of the checks, the service could never be healthy", cs.Quorum, total)
+	}
+	return nil
+}
+
+// warnUnchecked warns that s would no longer be checked at all.
+func warnUnchecked(s db.Service) {
+	if !lifecycle.HasCheck(s) {
+		fmt.Printf("Warning: service '%s' has no checks left, it always counts as healthy and is never restarted.\n", s.Name)
+	}
+}
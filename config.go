@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"linux_service_manager/lsm"
+)
+
+// Where a system-wide LSM keeps its files
+const (
+	systemDBPath     = "/var/lib/lsm/lsm.db"
+	systemLogPath    = "/var/log/lsm/lsm.log"
+	systemConfigPath = "/etc/lsm/lsm.conf"
+)
+
+// Paths in use, set by parseGlobalFlags
+var (
+	dbPath   = systemDBPath
+	logPath  = systemLogPath
+	userMode bool // --user: XDG paths, no root needed
+
+	servicesPath string // --services: read-only JSON file of services
+
+	// --leader-lock, --leader-db: elect a leader among daemons on several hosts
+	leaderLockPath string
+	leaderDBPath   string
+)
+
+// checkInterval is the time between checks of the daemon. The lease of
+// --leader-db lasts three of them, so a follower takes over within 30s of the
+// leader's last renewal.
+const (
+	checkInterval = 10 * time.Second
+	leaseTTL      = 3 * checkInterval
+)
+
+// parseGlobalFlags reads the flags before the command and returns the command
+// and its arguments. Paths are taken from, later ones winning: the defaults
+// (system or, with --user, XDG), the config file, LSM_DB/LSM_LOG and the flags.
+func parseGlobalFlags(args []string) []string {
+	fs := flag.NewFlagSet("lsm", flag.ExitOnError)
+	fs.Usage = printUsage
+	dbFlag := fs.String("db", "", "Database file")
+	logFlag := fs.String("log", "", "Log file")
+	configFlag := fs.String("config", "", "Config file")
+	user := fs.Bool("user", false, "Use the XDG directories of the current user, no root needed")
+	services := fs.String("services", "", "Read-only JSON file of services, instead of the database")
+	leaderLock := fs.String("leader-lock", "", "Only restart and run schedules while holding a lock on this file on shared storage")
+	leaderDB := fs.String("leader-db", "", "Only restart and run schedules while holding a lease in this SQLite database on shared storage")
+	fs.Parse(args)
+	userMode = *user
+
+	configPath := systemConfigPath
+	if userMode {
+		dbPath = filepath.Join(xdgDir("XDG_DATA_HOME", ".local/share"), "lsm", "lsm.db")
+		logPath = filepath.Join(xdgDir("XDG_STATE_HOME", ".local/state"), "lsm", "lsm.log")
+		configPath = filepath.Join(xdgDir("XDG_CONFIG_HOME", ".config"), "lsm", "lsm.conf")
+	}
+
+	// Only a config file asked for with --config must exist
+	if *configFlag != "" {
+		configPath = *configFlag
+	}
+	if err := loadConfig(configPath); err != nil && (*configFlag != "" || !os.IsNotExist(err)) {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if v := os.Getenv("LSM_DB"); v != "" {
+		dbPath = v
+	}
+	if v := os.Getenv("LSM_LOG"); v != "" {
+		logPath = v
+	}
+	if *dbFlag != "" {
+		dbPath = *dbFlag
+	}
+	if *logFlag != "" {
+		logPath = *logFlag
+	}
+	if *services != "" {
+		servicesPath = *services
+	}
+	if *leaderLock != "" {
+		leaderLockPath = *leaderLock
+	}
+	if *leaderDB != "" {
+		leaderDBPath = *leaderDB
+	}
+	if leaderLockPath != "" && leaderDBPath != "" {
+		fmt.Println("Error: Use either --leader-lock or --leader-db")
+		os.Exit(1)
+	}
+
+	// The daemon may run from another directory than the CLI
+	for _, p := range []*string{&dbPath, &logPath, &servicesPath, &leaderLockPath, &leaderDBPath} {
+		if *p == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(*p); err == nil {
+			*p = abs
+		}
+	}
+	return fs.Args()
+}
+
+// xdgDir returns the directory in the XDG variable env, or fallback under the
+// home directory if it is unset. Relative values are invalid per the spec and
+// ignored.
+func xdgDir(env, fallback string) string {
+	if v := os.Getenv(env); filepath.IsAbs(v) {
+		return v
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		fmt.Printf("Error: --user needs a home directory: %v\n", err)
+		os.Exit(1)
+	}
+	return filepath.Join(home, fallback)
+}
+
+// loadConfig reads "key = value" lines from path. Known keys are db, log,
+// services, leader_lock and leader_db; relative paths are relative to the
+// config file. Lines starting with # are comments.
+func loadConfig(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected key = value", path, n)
+		}
+		key, value = strings.TrimSpace(key), strings.Trim(strings.TrimSpace(value), `"'`)
+		if value == "" {
+			return fmt.Errorf("%s:%d: no value for '%s'", path, n, key)
+		}
+		if !filepath.IsAbs(value) {
+			value = filepath.Join(filepath.Dir(path), value)
+		}
+
+		switch key {
+		case "db":
+			dbPath = value
+		case "log":
+			logPath = value
+		case "services":
+			servicesPath = value
+		case "leader_lock":
+			leaderLockPath = value
+		case "leader_db":
+			leaderDBPath = value
+		default:
+			return fmt.Errorf("%s:%d: unknown key '%s' (expected db, log, services, leader_lock or leader_db)", path, n, key)
+		}
+	}
+	return sc.Err()
+}
+
+// openLease returns the lease of --leader-lock or --leader-db, nil if neither
+// is set.
+func openLease() (lsm.Lease, error) {
+	switch {
+	case leaderLockPath != "":
+		return lsm.NewFileLock(leaderLockPath), nil
+	case leaderDBPath != "":
+		return lsm.OpenSQLiteLease(leaderDBPath, leaseTTL)
+	}
+	return nil, nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"linux_service_manager/internal/logger"
+	"linux_service_manager/internal/sdnotify"
+	"linux_service_manager/lsm"
+)
+
+func runDaemon(args []string) {
+	cmd := flag.NewFlagSet("daemon", flag.ExitOnError)
+	drainTimeout := cmd.Duration("drain-timeout", lsm.DefaultDrainTimeout, "How long to wait for running checks, restarts and actions when stopping")
+	stateFile := cmd.String("state-file", "", "On SIGUSR1, also write the state as JSON to this file")
+	cmd.Parse(args)
+	if *drainTimeout == 0 {
+		*drainTimeout = -1 // lsm.Config takes 0 as the default
+	}
+
+	// Init Logger
+	logger.Init(store, logPath)
+
+	lease, err := openLease()
+	if err != nil {
+		log.Fatalf("Failed to open leader lease: %v", err)
+	}
+	if lease != nil {
+		defer lease.Close()
+	}
+
+	// Start the scheduler and the monitor loop
+	m := lsm.New(lsm.Config{
+		Store:        store,
+		Interval:     checkInterval,
+		DrainTimeout: *drainTimeout,
+		Lease:        lease,
+	})
+	if err := m.Start(context.Background()); err != nil {
+		log.Fatalf("Failed to start: %v", err)
+	}
+
+	slog.Info("LSM Daemon started. Press Ctrl+C to exit.", "db", dbPath, "user_mode", userMode, "pid", os.Getpid())
+	notifyCtx, stopNotify := context.WithCancel(context.Background())
+	defer stopNotify()
+	go notifySystemd(notifyCtx, m, checkInterval)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
+	for sig := range sigs {
+		switch sig {
+		case syscall.SIGHUP:
+			// The log config first, so the reload is logged where it now goes
+			logger.Init(store, logPath)
+			if err := m.Reload(); err != nil {
+				slog.Error("Reload failed", "error", err)
+			} else {
+				slog.Info("Reloaded services, schedules and log config")
+			}
+		case syscall.SIGUSR1:
+			dumpState(m, *stateFile)
+		case syscall.SIGUSR2:
+			logger.Reopen()
+			slog.Info("Reopened log files")
+		default:
+			// Running restarts are finished, or interrupted after the drain timeout,
+			// rather than cut off halfway
+			slog.Info("Shutting down...", "signal", sig.String(), "drain_timeout", drainTimeout.String())
+			stopNotify()
+			sdnotify.Notify(sdnotify.Stopping)
+			m.Stop()
+			slog.Info("Stopped")
+			return
+		}
+	}
+}
+
+// notifySystemd tells systemd (Type=notify) that the daemon is ready, keeps
+// the status text shown by systemctl status up to date, and pings the watchdog
+// (WatchdogSec) as long as the monitor loop keeps up. A monitor stuck e.g. on
+// the database then gets LSM itself restarted. Without systemd it does nothing.
+func notifySystemd(ctx context.Context, m *lsm.Manager, interval time.Duration) {
+	l := logger.Component("systemd")
+	ok, err := sdnotify.Notify(sdnotify.Ready + "\n" + sdnotify.Status(statusText(m)))
+	if err != nil {
+		l.Error("Failed to notify systemd", "error", err)
+	}
+	if !ok {
+		return
+	}
+
+	var watchdog <-chan time.Time
+	if wi := sdnotify.WatchdogInterval(); wi > 0 {
+		l.Info("Pinging the systemd watchdog", "every", wi.String())
+		t := time.NewTicker(wi)
+		defer t.Stop()
+		watchdog = t.C
+	}
+	status := time.NewTicker(interval)
+	defer status.Stop()
+
+	stalled := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-status.C:
+			sdnotify.Notify(sdnotify.Status(statusText(m)))
+		case <-watchdog:
+			if !m.Alive() {
+				// Let the watchdog fire
+				if !stalled {
+					l.Error("Monitor loop stalled, not pinging the watchdog")
+				}
+				stalled = true
+				continue
+			}
+			stalled = false
+			if _, err := sdnotify.Notify(sdnotify.Watchdog); err != nil {
+				l.Error("Failed to ping the watchdog", "error", err)
+			}
+		}
+	}
+}
+
+// statusText describes the state for systemctl status, e.g. "5 services, 1 failing".
+func statusText(m *lsm.Manager) string {
+	st, err := m.State()
+	if err != nil {
+		return fmt.Sprintf("Error reading state: %v", err)
+	}
+	monitored, failing := 0, 0
+	for _, s := range st.Services {
+		if !s.Enabled {
+			continue
+		}
+		monitored++
+		if s.Failing {
+			failing++
+		}
+	}
+	text := fmt.Sprintf("%d services, %d failing", monitored, failing)
+	if st.Role != "" {
+		text += ", " + st.Role
+	}
+	if st.SmartPause && st.UserActive {
+		text += ", checks paused (user logged in)"
+	}
+	return text
+}
+
+// dumpState logs the state of the daemon, one line per service, running
+// command and scheduled job, and writes it as JSON to stateFile if set.
+func dumpState(m *lsm.Manager, stateFile string) {
+	l := logger.Component("state")
+	st, err := m.State()
+	if err != nil {
+		l.Error("Failed to read state", "error", err)
+		return
+	}
+
+	failing := 0
+	for _, s := range st.Services {
+		if s.Failing {
+			failing++
+		}
+	}
+	l.Info("State", "services", len(st.Services), "failing", failing, "commands", len(st.Commands),
+		"jobs", len(st.Schedule), "smart_pause", st.SmartPause, "user_active", st.UserActive,
+		"role", st.Role, "leader", st.Leader)
+	for _, s := range st.Services {
+		l.Info("Service", "service", s.Name, "enabled", s.Enabled, "failing", s.Failing, "busy", s.Busy,
+			"last_checked", formatTime(s.LastChecked), "last_restarted", formatTime(s.LastRestarted))
+	}
+	for _, c := range st.Commands {
+		l.Info("Running command", "service", c.Service, "cmd", c.Cmd, "running_for", time.Since(c.Since).Round(time.Second).String())
+	}
+	for _, j := range st.Schedule {
+		l.Info("Scheduled job", "service", j.Service, "action", j.Action, "schedule_id", j.ScheduleID, "next", j.Next.Format(time.RFC3339))
+	}
+
+	if stateFile == "" {
+		return
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(stateFile, append(data, '\n'))
+	}
+	if err != nil {
+		l.Error("Failed to write state file", "file", stateFile, "error", err)
+		return
+	}
+	l.Info("Wrote state file", "file", stateFile)
+}
+
+// writeFileAtomic replaces path with data, so readers never see half a file.
+// The state lists commands, so only the owner may read it.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".state-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// formatTime returns t in RFC 3339, or "-" if it is unset.
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+)
+
+func printDBUsage() {
+	fmt.Println("Usage: lsm db <subcommand> [flags]")
+	fmt.Println("Subcommands:")
+	fmt.Println("  migrate [--status]    Apply pending schema migrations, or with --status only list them")
+	fmt.Println("  backup --to <file>    Write a consistent copy of the database (safe while the daemon runs)")
+	fmt.Println("  restore --from <file> Replace the database with a backup. The current one is saved first.")
+	fmt.Println("  check                 Run SQLite's integrity check")
+	fmt.Println("  auto-backup [flags]   Show or set the daemon's automatic backup:")
+	fmt.Println("                          --schedule  Cron schedule (e.g. '@daily'), \"\" disables")
+	fmt.Println("                          --dir       Directory (default: backups/ next to the database)")
+	fmt.Println("                          --keep      Newest automatic backups to keep (default 7, 0 = all)")
+	fmt.Println("\nEvery command except db check and db restore applies pending migrations first. Before")
+	fmt.Println("migrating an existing database, a copy is written next to it (<db>.v<version>-<time>.bak);")
+	fmt.Println("the newest 3 of those copies are kept.")
+}
+
+func runDB(args []string) {
+	if len(args) < 1 {
+		printDBUsage()
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "migrate":
+		runDBMigrate(args[1:])
+	case "backup":
+		runDBBackup(args[1:])
+	case "restore":
+		runDBRestore(args[1:])
+	case "check":
+		runDBCheck()
+	case "auto-backup":
+		runDBAutoBackup(args[1:])
+	default:
+		printDBUsage()
+		os.Exit(1)
+	}
+}
+
+func runDBMigrate(args []string) {
+	cmd := flag.NewFlagSet("db migrate", flag.ExitOnError)
+	status := cmd.Bool("status", false, "Only show the applied and pending migrations")
+	cmd.Parse(args)
+
+	if !*status {
+		applied, err := database.Migrate()
+		for _, m := range applied {
+			fmt.Printf("Applied migration %d (%s).\n", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatalf("Failed to migrate the database: %v", err)
+		}
+		if len(applied) == 0 {
+			fmt.Println("Nothing pending.")
+		}
+		version, err := database.SchemaVersion()
+		if err != nil {
+			log.Fatalf("Failed to read schema version: %v", err)
+		}
+		fmt.Printf("Database %s is at schema version %d.\n", dbPath, version)
+		return
+	}
+
+	states, err := database.MigrationStatus()
+	if err != nil {
+		log.Fatalf("Failed to read migrations: %v", err)
+	}
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 2, '\t', 0)
+	fmt.Fprintln(w, "Version\tName\tApplied")
+	for _, st := range states {
+		applied := "pending"
+		if st.AppliedAt != nil {
+			applied = st.AppliedAt.Local().Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", st.Version, st.Name, applied)
+	}
+	w.Flush()
+}
+
+func runDBBackup(args []string) {
+	cmd := flag.NewFlagSet("db backup", flag.ExitOnError)
+	to := cmd.String("to", "", "Backup file to write (must not exist)")
+	cmd.Parse(args)
+
+	if *to == "" {
+		fmt.Println("Error: --to is required.")
+		os.Exit(1)
+	}
+	if err := database.Backup(*to); err != nil {
+		log.Fatalf("Failed to back up the database: %v", err)
+	}
+	fmt.Printf("Database backed up to %s.\n", *to)
+}
+
+func runDBRestore(args []string) {
+	cmd := flag.NewFlagSet("db restore", flag.ExitOnError)
+	from := cmd.String("from", "", "Backup file to restore")
+	cmd.Parse(args)
+
+	if *from == "" {
+		fmt.Println("Error: --from is required.")
+		os.Exit(1)
+	}
+	saved, err := database.Restore(*from)
+	if err != nil {
+		if saved != "" {
+			log.Fatalf("Failed to restore the database: %v (the database before restoring is at %s)", err, saved)
+		}
+		log.Fatalf("Failed to restore the database: %v", err)
+	}
+	fmt.Printf("Database restored from %s. The previous one is at %s. %s\n", *from, saved, reloadHint)
+}
+
+func runDBCheck() {
+	problems, err := database.IntegrityCheck()
+	if err != nil {
+		log.Fatalf("Failed to check the database: %v", err)
+	}
+	version, err := database.SchemaVersion()
+	if err != nil {
+		log.Fatalf("Failed to read schema version: %v", err)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("Database %s (schema version %d) has problems:\n", dbPath, version)
+		for _, p := range problems {
+			fmt.Printf("  %s\n", p)
+		}
+		fmt.Println("Restore a backup with 'lsm db restore --from <file>'.")
+		os.Exit(1)
+	}
+	fmt.Printf("Database %s (schema version %d) is ok.\n", dbPath, version)
+}
+
+func runDBAutoBackup(args []string) {
+	cmd := flag.NewFlagSet("db auto-backup", flag.ExitOnError)
+	schedule := cmd.String("schedule", "", "Cron schedule, empty disables automatic backups")
+	dir := cmd.String("dir", "", "Backup directory (empty: backups/ next to the database)")
+	keep := cmd.Int("keep", 7, "Newest automatic backups to keep (0 = all)")
+	cmd.Parse(args)
+
+	cfg, err := store.GetBackupConfig()
+	if err != nil {
+		log.Fatalf("Failed to get backup config: %v", err)
+	}
+	if cmd.NFlag() == 0 {
+		schedule := cfg.Schedule
+		if schedule == "" {
+			schedule = "disabled"
+		}
+		fmt.Printf("Schedule: %s\nDirectory: %s\nKeep: %d\n", schedule, database.BackupDir(*cfg), cfg.Keep)
+		return
+	}
+
+	if isFlagSet(cmd, "schedule") {
+		if *schedule != "" {
+			validateSchedule(*schedule, "")
+		}
+		cfg.Schedule = *schedule
+	}
+	if isFlagSet(cmd, "dir") {
+		// The daemon resolves relative paths against its own directory
+		cfg.Dir = *dir
+		if abs, err := filepath.Abs(*dir); err == nil && *dir != "" {
+			cfg.Dir = abs
+		}
+	}
+	if isFlagSet(cmd, "keep") {
+		if *keep < 0 {
+			fmt.Println("Error: --keep must not be negative.")
+			os.Exit(1)
+		}
+		cfg.Keep = *keep
+	}
+	if err := store.SetBackupConfig(*cfg); err != nil {
+		log.Fatalf("Failed to update backup config: %v", err)
+	}
+	fmt.Println("Automatic backup configuration updated. " + reloadHint)
+}
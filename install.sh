@@ -48,11 +48,20 @@ Description=Linux Service Manager Daemon
 After=network.target
 
 [Service]
+# lsm reports readiness and "N services, M failing" (systemctl status) and pings the
+# watchdog while its monitor loop keeps up; a hung daemon is restarted
+Type=notify
+NotifyAccess=main
+WatchdogSec=60
 User=root
 ExecStart=$DEST daemon
+ExecReload=/bin/kill -HUP \$MAINPID
 WorkingDirectory=/root
 Restart=always
 RestartSec=5
+# SIGTERM only lsm, so restarts it is running can finish (lsm daemon --drain-timeout, 60s)
+KillMode=mixed
+TimeoutStopSec=90
 
 [Install]
 WantedBy=multi-user.target
@@ -66,4 +75,5 @@ systemctl restart lsm
 
 echo "SUCCESS! LSM installed and running."
 echo "Check status with: systemctl status lsm"
-echo "View logs with:    journalctl -u lsm -f"
+echo "View logs with:    tail -f $LOG_FILE"
+echo "To also log to the journal (journalctl -u lsm -f): lsm config-log --sinks file,journald"
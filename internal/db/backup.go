@@ -0,0 +1,317 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+)
+
+// autoBackupPrefix starts the names of automatic backups; only those are pruned.
+const autoBackupPrefix = "lsm-"
+
+// BackupConfig is the automatic backup run by the daemon.
+type BackupConfig struct {
+	Schedule string // Cron expression, empty disables automatic backups
+	Dir      string // Empty means a backups directory next to the database
+	Keep     int    // Newest automatic backups kept, 0 keeps all
+}
+
+// DefaultBackupConfig returns the backup settings used until auto-backup changes them.
+func DefaultBackupConfig() *BackupConfig {
+	return &BackupConfig{Keep: 7}
+}
+
+// BackupDir returns the directory automatic backups with cfg go to.
+func (st *SQLiteStore) BackupDir(cfg BackupConfig) string {
+	if cfg.Dir != "" {
+		return cfg.Dir
+	}
+	return filepath.Join(filepath.Dir(st.path), "backups")
+}
+
+// GetBackupConfig returns the automatic backup settings.
+func (st *SQLiteStore) GetBackupConfig() (*BackupConfig, error) {
+	rows, err := st.db.Query("SELECT key, value FROM app_config WHERE key LIKE 'backup_%'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cfg := DefaultBackupConfig()
+	for rows.Next() {
+		var k, v string
+		if err := rows.Scan(&k, &v); err != nil {
+			continue
+		}
+		switch k {
+		case "backup_schedule":
+			cfg.Schedule = v
+		case "backup_dir":
+			cfg.Dir = v
+		case "backup_keep":
+			fmt.Sscanf(v, "%d", &cfg.Keep)
+		}
+	}
+	return cfg, rows.Err()
+}
+
+// SetBackupConfig stores the automatic backup settings.
+func (st *SQLiteStore) SetBackupConfig(cfg BackupConfig) error {
+	keys := map[string]string{
+		"backup_schedule": cfg.Schedule,
+		"backup_dir":      cfg.Dir,
+		"backup_keep":     strconv.Itoa(cfg.Keep),
+	}
+	return st.inTx(func(tx *sql.Tx) error {
+		for k, v := range keys {
+			if _, err := tx.Exec("INSERT OR REPLACE INTO app_config(key, value) VALUES(?, ?)", k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Backup writes a consistent copy of the database to path with VACUUM INTO,
+// which is safe while the daemon writes. path must not exist yet.
+func (st *SQLiteStore) Backup(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := createPrivate(path); err != nil {
+		return err
+	}
+	if _, err := st.exec("VACUUM INTO ?", path); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+// createPrivate creates the empty file path, which must not exist yet, for
+// VACUUM INTO to fill. The copy holds commands and environment variables of
+// every service, so only the owner may read it, from the start.
+func createPrivate(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("%s already exists", path)
+	}
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// copyPrivate copies the file src to dst, which must not exist yet, readable
+// only by the owner like the backups.
+func copyPrivate(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// readOnlyURI returns the URI that opens the database at path read-only.
+// The path is escaped, a '?' or '#' in it would end it otherwise.
+func readOnlyURI(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	u := url.URL{Scheme: "file", Path: path, RawQuery: "mode=ro"}
+	return u.String()
+}
+
+// AutoBackup writes a timestamped backup to cfg's directory and removes the
+// oldest automatic backups beyond cfg.Keep. It returns the new file and the
+// removed ones.
+func (st *SQLiteStore) AutoBackup(cfg BackupConfig) (string, []string, error) {
+	dir := st.BackupDir(cfg)
+	path := filepath.Join(dir, autoBackupPrefix+time.Now().Format("20060102-150405")+".db")
+	if err := st.Backup(path); err != nil {
+		return "", nil, err
+	}
+	if cfg.Keep <= 0 {
+		return path, nil, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return path, nil, err
+	}
+	var backups []string
+	for _, e := range entries {
+		if name := e.Name(); strings.HasPrefix(name, autoBackupPrefix) && strings.HasSuffix(name, ".db") {
+			backups = append(backups, name)
+		}
+	}
+	// The timestamps sort by age
+	sort.Strings(backups)
+	removed, err := removeOldest(dir, backups, cfg.Keep)
+	return path, removed, err
+}
+
+// removeOldest removes the files of dir in names, sorted oldest first, until
+// keep are left. It returns the removed files.
+func removeOldest(dir string, names []string, keep int) ([]string, error) {
+	var removed []string
+	for len(names) > keep {
+		old := filepath.Join(dir, names[0])
+		if err := os.Remove(old); err != nil {
+			return removed, err
+		}
+		removed = append(removed, old)
+		names = names[1:]
+	}
+	return removed, nil
+}
+
+// IntegrityCheck runs PRAGMA integrity_check and returns the problems it
+// found, none for a sound database.
+func (st *SQLiteStore) IntegrityCheck() ([]string, error) {
+	return integrityCheck(st.db)
+}
+
+func integrityCheck(conn *sql.DB) ([]string, error) {
+	rows, err := conn.Query("PRAGMA integrity_check")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return nil, err
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	return problems, rows.Err()
+}
+
+// Restore replaces the content of the database with the backup at path, using
+// SQLite's online backup so connections of a running daemon stay valid. The
+// backup must pass the integrity check and must not come from a newer schema;
+// older ones are migrated afterwards. The current content is saved first, the
+// returned path tells where.
+func (st *SQLiteStore) Restore(path string) (string, error) {
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+	version, err := checkBackup(path)
+	if err != nil {
+		return "", err
+	}
+	if version > LatestVersion() {
+		return "", fmt.Errorf("%s has schema version %d, newer than this lsm supports (%d)", path, version, LatestVersion())
+	}
+
+	saved := fmt.Sprintf("%s.pre-restore-%s.bak", st.path, time.Now().Format("20060102-150405"))
+	if err := st.Backup(saved); err != nil {
+		// A damaged database may not be readable by VACUUM, keep its file as it is
+		if err := copyPrivate(st.path, saved); err != nil {
+			return "", fmt.Errorf("saving the current database failed: %v", err)
+		}
+	}
+
+	conn, err := st.db.Conn(context.Background())
+	if err != nil {
+		return saved, err
+	}
+	defer conn.Close()
+
+	err = retry(func() error {
+		return conn.Raw(func(dc any) error {
+			r, ok := dc.(interface {
+				NewRestore(string) (*sqlite.Backup, error)
+			})
+			if !ok {
+				return fmt.Errorf("the SQLite driver doesn't support restoring")
+			}
+			b, err := r.NewRestore(readOnlyURI(path))
+			if err != nil {
+				return err
+			}
+			if _, err := b.Step(-1); err != nil {
+				b.Finish()
+				return err
+			}
+			return b.Finish()
+		})
+	})
+	if err != nil {
+		return saved, err
+	}
+
+	// Bring a backup from an older lsm up to date
+	return saved, st.migrate()
+}
+
+// checkBackup opens the database at path read-only, checks its integrity and
+// returns its schema version (0 if it predates versioned migrations).
+func checkBackup(path string) (int, error) {
+	conn, err := sql.Open("sqlite", readOnlyURI(path))
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	problems, err := integrityCheck(conn)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a readable database: %v", path, err)
+	}
+	if len(problems) > 0 {
+		return 0, fmt.Errorf("%s fails the integrity check: %s", path, strings.Join(problems, "; "))
+	}
+
+	tables := map[string]bool{}
+	rows, err := conn.Query("SELECT name FROM sqlite_master WHERE type = 'table'")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return 0, err
+		}
+		tables[name] = true
+	}
+	rows.Close()
+
+	if !tables["services"] {
+		return 0, fmt.Errorf("%s is not an lsm database", path)
+	}
+	if !tables["schema_version"] {
+		return 0, nil
+	}
+
+	var version sql.NullInt64
+	err = conn.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version)
+	return int(version.Int64), err
+}
@@ -0,0 +1,94 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// The daemon and CLI commands use the same file at the same time. WAL lets
+// readers go on while one connection writes, and busy_timeout makes SQLite
+// wait for the write lock instead of failing at once. Transactions take the
+// write lock when they begin (_txlock=immediate), as upgrading a read lock
+// later fails without waiting.
+const (
+	busyTimeout  = 5 * time.Second
+	maxOpenConns = 4
+	busyRetries  = 5                      // Attempts of a write that still finds the database locked
+	retryDelay   = 100 * time.Millisecond // Doubled after each attempt
+)
+
+// dsn returns the data source name for the database at path.
+func dsn(path string) string {
+	return fmt.Sprintf("%s?_pragma=busy_timeout(%d)&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_txlock=immediate",
+		path, busyTimeout.Milliseconds())
+}
+
+// open opens the database at path with the settings above.
+func open(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", dsn(path))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxOpenConns)
+	return db, nil
+}
+
+// isBusy reports whether err means the database stayed locked for longer than
+// busy_timeout.
+func isBusy(err error) bool {
+	var se *sqlite.Error
+	if !errors.As(err, &se) {
+		return false
+	}
+	code := se.Code() & 0xff // Primary code of an extended one, e.g. SQLITE_BUSY_SNAPSHOT
+	return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+}
+
+// retry runs fn until it succeeds, fails with another error than SQLITE_BUSY,
+// or busyRetries attempts were made.
+func retry(fn func() error) error {
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !isBusy(err) || attempt == busyRetries {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// exec runs a single write statement, retrying while the database is locked.
+func (st *SQLiteStore) exec(query string, args ...any) (sql.Result, error) {
+	var res sql.Result
+	err := retry(func() error {
+		var err error
+		res, err = st.db.Exec(query, args...)
+		return err
+	})
+	return res, err
+}
+
+// inTx runs fn in a transaction and commits it if fn returns nil. The whole
+// transaction is retried while the database is locked, so fn must not have
+// effects outside of tx.
+func (st *SQLiteStore) inTx(fn func(tx *sql.Tx) error) error {
+	return retry(func() error {
+		tx, err := st.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
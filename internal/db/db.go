@@ -2,9 +2,9 @@ package db
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
-	"os"
-	"path/filepath"
+	"strings"
 	"time"
 
 	_ "modernc.org/sqlite"
@@ -16,66 +16,135 @@ type Service struct {
 	RestartCommand string
 	CheckCommand   string
 	StatusCommand  string // Used to check if service is running before scheduled restart
+	StartCommand   string // Used by scheduled "start" actions
+	StopCommand    string // Used by scheduled "stop" actions
 	CronSchedule   string
+	VerifyDelay    time.Duration // Settle time before re-running the check after a restart
+	VerifyTimeout  time.Duration // Deadline for the check to pass again, 0 disables verification
+	OnVerifyFailed string        // Command run when verification fails (rollback, escalation)
+	CommandTimeout time.Duration // Applies to every command and hook of the service
+	PreRestart     string        // Hook run before a restart, non-zero exit vetoes the restart
+	PostRestart    string        // Hook run after a successful restart
+	OnFailure      string        // Hook run when the check starts failing
+	OnRecovery     string        // Hook run when the check passes again after failing
+	RunAsUser      string        // Commands run as this user instead of root
+	RunAsGroup     string        // Primary group, defaults to the user's
+	Groups         []string      // Supplementary groups
+	WorkDir        string        // Working directory, defaults to the user's home
+	Env            []string      // KEY=VALUE pairs, applied after EnvFile
+	EnvFile        string        // File with KEY=VALUE lines, read on every run
+	Umask          string        // Octal, e.g. "027". Empty keeps the daemon's
+	Sandbox        Sandbox       // Resource limits and isolation for every command and hook
+	Resources      ResourceCheck // Restart when the service's process exceeds thresholds
+	LogCheck       LogCheck      // Fail the check on log patterns or a stalled log
+	Checks         CheckSet      // Further checks, combined with CheckCommand
+	OwnLog         bool          // Also log the service's lines to a file of its own
 	Enabled        bool
 	LastChecked    *time.Time // Pointer to handle NULL
 	LastRestarted  *time.Time // Pointer to handle NULL
+
+	// Run-time state, not changed by AddService and UpdateService
+	Failing           bool          // The last check failed
+	LastCheckDuration time.Duration // How long the last check took
+	SilencedUntil     *time.Time    // Checked but not restarted until then, see SilenceService
+	ScheduleLastRun   *time.Time    // When CronSchedule last ran, see UpdateServiceScheduleLastRun
+}
+
+// Silenced reports whether the monitor leaves the service alone for now.
+func (s Service) Silenced() bool {
+	return s.SilencedUntil != nil && time.Now().Before(*s.SilencedUntil)
 }
 
-var DB *sql.DB
+func (st *SQLiteStore) AddService(s Service) error {
+	query := `INSERT INTO services(name, restart_command, check_command, status_command, start_command, stop_command, cron_schedule,
+		verify_delay_ms, verify_timeout_ms, on_verify_failed, command_timeout_ms, pre_restart, post_restart, on_failure, on_recovery,
+		run_as_user, run_as_group, supplementary_groups, work_dir, env, env_file, umask, sandbox, resource_check, log_check, checks, own_log, enabled)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
-func InitDB(filepathStr string) error {
-	// Ensure directory exists
-	if err := os.MkdirAll(filepath.Dir(filepathStr), 0755); err != nil {
+	sandbox, err := json.Marshal(s.Sandbox)
+	if err != nil {
 		return err
 	}
-
-	var err error
-	DB, err = sql.Open("sqlite", filepathStr)
+	resources, err := json.Marshal(s.Resources)
 	if err != nil {
 		return err
 	}
-
-	createTableServices := `
-	CREATE TABLE IF NOT EXISTS services (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		name TEXT NOT NULL UNIQUE,
-		restart_command TEXT NOT NULL,
-		check_command TEXT NOT NULL,
-		status_command TEXT,
-		cron_schedule TEXT,
-		enabled BOOLEAN DEFAULT 1,
-		last_checked DATETIME,
-		last_restarted DATETIME
-	);
-	`
-	if _, err := DB.Exec(createTableServices); err != nil {
+	logCheck, err := json.Marshal(s.LogCheck)
+	if err != nil {
+		return err
+	}
+	checks, err := json.Marshal(s.Checks)
+	if err != nil {
 		return err
 	}
 
-	createTableConfig := `
-	CREATE TABLE IF NOT EXISTS app_config (
-		key TEXT PRIMARY KEY,
-		value TEXT
-	);
-	`
-	_, err = DB.Exec(createTableConfig)
+	_, err = st.exec(query, s.Name, s.RestartCommand, s.CheckCommand, s.StatusCommand, s.StartCommand, s.StopCommand, s.CronSchedule,
+		s.VerifyDelay.Milliseconds(), s.VerifyTimeout.Milliseconds(), s.OnVerifyFailed,
+		s.CommandTimeout.Milliseconds(), s.PreRestart, s.PostRestart, s.OnFailure, s.OnRecovery,
+		s.RunAsUser, s.RunAsGroup, strings.Join(s.Groups, ","), s.WorkDir, strings.Join(s.Env, "\n"), s.EnvFile, s.Umask, string(sandbox), string(resources), string(logCheck), string(checks), s.OwnLog, s.Enabled)
 	return err
 }
 
-func AddService(s Service) error {
-	stmt, err := DB.Prepare("INSERT INTO services(name, restart_command, check_command, status_command, cron_schedule, enabled) VALUES(?, ?, ?, ?, ?, ?)")
-	if err != nil {
-		return err
+// splitNonEmpty splits s and drops empty parts, so "" gives a nil slice
+func splitNonEmpty(s, sep string) []string {
+	var parts []string
+	for _, p := range strings.Split(s, sep) {
+		if p = strings.TrimSpace(p); p != "" {
+			parts = append(parts, p)
+		}
 	}
-	defer stmt.Close()
+	return parts
+}
 
-	_, err = stmt.Exec(s.Name, s.RestartCommand, s.CheckCommand, s.StatusCommand, s.CronSchedule, s.Enabled)
-	return err
+// seconds converts a duration to the whole seconds stored in INTEGER columns
+func seconds(d time.Duration) int64 {
+	return int64(d / time.Second)
 }
 
-func ListServices() ([]Service, error) {
-	rows, err := DB.Query("SELECT id, name, restart_command, check_command, status_command, cron_schedule, enabled, last_checked, last_restarted FROM services")
+const serviceColumns = `id, name, restart_command, check_command, status_command, start_command, stop_command, cron_schedule,
+	verify_delay_ms, verify_timeout_ms, on_verify_failed, command_timeout_ms, pre_restart, post_restart, on_failure, on_recovery,
+	run_as_user, run_as_group, supplementary_groups, work_dir, env, env_file, umask, sandbox, resource_check, log_check, checks, own_log,
+	enabled, last_checked, last_restarted, failing, last_check_ms, silenced_until, schedule_last_run`
+
+// scanner is satisfied by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanService(row scanner) (Service, error) {
+	var s Service
+	var verifyDelayMS, verifyTimeoutMS, commandTimeoutMS, lastCheckMS int64
+	var groups, env, sandbox, resources, logCheck, checks string
+	err := row.Scan(&s.ID, &s.Name, &s.RestartCommand, &s.CheckCommand, &s.StatusCommand, &s.StartCommand, &s.StopCommand, &s.CronSchedule,
+		&verifyDelayMS, &verifyTimeoutMS, &s.OnVerifyFailed, &commandTimeoutMS, &s.PreRestart, &s.PostRestart, &s.OnFailure, &s.OnRecovery,
+		&s.RunAsUser, &s.RunAsGroup, &groups, &s.WorkDir, &env, &s.EnvFile, &s.Umask, &sandbox, &resources, &logCheck, &checks, &s.OwnLog,
+		&s.Enabled, &s.LastChecked, &s.LastRestarted, &s.Failing, &lastCheckMS, &s.SilencedUntil, &s.ScheduleLastRun)
+	if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal([]byte(sandbox), &s.Sandbox); err != nil {
+		return s, fmt.Errorf("service %s: invalid sandbox settings: %v", s.Name, err)
+	}
+	if err := json.Unmarshal([]byte(resources), &s.Resources); err != nil {
+		return s, fmt.Errorf("service %s: invalid resource check settings: %v", s.Name, err)
+	}
+	if err := json.Unmarshal([]byte(logCheck), &s.LogCheck); err != nil {
+		return s, fmt.Errorf("service %s: invalid log check settings: %v", s.Name, err)
+	}
+	if err := json.Unmarshal([]byte(checks), &s.Checks); err != nil {
+		return s, fmt.Errorf("service %s: invalid check settings: %v", s.Name, err)
+	}
+	s.Groups = splitNonEmpty(groups, ",")
+	s.Env = splitNonEmpty(env, "\n")
+	s.VerifyDelay = time.Duration(verifyDelayMS) * time.Millisecond
+	s.VerifyTimeout = time.Duration(verifyTimeoutMS) * time.Millisecond
+	s.CommandTimeout = time.Duration(commandTimeoutMS) * time.Millisecond
+	s.LastCheckDuration = time.Duration(lastCheckMS) * time.Millisecond
+	return s, err
+}
+
+func (st *SQLiteStore) ListServices() ([]Service, error) {
+	rows, err := st.db.Query("SELECT " + serviceColumns + " FROM services")
 	if err != nil {
 		return nil, err
 	}
@@ -83,8 +152,7 @@ func ListServices() ([]Service, error) {
 
 	var services []Service
 	for rows.Next() {
-		var s Service
-		err = rows.Scan(&s.ID, &s.Name, &s.RestartCommand, &s.CheckCommand, &s.StatusCommand, &s.CronSchedule, &s.Enabled, &s.LastChecked, &s.LastRestarted)
+		s, err := scanService(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -93,82 +161,195 @@ func ListServices() ([]Service, error) {
 	return services, nil
 }
 
-func GetService(name string) (*Service, error) {
-	var s Service
-	err := DB.QueryRow("SELECT id, name, restart_command, check_command, status_command, cron_schedule, enabled, last_checked, last_restarted FROM services WHERE name = ?", name).
-		Scan(&s.ID, &s.Name, &s.RestartCommand, &s.CheckCommand, &s.StatusCommand, &s.CronSchedule, &s.Enabled, &s.LastChecked, &s.LastRestarted)
+func (st *SQLiteStore) GetService(name string) (*Service, error) {
+	s, err := scanService(st.db.QueryRow("SELECT "+serviceColumns+" FROM services WHERE name = ?", name))
 	if err != nil {
 		return nil, err
 	}
 	return &s, nil
 }
 
-func ToggleService(name string, enable bool) error {
-	stmt, err := DB.Prepare("UPDATE services SET enabled = ? WHERE name = ?")
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-
-	_, err = stmt.Exec(enable, name)
+func (st *SQLiteStore) ToggleService(name string, enable bool) error {
+	_, err := st.exec("UPDATE services SET enabled = ? WHERE name = ?", enable, name)
 	return err
 }
 
-func RemoveService(name string) error {
-	_, err := DB.Exec("DELETE FROM services WHERE name = ?", name)
-	return err
+func (st *SQLiteStore) RemoveService(name string) error {
+	return st.inTx(func(tx *sql.Tx) error {
+		// Schedules reference the service by id, drop them first
+		if _, err := tx.Exec("DELETE FROM schedules WHERE service_id IN (SELECT id FROM services WHERE name = ?)", name); err != nil {
+			return err
+		}
+		_, err := tx.Exec("DELETE FROM services WHERE name = ?", name)
+		return err
+	})
 }
 
-func UpdateService(s Service) error {
+func (st *SQLiteStore) UpdateService(s Service) error {
+	sandbox, err := json.Marshal(s.Sandbox)
+	if err != nil {
+		return err
+	}
+	resources, err := json.Marshal(s.Resources)
+	if err != nil {
+		return err
+	}
+	logCheck, err := json.Marshal(s.LogCheck)
+	if err != nil {
+		return err
+	}
+	checks, err := json.Marshal(s.Checks)
+	if err != nil {
+		return err
+	}
+
 	// We only update mutable fields. ID and Name are identification.
 	// Actually Name could be mutable but let's keep it simple for now as ID.
+	// A new --schedule starts without a last run, like UpdateSchedule.
 	query := `
 		UPDATE services 
-		SET restart_command = ?, check_command = ?, status_command = ?, cron_schedule = ?, enabled = ?
+		SET schedule_last_run = CASE WHEN cron_schedule = ? THEN schedule_last_run END,
+			restart_command = ?, check_command = ?, status_command = ?, start_command = ?, stop_command = ?, cron_schedule = ?,
+			verify_delay_ms = ?, verify_timeout_ms = ?, on_verify_failed = ?,
+			command_timeout_ms = ?, pre_restart = ?, post_restart = ?, on_failure = ?, on_recovery = ?,
+			run_as_user = ?, run_as_group = ?, supplementary_groups = ?, work_dir = ?, env = ?, env_file = ?, umask = ?, sandbox = ?, resource_check = ?, log_check = ?, checks = ?, own_log = ?, enabled = ?
 		WHERE name = ?
 	`
-	_, err := DB.Exec(query, s.RestartCommand, s.CheckCommand, s.StatusCommand, s.CronSchedule, s.Enabled, s.Name)
+	_, err = st.exec(query, s.CronSchedule, s.RestartCommand, s.CheckCommand, s.StatusCommand, s.StartCommand, s.StopCommand, s.CronSchedule,
+		s.VerifyDelay.Milliseconds(), s.VerifyTimeout.Milliseconds(), s.OnVerifyFailed,
+		s.CommandTimeout.Milliseconds(), s.PreRestart, s.PostRestart, s.OnFailure, s.OnRecovery,
+		s.RunAsUser, s.RunAsGroup, strings.Join(s.Groups, ","), s.WorkDir, strings.Join(s.Env, "\n"), s.EnvFile, s.Umask, string(sandbox), string(resources), string(logCheck), string(checks), s.OwnLog, s.Enabled, s.Name)
 	return err
 }
 
+// Sandbox limits what a service's commands can do. Zero values mean "not set".
+type Sandbox struct {
+	LimitCPU         int    `json:"limit_cpu,omitempty"`            // RLIMIT_CPU, seconds
+	LimitMemory      int    `json:"limit_memory_mb,omitempty"`      // RLIMIT_AS, MB
+	LimitNoFile      int    `json:"limit_nofile,omitempty"`         // RLIMIT_NOFILE
+	LimitNProc       int    `json:"limit_nproc,omitempty"`          // RLIMIT_NPROC
+	Nice             int    `json:"nice,omitempty"`                 // -20..19
+	IOClass          string `json:"io_class,omitempty"`             // realtime, best-effort, idle
+	IOPriority       int    `json:"io_priority,omitempty"`          // 0..7 for realtime and best-effort
+	PrivateTmp       bool   `json:"private_tmp,omitempty"`          // Fresh tmpfs on /tmp
+	NoNewPrivs       bool   `json:"no_new_privs,omitempty"`         // No privilege gain through setuid binaries
+	CgroupMemoryMax  int    `json:"cgroup_memory_max_mb,omitempty"` // memory.max of a transient cgroup v2, MB
+	CgroupCPUPercent int    `json:"cgroup_cpu_percent,omitempty"`   // cpu.max of a transient cgroup v2, 100 = one CPU
+}
+
+// ResourceCheck restarts a service when its process exceeds a threshold for a
+// sustained time. Zero thresholds are not checked, an empty Target disables it.
+type ResourceCheck struct {
+	Target     string        `json:"target,omitempty"` // pidfile:<path>, systemd:<unit> or name:<process>
+	MaxRSS     int           `json:"max_rss_mb,omitempty"`
+	MaxCPU     float64       `json:"max_cpu_percent,omitempty"` // 100 = one CPU
+	MaxFDs     int           `json:"max_fds,omitempty"`
+	MaxThreads int           `json:"max_threads,omitempty"`
+	MaxUptime  time.Duration `json:"max_uptime,omitempty"`
+	For        time.Duration `json:"for,omitempty"` // How long a threshold must be exceeded
+}
+
+// Check modes, how the results of a service's checks are combined
+const (
+	CheckModeAll    = "all"    // Healthy if every check passes
+	CheckModeAny    = "any"    // Healthy if at least one check passes
+	CheckModeQuorum = "quorum" // Healthy if the weights of the passing checks add up to Quorum
+)
+
+// ValidCheckMode reports whether mode is one of the check modes above. Empty
+// means CheckModeAll.
+func ValidCheckMode(mode string) bool {
+	switch mode {
+	case "", CheckModeAll, CheckModeAny, CheckModeQuorum:
+		return true
+	}
+	return false
+}
+
+// CheckSet holds a service's named checks, which are evaluated together with
+// its CheckCommand.
+type CheckSet struct {
+	Mode   string  `json:"mode,omitempty"`   // Empty means CheckModeAll
+	Quorum int     `json:"quorum,omitempty"` // Weight needed with CheckModeQuorum
+	Checks []Check `json:"checks,omitempty"`
+}
+
+// Check is one named health check.
+type Check struct {
+	Name    string        `json:"name"`
+	Command string        `json:"command"`
+	Timeout time.Duration `json:"timeout,omitempty"` // 0 uses the service's CommandTimeout
+	Weight  int           `json:"weight,omitempty"`  // 0 counts as 1
+}
+
+// LogCheck fails a service's check based on what it logs. Lines come from
+// File (followed across rotation) or from the output of Command; with neither
+// set the check is disabled.
+type LogCheck struct {
+	File    string        `json:"file,omitempty"`
+	Command string        `json:"command,omitempty"` // Long-running, e.g. journalctl -f -u app
+	Pattern string        `json:"pattern,omitempty"` // Go regexp
+	Count   int           `json:"count,omitempty"`   // Matches needed within Window, default 1
+	Window  time.Duration `json:"window,omitempty"`  // 0 counts matches since the last restart
+	Stall   time.Duration `json:"stall,omitempty"`   // Fail if no lines arrive for this long, 0 disables
+}
+
 type LogConfig struct {
 	MaxSize    int // MB
 	MaxBackups int
 	MaxAge     int // Days
 	Compress   bool
+	Level      string   // debug, info, warn, error
+	Format     string   // text or json
+	Sinks      []string // Any of file, stdout, stderr, syslog, journald
+	SyslogAddr string   // Unix socket of the syslog daemon, empty for the system default
 }
 
-func SetLogConfig(cfg LogConfig) error {
+func (st *SQLiteStore) SetLogConfig(cfg LogConfig) error {
 	// Upsert keys
 	keys := map[string]string{
 		"log_max_size":    fmt.Sprintf("%d", cfg.MaxSize),
 		"log_max_backups": fmt.Sprintf("%d", cfg.MaxBackups),
 		"log_max_age":     fmt.Sprintf("%d", cfg.MaxAge),
 		"log_compress":    fmt.Sprintf("%t", cfg.Compress),
+		"log_level":       cfg.Level,
+		"log_format":      cfg.Format,
+		"log_sinks":       strings.Join(cfg.Sinks, ","),
+		"log_syslog_addr": cfg.SyslogAddr,
 	}
 
-	for k, v := range keys {
-		_, err := DB.Exec("INSERT OR REPLACE INTO app_config(key, value) VALUES(?, ?)", k, v)
-		if err != nil {
-			return err
+	// All or nothing, so a reader never sees half a configuration
+	return st.inTx(func(tx *sql.Tx) error {
+		for k, v := range keys {
+			if _, err := tx.Exec("INSERT OR REPLACE INTO app_config(key, value) VALUES(?, ?)", k, v); err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+}
+
+// DefaultLogConfig returns the log settings used until config-log changes them.
+func DefaultLogConfig() *LogConfig {
+	return &LogConfig{
+		MaxSize:    10, // Default 10MB
+		MaxBackups: 3,  // Default 3 files
+		MaxAge:     28, // Default 28 days
+		Compress:   true,
+		Level:      "info",
+		Format:     "text",
+		Sinks:      []string{"file"},
 	}
-	return nil
 }
 
-func GetLogConfig() (*LogConfig, error) {
-	rows, err := DB.Query("SELECT key, value FROM app_config WHERE key LIKE 'log_%'")
+func (st *SQLiteStore) GetLogConfig() (*LogConfig, error) {
+	rows, err := st.db.Query("SELECT key, value FROM app_config WHERE key LIKE 'log_%'")
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	cfg := &LogConfig{
-		MaxSize:    10, // Default 10MB
-		MaxBackups: 3,  // Default 3 files
-		MaxAge:     28, // Default 28 days
-		Compress:   true,
-	}
+	cfg := DefaultLogConfig()
 
 	for rows.Next() {
 		var k, v string
@@ -184,24 +365,51 @@ func GetLogConfig() (*LogConfig, error) {
 			fmt.Sscanf(v, "%d", &cfg.MaxAge)
 		case "log_compress":
 			cfg.Compress = (v == "true")
+		case "log_level":
+			cfg.Level = v
+		case "log_format":
+			cfg.Format = v
+		case "log_sinks":
+			if sinks := splitNonEmpty(v, ","); len(sinks) > 0 {
+				cfg.Sinks = sinks
+			}
+		case "log_syslog_addr":
+			cfg.SyslogAddr = v
 		}
 	}
 	return cfg, nil
 }
 
-func UpdateLastChecked(id int) error {
-	_, err := DB.Exec("UPDATE services SET last_checked = ? WHERE id = ?", time.Now(), id)
+// UpdateLastChecked records when the service with id was checked, how long
+// the check took and whether it failed.
+func (st *SQLiteStore) UpdateLastChecked(id int, took time.Duration, failing bool) error {
+	_, err := st.exec("UPDATE services SET last_checked = ?, last_check_ms = ?, failing = ? WHERE id = ?",
+		time.Now(), took.Milliseconds(), failing, id)
+	return err
+}
+
+// SilenceService makes the monitor leave the service alone until until, or
+// again right away if it is nil.
+func (st *SQLiteStore) SilenceService(name string, until *time.Time) error {
+	_, err := st.exec("UPDATE services SET silenced_until = ? WHERE name = ?", until, name)
+	return err
+}
+
+// UpdateServiceScheduleLastRun records when the CronSchedule of the service
+// with id last ran.
+func (st *SQLiteStore) UpdateServiceScheduleLastRun(id int, t time.Time) error {
+	_, err := st.exec("UPDATE services SET schedule_last_run = ? WHERE id = ?", t, id)
 	return err
 }
 
-func UpdateLastRestarted(id int) error {
-	_, err := DB.Exec("UPDATE services SET last_restarted = ? WHERE id = ?", time.Now(), id)
+func (st *SQLiteStore) UpdateLastRestarted(id int) error {
+	_, err := st.exec("UPDATE services SET last_restarted = ? WHERE id = ?", time.Now(), id)
 	return err
 }
 
 // GetPauseConfig returns the pause_on_active_user setting
-func GetPauseConfig() (bool, error) {
-	row := DB.QueryRow("SELECT value FROM app_config WHERE key = 'pause_on_active_user'")
+func (st *SQLiteStore) GetPauseConfig() (bool, error) {
+	row := st.db.QueryRow("SELECT value FROM app_config WHERE key = 'pause_on_active_user'")
 	var val string
 	if err := row.Scan(&val); err != nil {
 		if err == sql.ErrNoRows {
@@ -213,11 +421,11 @@ func GetPauseConfig() (bool, error) {
 }
 
 // SetPauseConfig updates the pause_on_active_user setting
-func SetPauseConfig(enabled bool) error {
+func (st *SQLiteStore) SetPauseConfig(enabled bool) error {
 	val := "false"
 	if enabled {
 		val = "true"
 	}
-	_, err := DB.Exec("INSERT OR REPLACE INTO app_config (key, value) VALUES ('pause_on_active_user', ?)", val)
+	_, err := st.exec("INSERT OR REPLACE INTO app_config (key, value) VALUES ('pause_on_active_user', ?)", val)
 	return err
 }
@@ -0,0 +1,306 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// FileStore is a Store of services and schedules declared in a JSON file, for
+// hosts whose configuration is managed elsewhere (configuration management,
+// images). The services and schedules are read-only. Their run-time state —
+// last checked and restarted times, silences, last runs of schedules — as
+// well as the history and the settings are kept in an SQLite database, so
+// they survive restarts of the daemon like without a file.
+//
+// The file holds the JSON encoding of the Service and Schedule types, with
+// durations in nanoseconds like the JSON settings columns. Schedules name
+// their service in ServiceName. Omitted fields get the defaults of the
+// database columns, e.g. Enabled true and VerifyTimeout 30s:
+//
+//	{
+//	  "services": [{"Name": "nginx", "RestartCommand": "systemctl restart nginx", "CheckCommand": "curl -fsS localhost"}],
+//	  "schedules": [{"ServiceName": "nginx", "Action": "restart", "CronSchedule": "@daily"}]
+//	}
+type FileStore struct {
+	defs  *MemoryStore // The services and schedules of the file, without run-time state
+	state *SQLiteStore
+	path  string
+}
+
+// OpenFile loads the services and schedules declared in the file at path. The
+// run-time state, history and settings are kept in state.
+func OpenFile(path string, state *SQLiteStore) (*FileStore, error) {
+	defs, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStore{defs: defs, state: state, path: path}, nil
+}
+
+// readFile reads the services and schedules of the file at path.
+func readFile(path string) (*MemoryStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Services  []json.RawMessage `json:"services"`
+		Schedules []json.RawMessage `json:"schedules"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	m := NewMemoryStore()
+	for i, raw := range file.Services {
+		s := Service{
+			VerifyDelay:    5 * time.Second,
+			VerifyTimeout:  30 * time.Second,
+			CommandTimeout: 300 * time.Second,
+			Enabled:        true,
+		}
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, fmt.Errorf("%s: service %d: %v", path, i+1, err)
+		}
+		if s.Name == "" || s.RestartCommand == "" {
+			return nil, fmt.Errorf("%s: service %d: Name and RestartCommand are required", path, i+1)
+		}
+		if err := m.AddService(s); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	for i, raw := range file.Schedules {
+		sc := Schedule{Catchup: CatchupSkip, Enabled: true}
+		if err := json.Unmarshal(raw, &sc); err != nil {
+			return nil, fmt.Errorf("%s: schedule %d: %v", path, i+1, err)
+		}
+		s, ok := m.byName(sc.ServiceName)
+		if !ok {
+			return nil, fmt.Errorf("%s: schedule %d: no service named '%s'", path, i+1, sc.ServiceName)
+		}
+		if !ValidAction(sc.Action) || !ValidCatchup(sc.Catchup) {
+			return nil, fmt.Errorf("%s: schedule %d: invalid Action or Catchup", path, i+1)
+		}
+		sc.ServiceID = s.ID
+		m.AddSchedule(sc)
+	}
+	return m, nil
+}
+
+// Reload reads the file again. The run-time state is kept in the database, so
+// services keep theirs and unchanged schedules their last run.
+func (f *FileStore) Reload() error {
+	fresh, err := readFile(f.path)
+	if err != nil {
+		return err
+	}
+	f.defs.replaceConfig(fresh)
+	return nil
+}
+
+func (f *FileStore) readOnly() error {
+	return fmt.Errorf("%w (edit %s)", ErrReadOnly, f.path)
+}
+
+func (f *FileStore) AddService(Service) error         { return f.readOnly() }
+func (f *FileStore) UpdateService(Service) error      { return f.readOnly() }
+func (f *FileStore) RemoveService(string) error       { return f.readOnly() }
+func (f *FileStore) ToggleService(string, bool) error { return f.readOnly() }
+func (f *FileStore) AddSchedule(Schedule) error       { return f.readOnly() }
+func (f *FileStore) UpdateSchedule(Schedule) error    { return f.readOnly() }
+func (f *FileStore) ToggleSchedule(int, bool) error   { return f.readOnly() }
+func (f *FileStore) RemoveSchedule(int) error         { return f.readOnly() }
+
+func (f *FileStore) ListServices() ([]Service, error) {
+	services, err := f.defs.ListServices()
+	if err != nil {
+		return nil, err
+	}
+	states, err := f.state.fileServiceStates()
+	if err != nil {
+		return nil, err
+	}
+	for i, s := range services {
+		services[i] = withState(s, states[s.Name])
+	}
+	return services, nil
+}
+
+func (f *FileStore) GetService(name string) (*Service, error) {
+	s, err := f.defs.GetService(name)
+	if err != nil {
+		return nil, err
+	}
+	states, err := f.state.fileServiceStates()
+	if err != nil {
+		return nil, err
+	}
+	*s = withState(*s, states[name])
+	return s, nil
+}
+
+// serviceName returns the name of the service with id.
+func (f *FileStore) serviceName(id int) (string, bool) {
+	f.defs.mu.Lock()
+	defer f.defs.mu.Unlock()
+	s, ok := f.defs.services[id]
+	return s.Name, ok
+}
+
+// updateState sets columns of the state of the service with id, like
+// updateFileServiceState. Unknown services are ignored like by an UPDATE.
+func (f *FileStore) updateState(id int, set string, args ...any) error {
+	name, ok := f.serviceName(id)
+	if !ok {
+		return nil
+	}
+	return f.state.updateFileServiceState(name, set, args...)
+}
+
+func (f *FileStore) UpdateLastChecked(id int, took time.Duration, failing bool) error {
+	return f.updateState(id, "last_checked = ?, last_check_ms = ?, failing = ?", time.Now(), took.Milliseconds(), failing)
+}
+
+func (f *FileStore) UpdateLastRestarted(id int) error {
+	return f.updateState(id, "last_restarted = ?", time.Now())
+}
+
+func (f *FileStore) UpdateServiceScheduleLastRun(id int, t time.Time) error {
+	return f.updateState(id, "schedule_last_run = ?", t)
+}
+
+func (f *FileStore) SilenceService(name string, until *time.Time) error {
+	if _, err := f.defs.GetService(name); err != nil {
+		return nil
+	}
+	return f.state.updateFileServiceState(name, "silenced_until = ?", until)
+}
+
+// LockService locks the service name in the lock directory of the database.
+func (f *FileStore) LockService(name string) (func(), error) {
+	return f.state.LockService(name)
+}
+
+func (f *FileStore) ListSchedules(serviceName string) ([]Schedule, error) {
+	schedules, err := f.defs.ListSchedules(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	lastRuns, err := f.state.fileScheduleLastRuns()
+	if err != nil {
+		return nil, err
+	}
+	for i, sc := range schedules {
+		if t, ok := lastRuns[fileScheduleKey(sc)]; ok {
+			schedules[i].LastRun = &t
+		}
+	}
+	return schedules, nil
+}
+
+func (f *FileStore) GetSchedule(id int) (*Schedule, error) {
+	sc, err := f.defs.GetSchedule(id)
+	if err != nil {
+		return nil, err
+	}
+	lastRuns, err := f.state.fileScheduleLastRuns()
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := lastRuns[fileScheduleKey(*sc)]; ok {
+		sc.LastRun = &t
+	}
+	return sc, nil
+}
+
+func (f *FileStore) UpdateScheduleLastRun(id int, t time.Time) error {
+	sc, err := f.defs.GetSchedule(id)
+	if err != nil {
+		return nil // Like an UPDATE that matches no row
+	}
+	_, err = f.state.exec("INSERT OR REPLACE INTO file_schedule_state(schedule, last_run) VALUES(?, ?)", fileScheduleKey(*sc), t)
+	return err
+}
+
+func (f *FileStore) AddHistory(serviceName, event, detail string) error {
+	return f.state.AddHistory(serviceName, event, detail)
+}
+
+func (f *FileStore) ListHistory(serviceName string, limit int) ([]HistoryEntry, error) {
+	return f.state.ListHistory(serviceName, limit)
+}
+
+func (f *FileStore) CountHistory(serviceName, event string, since time.Time) (int, error) {
+	return f.state.CountHistory(serviceName, event, since)
+}
+
+func (f *FileStore) GetLogConfig() (*LogConfig, error)       { return f.state.GetLogConfig() }
+func (f *FileStore) SetLogConfig(cfg LogConfig) error        { return f.state.SetLogConfig(cfg) }
+func (f *FileStore) GetPauseConfig() (bool, error)           { return f.state.GetPauseConfig() }
+func (f *FileStore) SetPauseConfig(enabled bool) error       { return f.state.SetPauseConfig(enabled) }
+func (f *FileStore) GetBackupConfig() (*BackupConfig, error) { return f.state.GetBackupConfig() }
+func (f *FileStore) SetBackupConfig(cfg BackupConfig) error  { return f.state.SetBackupConfig(cfg) }
+
+// fileScheduleKey identifies a schedule of a file across reloads and restarts.
+// A schedule whose timing or catch-up changed is a new one, without a last run.
+func fileScheduleKey(sc Schedule) string {
+	return fmt.Sprintf("%q %q %q %q %q %q %d", sc.ServiceName, sc.Action, sc.Command, sc.CronSchedule, sc.Timezone, sc.Catchup, sc.CatchupGrace)
+}
+
+// fileServiceStates returns the run-time state of the services of a file by
+// name, in the run-time fields of Service.
+func (st *SQLiteStore) fileServiceStates() (map[string]Service, error) {
+	rows, err := st.db.Query("SELECT name, last_checked, last_restarted, failing, last_check_ms, silenced_until, schedule_last_run FROM file_service_state")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := map[string]Service{}
+	for rows.Next() {
+		var s Service
+		var lastCheckMS int64
+		if err := rows.Scan(&s.Name, &s.LastChecked, &s.LastRestarted, &s.Failing, &lastCheckMS, &s.SilencedUntil, &s.ScheduleLastRun); err != nil {
+			return nil, err
+		}
+		s.LastCheckDuration = time.Duration(lastCheckMS) * time.Millisecond
+		states[s.Name] = s
+	}
+	return states, rows.Err()
+}
+
+// updateFileServiceState runs "UPDATE ... SET set" on the state of the
+// service name of a file, adding its row first if needed.
+func (st *SQLiteStore) updateFileServiceState(name, set string, args ...any) error {
+	return st.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO file_service_state(name) VALUES(?)", name); err != nil {
+			return err
+		}
+		_, err := tx.Exec("UPDATE file_service_state SET "+set+" WHERE name = ?", append(args, name)...)
+		return err
+	})
+}
+
+// fileScheduleLastRuns returns the last runs of the schedules of a file by
+// fileScheduleKey.
+func (st *SQLiteStore) fileScheduleLastRuns() (map[string]time.Time, error) {
+	rows, err := st.db.Query("SELECT schedule, last_run FROM file_schedule_state")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lastRuns := map[string]time.Time{}
+	for rows.Next() {
+		var key string
+		var t time.Time
+		if err := rows.Scan(&key, &t); err != nil {
+			return nil, err
+		}
+		lastRuns[key] = t
+	}
+	return lastRuns, rows.Err()
+}
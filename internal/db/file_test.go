@@ -0,0 +1,89 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const servicesFile = `{
+  "services": [{"Name": "app", "RestartCommand": "systemctl restart app", "CheckCommand": "true"}],
+  "schedules": [{"ServiceName": "app", "Action": "restart", "CronSchedule": "@daily"}]
+}`
+
+func TestFileStoreKeepsStateInDatabase(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "services.json")
+	if err := os.WriteFile(path, []byte(servicesFile), 0600); err != nil {
+		t.Fatal(err)
+	}
+	st, err := OpenSQLite(filepath.Join(dir, "lsm.db"))
+	if err != nil {
+		t.Fatalf("OpenSQLite: %v", err)
+	}
+	defer st.Close()
+
+	f, err := OpenFile(path, st)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if err := f.AddService(Service{Name: "other"}); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("AddService: %v, want ErrReadOnly", err)
+	}
+	s, _ := f.GetService("app")
+	schedules, _ := f.ListSchedules("app")
+	now := time.Now()
+	until := now.Add(time.Hour)
+	for _, err := range []error{
+		f.UpdateLastChecked(s.ID, 2*time.Second, true),
+		f.UpdateLastRestarted(s.ID),
+		f.SilenceService("app", &until),
+		f.UpdateScheduleLastRun(schedules[0].ID, now),
+		f.AddHistory("app", EventRestarted, ""),
+		f.SetPauseConfig(true),
+	} {
+		if err != nil {
+			t.Fatalf("recording state: %v", err)
+		}
+	}
+
+	// As after a restart of the daemon
+	f, err = OpenFile(path, st)
+	if err != nil {
+		t.Fatalf("OpenFile again: %v", err)
+	}
+	s, err = f.GetService("app")
+	if err != nil {
+		t.Fatalf("GetService: %v", err)
+	}
+	if !near(s.LastChecked, now) || !near(s.LastRestarted, now) || !s.Failing || s.LastCheckDuration != 2*time.Second || !near(s.SilencedUntil, until) {
+		t.Errorf("service state after reopening: %+v", s)
+	}
+	if schedules, _ := f.ListSchedules("app"); !near(schedules[0].LastRun, now) {
+		t.Errorf("schedule last run after reopening = %v, want %v", schedules[0].LastRun, now)
+	}
+	if history, _ := f.ListHistory("app", 10); len(history) != 1 {
+		t.Errorf("got %d history entries, want 1", len(history))
+	}
+	if pause, _ := f.GetPauseConfig(); !pause {
+		t.Errorf("pause setting lost")
+	}
+
+	// A schedule that now runs at other times starts over
+	changed := strings.Replace(servicesFile, "@daily", "@hourly", 1)
+	if err := os.WriteFile(path, []byte(changed), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if schedules, _ := f.ListSchedules("app"); schedules[0].LastRun != nil {
+		t.Errorf("last run of the changed schedule = %v, want none", schedules[0].LastRun)
+	}
+	if s, _ := f.GetService("app"); !near(s.LastChecked, now) {
+		t.Errorf("service lost its state on reload: %+v", s)
+	}
+}
@@ -0,0 +1,69 @@
+package db
+
+import "time"
+
+// History events
+const (
+	EventScheduleMissed = "schedule_missed" // A scheduled run was due while the daemon was down
+	EventRestarted      = "restarted"       // Restart succeeded (and passed verification, if enabled)
+	EventRestartFailed  = "restart_failed"  // RestartCommand exited non-zero
+	EventVerifyFailed   = "verify_failed"   // Check did not pass again before the verification deadline
+	EventRestartVetoed  = "restart_vetoed"  // pre_restart hook exited non-zero
+	EventFailing        = "failing"         // Check started failing
+	EventRecovered      = "recovered"       // Check passes again after failing
+	EventResourceLimit  = "resource_limit"  // Process exceeded a resource threshold for the sustained time
+	EventInterrupted    = "interrupted"     // An action was cut off because the daemon stopped
+)
+
+// HistoryEntry is one recorded event of a service.
+type HistoryEntry struct {
+	ID          int
+	ServiceName string
+	Event       string
+	Detail      string
+	CreatedAt   time.Time
+}
+
+// AddHistory records an event. The service name is stored as-is so entries
+// survive the service being removed.
+func (st *SQLiteStore) AddHistory(serviceName, event, detail string) error {
+	_, err := st.exec("INSERT INTO history(service_name, event, detail, created_at) VALUES(?, ?, ?, ?)",
+		serviceName, event, detail, time.Now())
+	return err
+}
+
+// CountHistory returns how many event entries of serviceName were recorded since since.
+func (st *SQLiteStore) CountHistory(serviceName, event string, since time.Time) (int, error) {
+	var n int
+	err := st.db.QueryRow("SELECT COUNT(*) FROM history WHERE service_name = ? AND event = ? AND created_at >= ?",
+		serviceName, event, since).Scan(&n)
+	return n, err
+}
+
+// ListHistory returns the latest limit entries, newest first, optionally only for serviceName.
+func (st *SQLiteStore) ListHistory(serviceName string, limit int) ([]HistoryEntry, error) {
+	query := "SELECT id, service_name, event, detail, created_at FROM history"
+	var args []any
+	if serviceName != "" {
+		query += " WHERE service_name = ?"
+		args = append(args, serviceName)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := st.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []HistoryEntry
+	for rows.Next() {
+		var h HistoryEntry
+		if err := rows.Scan(&h.ID, &h.ServiceName, &h.Event, &h.Detail, &h.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, h)
+	}
+	return entries, nil
+}
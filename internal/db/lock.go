@@ -0,0 +1,56 @@
+package db
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// ErrLocked is returned by LockService while another process or goroutine
+// holds the lock of the service.
+var ErrLocked = errors.New("the service is locked by another restart")
+
+// lockService takes the lock of the service name with flock(2) on a file in
+// dir, so it also keeps out other processes. The kernel releases it when the
+// holder dies.
+func lockService(dir, name string) (func(), error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, url.PathEscape(name)+".lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	return func() { f.Close() }, nil // Unlocks
+}
+
+// LockService locks the service name against restarts by the daemon and lsm
+// top alike, until the returned function is called. The lock files are kept
+// in a directory next to the database.
+func (st *SQLiteStore) LockService(name string) (func(), error) {
+	return lockService(st.path+".locks", name)
+}
+
+// LockService locks the service name within the process.
+func (m *MemoryStore) LockService(name string) (func(), error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.locked[name] {
+		return nil, ErrLocked
+	}
+	m.locked[name] = true
+	return func() {
+		m.mu.Lock()
+		delete(m.locked, name)
+		m.mu.Unlock()
+	}, nil
+}
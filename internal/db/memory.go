@@ -0,0 +1,384 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store that keeps everything in memory, for tests and for
+// embedding LSM without a database file. Like SQLite, it hands out copies and
+// reports missing rows with sql.ErrNoRows.
+type MemoryStore struct {
+	mu        sync.Mutex
+	services  map[int]Service
+	schedules map[int]Schedule
+	history   []HistoryEntry
+	logConfig LogConfig
+	pause     bool
+	backup    BackupConfig
+	nextID    int             // Shared by services, schedules and history entries
+	locked    map[string]bool // Services locked by LockService
+}
+
+// NewMemoryStore returns an empty MemoryStore with default settings.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		services:  map[int]Service{},
+		schedules: map[int]Schedule{},
+		locked:    map[string]bool{},
+		logConfig: *DefaultLogConfig(),
+		backup:    *DefaultBackupConfig(),
+	}
+}
+
+func (m *MemoryStore) id() int {
+	m.nextID++
+	return m.nextID
+}
+
+// cloneService copies s so callers can't change the stored slices.
+func cloneService(s Service) Service {
+	s.Groups = slices.Clone(s.Groups)
+	s.Env = slices.Clone(s.Env)
+	s.Checks.Checks = slices.Clone(s.Checks.Checks)
+	return s
+}
+
+// withState returns s with the run-time state of old.
+func withState(s, old Service) Service {
+	s.LastChecked, s.LastRestarted = old.LastChecked, old.LastRestarted
+	s.Failing, s.LastCheckDuration, s.SilencedUntil = old.Failing, old.LastCheckDuration, old.SilencedUntil
+	s.ScheduleLastRun = old.ScheduleLastRun
+	return s
+}
+
+func (m *MemoryStore) byName(name string) (Service, bool) {
+	for _, s := range m.services {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return Service{}, false
+}
+
+// replaceConfig replaces the services and schedules with those of other.
+func (m *MemoryStore) replaceConfig(other *MemoryStore) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	other.mu.Lock()
+	defer other.mu.Unlock()
+
+	m.services, m.schedules, m.nextID = other.services, other.schedules, other.nextID
+}
+
+func (m *MemoryStore) ListServices() ([]Service, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	services := make([]Service, 0, len(m.services))
+	for _, s := range m.services {
+		services = append(services, cloneService(s))
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].ID < services[j].ID })
+	return services, nil
+}
+
+func (m *MemoryStore) GetService(name string) (*Service, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.byName(name)
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	s = cloneService(s)
+	return &s, nil
+}
+
+func (m *MemoryStore) AddService(s Service) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.byName(s.Name); ok {
+		return fmt.Errorf("service '%s' already exists", s.Name)
+	}
+	s = withState(s, Service{})
+	s.ID = m.id()
+	m.services[s.ID] = cloneService(s)
+	return nil
+}
+
+func (m *MemoryStore) UpdateService(s Service) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.byName(s.Name)
+	if !ok {
+		return nil // Like an UPDATE that matches no row
+	}
+	s = withState(s, old)
+	if s.CronSchedule != old.CronSchedule {
+		s.ScheduleLastRun = nil // Like UpdateSchedule
+	}
+	s.ID = old.ID
+	m.services[s.ID] = cloneService(s)
+	return nil
+}
+
+func (m *MemoryStore) RemoveService(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.byName(name)
+	if !ok {
+		return nil
+	}
+	for id, sc := range m.schedules {
+		if sc.ServiceID == s.ID {
+			delete(m.schedules, id)
+		}
+	}
+	delete(m.services, s.ID)
+	return nil
+}
+
+func (m *MemoryStore) ToggleService(name string, enable bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s, ok := m.byName(name); ok {
+		s.Enabled = enable
+		m.services[s.ID] = s
+	}
+	return nil
+}
+
+func (m *MemoryStore) UpdateLastChecked(id int, took time.Duration, failing bool) error {
+	return m.touch(id, func(s *Service, t *time.Time) {
+		s.LastChecked, s.LastCheckDuration, s.Failing = t, took, failing
+	})
+}
+
+func (m *MemoryStore) SilenceService(name string, until *time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s, ok := m.byName(name); ok {
+		s.SilencedUntil = until
+		m.services[s.ID] = s
+	}
+	return nil
+}
+
+func (m *MemoryStore) UpdateLastRestarted(id int) error {
+	return m.touch(id, func(s *Service, t *time.Time) { s.LastRestarted = t })
+}
+
+func (m *MemoryStore) UpdateServiceScheduleLastRun(id int, t time.Time) error {
+	return m.touch(id, func(s *Service, _ *time.Time) { s.ScheduleLastRun = &t })
+}
+
+func (m *MemoryStore) touch(id int, set func(s *Service, t *time.Time)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s, ok := m.services[id]; ok {
+		now := time.Now()
+		set(&s, &now)
+		m.services[id] = s
+	}
+	return nil
+}
+
+// withServiceName fills in the joined ServiceName, false if the service is gone.
+func (m *MemoryStore) withServiceName(sc Schedule) (Schedule, bool) {
+	s, ok := m.services[sc.ServiceID]
+	sc.ServiceName = s.Name
+	return sc, ok
+}
+
+func (m *MemoryStore) ListSchedules(serviceName string) ([]Schedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var schedules []Schedule
+	for _, sc := range m.schedules {
+		sc, ok := m.withServiceName(sc)
+		if ok && (serviceName == "" || sc.ServiceName == serviceName) {
+			schedules = append(schedules, sc)
+		}
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		a, b := schedules[i], schedules[j]
+		if a.ServiceName != b.ServiceName {
+			return a.ServiceName < b.ServiceName
+		}
+		return a.ID < b.ID
+	})
+	return schedules, nil
+}
+
+func (m *MemoryStore) GetSchedule(id int) (*Schedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sc, ok := m.schedules[id]
+	if ok {
+		sc, ok = m.withServiceName(sc)
+	}
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &sc, nil
+}
+
+func (m *MemoryStore) AddSchedule(sc Schedule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if sc.Catchup == "" {
+		sc.Catchup = CatchupSkip
+	}
+	sc.ID, sc.ServiceName, sc.LastRun = m.id(), "", nil
+	m.schedules[sc.ID] = sc
+	return nil
+}
+
+func (m *MemoryStore) UpdateSchedule(sc Schedule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.schedules[sc.ID]
+	if !ok {
+		return nil
+	}
+	if sc.Catchup == "" {
+		sc.Catchup = CatchupSkip
+	}
+	sc.ServiceID, sc.ServiceName, sc.Enabled, sc.LastRun = old.ServiceID, "", old.Enabled, nil
+	if sc.SameTiming(old) {
+		sc.LastRun = old.LastRun
+	}
+	m.schedules[sc.ID] = sc
+	return nil
+}
+
+func (m *MemoryStore) ToggleSchedule(id int, enable bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if sc, ok := m.schedules[id]; ok {
+		sc.Enabled = enable
+		m.schedules[id] = sc
+	}
+	return nil
+}
+
+func (m *MemoryStore) UpdateScheduleLastRun(id int, t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if sc, ok := m.schedules[id]; ok {
+		sc.LastRun = &t
+		m.schedules[id] = sc
+	}
+	return nil
+}
+
+func (m *MemoryStore) RemoveSchedule(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.schedules, id)
+	return nil
+}
+
+func (m *MemoryStore) AddHistory(serviceName, event, detail string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.history = append(m.history, HistoryEntry{
+		ID:          m.id(),
+		ServiceName: serviceName,
+		Event:       event,
+		Detail:      detail,
+		CreatedAt:   time.Now(),
+	})
+	return nil
+}
+
+func (m *MemoryStore) ListHistory(serviceName string, limit int) ([]HistoryEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var entries []HistoryEntry
+	for i := len(m.history) - 1; i >= 0 && len(entries) < limit; i-- {
+		if h := m.history[i]; serviceName == "" || h.ServiceName == serviceName {
+			entries = append(entries, h)
+		}
+	}
+	return entries, nil
+}
+
+func (m *MemoryStore) CountHistory(serviceName, event string, since time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	for _, h := range m.history {
+		if h.ServiceName == serviceName && h.Event == event && !h.CreatedAt.Before(since) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *MemoryStore) GetLogConfig() (*LogConfig, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cfg := m.logConfig
+	cfg.Sinks = slices.Clone(cfg.Sinks)
+	return &cfg, nil
+}
+
+func (m *MemoryStore) SetLogConfig(cfg LogConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cfg.Sinks = slices.Clone(cfg.Sinks)
+	m.logConfig = cfg
+	return nil
+}
+
+func (m *MemoryStore) GetPauseConfig() (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pause, nil
+}
+
+func (m *MemoryStore) SetPauseConfig(enabled bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pause = enabled
+	return nil
+}
+
+func (m *MemoryStore) GetBackupConfig() (*BackupConfig, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cfg := m.backup
+	return &cfg, nil
+}
+
+func (m *MemoryStore) SetBackupConfig(cfg BackupConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.backup = cfg
+	return nil
+}
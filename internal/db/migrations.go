@@ -0,0 +1,385 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// migration is one forward step of the schema. Migrations run in order of
+// Version, each in its own transaction, and are never changed once released:
+// a schema change is a new migration at the end of the list.
+type migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{1, "create tables", createTables},
+	{2, "check results and silence", checkState},
+	{3, "last run of service schedules", serviceScheduleLastRun},
+	{4, "run-time state of services from a file", fileState},
+	{5, "command timeout in milliseconds", commandTimeoutMS},
+	{6, "restart verification in milliseconds", verifyMS},
+}
+
+// LatestVersion is the schema version this binary migrates to.
+func LatestVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// createTables creates the tables. Databases from before versioned
+// migrations have them already, with any subset of the columns that used to
+// be added at every start, so those are added where missing.
+func createTables(tx *sql.Tx) error {
+	err := execAll(tx, `
+	CREATE TABLE IF NOT EXISTS services (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		restart_command TEXT NOT NULL,
+		check_command TEXT NOT NULL,
+		status_command TEXT,
+		cron_schedule TEXT,
+		enabled BOOLEAN DEFAULT 1,
+		last_checked DATETIME,
+		last_restarted DATETIME
+	);
+	`, `
+	CREATE TABLE IF NOT EXISTS app_config (
+		key TEXT PRIMARY KEY,
+		value TEXT
+	);
+	`, `
+	CREATE TABLE IF NOT EXISTS schedules (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		service_id INTEGER NOT NULL,
+		action TEXT NOT NULL,
+		command TEXT NOT NULL DEFAULT '',
+		cron_schedule TEXT NOT NULL,
+		enabled BOOLEAN DEFAULT 1
+	);
+	`, `
+	CREATE TABLE IF NOT EXISTS history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		service_name TEXT NOT NULL,
+		event TEXT NOT NULL,
+		detail TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	columns := []struct{ table, column, definition string }{
+		{"services", "start_command", "TEXT NOT NULL DEFAULT ''"},
+		{"services", "stop_command", "TEXT NOT NULL DEFAULT ''"},
+		{"services", "verify_delay", "INTEGER NOT NULL DEFAULT 5"},    // Seconds
+		{"services", "verify_timeout", "INTEGER NOT NULL DEFAULT 30"}, // Seconds
+		{"services", "on_verify_failed", "TEXT NOT NULL DEFAULT ''"},
+		{"services", "command_timeout", "INTEGER NOT NULL DEFAULT 300"}, // Seconds
+		{"services", "pre_restart", "TEXT NOT NULL DEFAULT ''"},
+		{"services", "post_restart", "TEXT NOT NULL DEFAULT ''"},
+		{"services", "on_failure", "TEXT NOT NULL DEFAULT ''"},
+		{"services", "on_recovery", "TEXT NOT NULL DEFAULT ''"},
+		{"services", "run_as_user", "TEXT NOT NULL DEFAULT ''"},
+		{"services", "run_as_group", "TEXT NOT NULL DEFAULT ''"},
+		{"services", "supplementary_groups", "TEXT NOT NULL DEFAULT ''"}, // Comma separated
+		{"services", "work_dir", "TEXT NOT NULL DEFAULT ''"},
+		{"services", "env", "TEXT NOT NULL DEFAULT ''"}, // One KEY=VALUE per line
+		{"services", "env_file", "TEXT NOT NULL DEFAULT ''"},
+		{"services", "umask", "TEXT NOT NULL DEFAULT ''"},
+		{"services", "sandbox", "TEXT NOT NULL DEFAULT '{}'"},        // JSON encoded Sandbox
+		{"services", "resource_check", "TEXT NOT NULL DEFAULT '{}'"}, // JSON encoded ResourceCheck
+		{"services", "log_check", "TEXT NOT NULL DEFAULT '{}'"},      // JSON encoded LogCheck
+		{"services", "checks", "TEXT NOT NULL DEFAULT '{}'"},         // JSON encoded CheckSet
+		{"services", "own_log", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"schedules", "timezone", "TEXT NOT NULL DEFAULT ''"},
+		{"schedules", "jitter", "INTEGER NOT NULL DEFAULT 0"}, // Seconds
+		{"schedules", "catchup", "TEXT NOT NULL DEFAULT 'skip'"},
+		{"schedules", "catchup_grace", "INTEGER NOT NULL DEFAULT 0"}, // Seconds
+		{"schedules", "last_run", "DATETIME"},
+	}
+	for _, col := range columns {
+		if err := addColumnIfMissing(tx, col.table, col.column, col.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkState adds the result of the last check, which 'lsm top' shows, and
+// the silence of 'lsm silence'.
+func checkState(tx *sql.Tx) error {
+	return execAll(tx,
+		"ALTER TABLE services ADD COLUMN failing BOOLEAN NOT NULL DEFAULT 0",
+		"ALTER TABLE services ADD COLUMN last_check_ms INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE services ADD COLUMN silenced_until DATETIME",
+	)
+}
+
+// serviceScheduleLastRun adds when the --schedule of a service last ran, for
+// catching up on runs missed while the daemon was down.
+func serviceScheduleLastRun(tx *sql.Tx) error {
+	return execAll(tx, "ALTER TABLE services ADD COLUMN schedule_last_run DATETIME")
+}
+
+// fileState adds the run-time state of the services and schedules of a
+// FileStore, which aren't rows of services and schedules.
+func fileState(tx *sql.Tx) error {
+	return execAll(tx, `
+	CREATE TABLE file_service_state (
+		name TEXT PRIMARY KEY,
+		last_checked DATETIME,
+		last_restarted DATETIME,
+		failing BOOLEAN NOT NULL DEFAULT 0,
+		last_check_ms INTEGER NOT NULL DEFAULT 0,
+		silenced_until DATETIME,
+		schedule_last_run DATETIME
+	);
+	`, `
+	CREATE TABLE file_schedule_state (
+		schedule TEXT PRIMARY KEY, -- fileScheduleKey
+		last_run DATETIME NOT NULL
+	);
+	`)
+}
+
+// commandTimeoutMS keeps the command timeout in milliseconds instead of whole
+// seconds, which cut off sub-second timeouts.
+func commandTimeoutMS(tx *sql.Tx) error {
+	return execAll(tx,
+		"ALTER TABLE services ADD COLUMN command_timeout_ms INTEGER NOT NULL DEFAULT 300000",
+		"UPDATE services SET command_timeout_ms = command_timeout * 1000",
+		"ALTER TABLE services DROP COLUMN command_timeout",
+	)
+}
+
+// verifyMS keeps the verify delay and timeout in milliseconds, like
+// commandTimeoutMS.
+func verifyMS(tx *sql.Tx) error {
+	return execAll(tx,
+		"ALTER TABLE services ADD COLUMN verify_delay_ms INTEGER NOT NULL DEFAULT 5000",
+		"ALTER TABLE services ADD COLUMN verify_timeout_ms INTEGER NOT NULL DEFAULT 30000",
+		"UPDATE services SET verify_delay_ms = verify_delay * 1000, verify_timeout_ms = verify_timeout * 1000",
+		"ALTER TABLE services DROP COLUMN verify_delay",
+		"ALTER TABLE services DROP COLUMN verify_timeout",
+	)
+}
+
+// execAll runs each statement in turn.
+func execAll(tx *sql.Tx, statements ...string) error {
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumnIfMissing runs ALTER TABLE ADD COLUMN unless the column already exists.
+// Definitions should carry a DEFAULT so existing rows never scan as NULL.
+func addColumnIfMissing(tx *sql.Tx, table, column, definition string) error {
+	var n int
+	err := tx.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// MigrationState is a migration and, if it ran, when.
+type MigrationState struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time // nil while pending
+}
+
+// MigrationStatus lists every migration of this binary, plus applied versions
+// it doesn't know (the database was migrated by a newer binary).
+func (st *SQLiteStore) MigrationStatus() ([]MigrationState, error) {
+	applied, err := st.appliedVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	var states []MigrationState
+	for _, m := range migrations {
+		st := MigrationState{Version: m.Version, Name: m.Name}
+		if a, ok := applied[m.Version]; ok {
+			st.AppliedAt = &a.at
+			delete(applied, m.Version)
+		}
+		states = append(states, st)
+	}
+	for v, a := range applied {
+		states = append(states, MigrationState{Version: v, Name: a.name + " (unknown to this lsm)", AppliedAt: &a.at})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Version < states[j].Version })
+	return states, nil
+}
+
+// SchemaVersion returns the highest applied migration, 0 for a new database
+// or one from before versioned migrations.
+func (st *SQLiteStore) SchemaVersion() (int, error) {
+	if ok, err := st.hasTable("schema_version"); err != nil || !ok {
+		return 0, err
+	}
+	var v sql.NullInt64
+	err := st.db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&v)
+	return int(v.Int64), err
+}
+
+// hasTable reports whether the table name exists.
+func (st *SQLiteStore) hasTable(name string) (bool, error) {
+	var n int
+	err := st.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", name).Scan(&n)
+	return n > 0, err
+}
+
+type appliedMigration struct {
+	name string
+	at   time.Time
+}
+
+func (st *SQLiteStore) appliedVersions() (map[int]appliedMigration, error) {
+	applied := map[int]appliedMigration{}
+	if ok, err := st.hasTable("schema_version"); err != nil || !ok {
+		return applied, err
+	}
+	rows, err := st.db.Query("SELECT version, name, applied_at FROM schema_version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var v int
+		var a appliedMigration
+		if err := rows.Scan(&v, &a.name, &a.at); err != nil {
+			return nil, err
+		}
+		applied[v] = a
+	}
+	return applied, rows.Err()
+}
+
+// migrate brings the database up to LatestVersion.
+func (st *SQLiteStore) migrate() error {
+	_, err := st.Migrate()
+	return err
+}
+
+// Migrate brings the database up to LatestVersion and returns the migrations
+// it applied, none if it was up to date. Before the first pending migration of
+// an existing database it writes a copy next to it, named after the version it
+// had, e.g. lsm.db.v2-20261018-150405.bak; of those the newest
+// migrationBackupsKept are kept.
+func (st *SQLiteStore) Migrate() ([]MigrationState, error) {
+	if _, err := st.exec(`CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at DATETIME NOT NULL
+	)`); err != nil {
+		return nil, err
+	}
+
+	current, err := st.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if current > LatestVersion() {
+		return nil, fmt.Errorf("database schema version %d is newer than this lsm supports (%d)", current, LatestVersion())
+	}
+	if current == LatestVersion() {
+		return nil, nil
+	}
+
+	// Databases from before versioned migrations are at version 0 but have data
+	existing, err := st.hasTable("services")
+	if err != nil {
+		return nil, err
+	}
+	backup := ""
+	if existing {
+		backup = fmt.Sprintf("%s.v%d-%s.bak", st.path, current, time.Now().Format("20060102-150405"))
+		if err := st.Backup(backup); err != nil {
+			return nil, fmt.Errorf("backup before migrating failed: %v", err)
+		}
+	}
+
+	var applied []MigrationState
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		if err := st.applyMigration(m); err != nil {
+			if backup != "" {
+				return applied, fmt.Errorf("migration %d (%s) failed: %v (the database before migrating is at %s)", m.Version, m.Name, err, backup)
+			}
+			return applied, fmt.Errorf("migration %d (%s) failed: %v", m.Version, m.Name, err)
+		}
+		now := time.Now()
+		applied = append(applied, MigrationState{Version: m.Version, Name: m.Name, AppliedAt: &now})
+	}
+
+	// Only once migrating worked, the backups may be needed to undo a failure
+	if backup != "" {
+		if err := st.pruneMigrationBackups(); err != nil {
+			return applied, fmt.Errorf("removing old backups from before migrating failed: %v", err)
+		}
+	}
+	return applied, nil
+}
+
+// migrationBackupsKept is how many backups from before migrating Migrate keeps.
+const migrationBackupsKept = 3
+
+// pruneMigrationBackups removes all but the newest migrationBackupsKept
+// backups written before migrating.
+func (st *SQLiteStore) pruneMigrationBackups() error {
+	dir, prefix := filepath.Dir(st.path), filepath.Base(st.path)+".v"
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	// Named <db>.v<version>-<time>.bak, the time sorts them by age
+	stamps := map[string]string{}
+	var backups []string
+	for _, e := range entries {
+		name := e.Name()
+		rest, ok := strings.CutPrefix(name, prefix)
+		if !ok || !strings.HasSuffix(name, ".bak") {
+			continue
+		}
+		if _, stamp, ok := strings.Cut(rest, "-"); ok {
+			stamps[name] = stamp
+			backups = append(backups, name)
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool { return stamps[backups[i]] < stamps[backups[j]] })
+	_, err = removeOldest(dir, backups, migrationBackupsKept)
+	return err
+}
+
+// applyMigration runs m and records it in one transaction.
+func (st *SQLiteStore) applyMigration(m migration) error {
+	return st.inTx(func(tx *sql.Tx) error {
+		// Another lsm process may have got here first
+		var done int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM schema_version WHERE version = ?", m.Version).Scan(&done); err != nil || done > 0 {
+			return err
+		}
+		if err := m.Up(tx); err != nil {
+			return err
+		}
+		_, err := tx.Exec("INSERT INTO schema_version(version, name, applied_at) VALUES(?, ?, ?)", m.Version, m.Name, time.Now())
+		return err
+	})
+}
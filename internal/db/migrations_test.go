@@ -0,0 +1,211 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// preVersionedSchema is a database from before versioned migrations, with
+// only some of the columns that used to be added at every start.
+const preVersionedSchema = `
+CREATE TABLE services (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE,
+	restart_command TEXT NOT NULL,
+	check_command TEXT NOT NULL,
+	status_command TEXT,
+	cron_schedule TEXT,
+	enabled BOOLEAN DEFAULT 1,
+	last_checked DATETIME,
+	last_restarted DATETIME,
+	start_command TEXT NOT NULL DEFAULT '',
+	verify_delay INTEGER NOT NULL DEFAULT 5
+);
+CREATE TABLE app_config (key TEXT PRIMARY KEY, value TEXT);
+CREATE TABLE schedules (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	service_id INTEGER NOT NULL,
+	action TEXT NOT NULL,
+	command TEXT NOT NULL DEFAULT '',
+	cron_schedule TEXT NOT NULL,
+	enabled BOOLEAN DEFAULT 1
+);
+CREATE TABLE history (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	service_name TEXT NOT NULL,
+	event TEXT NOT NULL,
+	detail TEXT NOT NULL DEFAULT '',
+	created_at DATETIME NOT NULL
+);
+INSERT INTO services(name, restart_command, check_command, status_command, cron_schedule, start_command)
+	VALUES('app', 'systemctl restart app', 'curl -f localhost', '', '', 'systemctl start app');
+INSERT INTO schedules(service_id, action, cron_schedule) VALUES(1, 'restart', '@daily');
+`
+
+// createAt creates a database at path migrated up to version, which must be
+// at least 1, with the app service.
+func createAt(t *testing.T, path string, version int) {
+	t.Helper()
+	st, err := OpenSQLiteUnmigrated(path)
+	if err != nil {
+		t.Fatalf("OpenSQLiteUnmigrated: %v", err)
+	}
+	defer st.Close()
+	if _, err := st.exec(`CREATE TABLE schema_version (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at DATETIME NOT NULL
+	)`); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations[:version] {
+		if err := st.applyMigration(m); err != nil {
+			t.Fatalf("migration %d: %v", m.Version, err)
+		}
+	}
+	// The columns of version 1, the others get their defaults
+	if _, err := st.exec(`INSERT INTO services(name, restart_command, check_command, status_command, cron_schedule, start_command)
+		VALUES('app', 'systemctl restart app', 'curl -f localhost', '', '', 'systemctl start app')`); err != nil {
+		t.Fatalf("adding the service: %v", err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	type test struct {
+		name    string
+		create  func(t *testing.T, path string)
+		from    int  // Schema version before migrating
+		hasData bool // Whether there is a service
+	}
+	tests := []test{
+		{
+			name:   "new database",
+			create: func(t *testing.T, path string) {},
+		},
+		{
+			name: "before versioned migrations",
+			create: func(t *testing.T, path string) {
+				st, err := OpenSQLiteUnmigrated(path)
+				if err != nil {
+					t.Fatalf("OpenSQLiteUnmigrated: %v", err)
+				}
+				defer st.Close()
+				if _, err := st.db.Exec(preVersionedSchema); err != nil {
+					t.Fatalf("creating the old schema: %v", err)
+				}
+			},
+			hasData: true,
+		},
+	}
+	for v := 1; v <= LatestVersion(); v++ {
+		tests = append(tests, test{
+			name:    fmt.Sprintf("version %d", v),
+			create:  func(t *testing.T, path string) { createAt(t, path, v) },
+			from:    v,
+			hasData: true,
+		})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "lsm.db")
+			tt.create(t, path)
+
+			st, err := OpenSQLiteUnmigrated(path)
+			if err != nil {
+				t.Fatalf("OpenSQLiteUnmigrated: %v", err)
+			}
+			defer st.Close()
+			if v, err := st.SchemaVersion(); err != nil || v != tt.from {
+				t.Fatalf("SchemaVersion before migrating = %d, %v, want %d", v, err, tt.from)
+			}
+
+			applied, err := st.Migrate()
+			if err != nil {
+				t.Fatalf("Migrate: %v", err)
+			}
+			if len(applied) != LatestVersion()-tt.from {
+				t.Errorf("applied %d migrations, want %d", len(applied), LatestVersion()-tt.from)
+			}
+			if v, _ := st.SchemaVersion(); v != LatestVersion() {
+				t.Errorf("SchemaVersion = %d, want %d", v, LatestVersion())
+			}
+			if again, err := st.Migrate(); err != nil || len(again) != 0 {
+				t.Errorf("migrating again applied %d migrations, %v", len(again), err)
+			}
+
+			// Only an existing database that had to be migrated is copied first
+			backups, _ := filepath.Glob(path + ".v*.bak")
+			if wantBackup := tt.hasData && tt.from < LatestVersion(); (len(backups) == 1) != wantBackup || len(backups) > 1 {
+				t.Errorf("got backups %v, want one: %v", backups, wantBackup)
+			}
+			if !tt.hasData {
+				return
+			}
+
+			s, err := st.GetService("app")
+			if err != nil {
+				t.Fatalf("GetService: %v", err)
+			}
+			if s.StartCommand != "systemctl start app" || s.CheckCommand != "curl -f localhost" {
+				t.Errorf("service lost its commands: %+v", s)
+			}
+			if s.VerifyTimeout != 30*time.Second || s.CommandTimeout != 300*time.Second {
+				// Columns added to existing rows get their defaults, kept by later migrations
+				t.Errorf("VerifyTimeout, CommandTimeout = %v, %v, want the defaults 30s, 5m", s.VerifyTimeout, s.CommandTimeout)
+			}
+			if err := st.UpdateLastChecked(s.ID, time.Second, true); err != nil {
+				t.Errorf("UpdateLastChecked on the migrated schema: %v", err)
+			}
+		})
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lsm.db")
+	createAt(t, path, LatestVersion())
+	st, err := OpenSQLiteUnmigrated(path)
+	if err != nil {
+		t.Fatalf("OpenSQLiteUnmigrated: %v", err)
+	}
+	defer st.Close()
+	if _, err := st.exec("INSERT INTO schema_version(version, name, applied_at) VALUES(?, 'future', ?)", LatestVersion()+1, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := st.Migrate(); err == nil {
+		t.Errorf("Migrate of a newer schema succeeded")
+	}
+}
+
+func TestPruneMigrationBackups(t *testing.T) {
+	dir := t.TempDir()
+	st := &SQLiteStore{path: filepath.Join(dir, "lsm.db")}
+	names := []string{
+		"lsm.db.v3-20261001-120000.bak",
+		"lsm.db.v0-20261002-120000.bak",
+		"lsm.db.v10-20261003-120000.bak",
+		"lsm.db.v1-20261004-120000.bak",
+		"lsm.db.v2-20261005-120000.bak",
+		"lsm.db.pre-restore-20261001-120000.bak", // Not from migrating
+	}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := st.pruneMigrationBackups(); err != nil {
+		t.Fatalf("pruneMigrationBackups: %v", err)
+	}
+	for i, name := range names {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if kept := err == nil; kept != (i >= 2) {
+			t.Errorf("%s kept = %v", name, kept)
+		}
+	}
+}
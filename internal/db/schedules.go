@@ -0,0 +1,145 @@
+package db
+
+import "time"
+
+// Schedule actions
+const (
+	ActionRestart = "restart" // RestartCommand, skipped if StatusCommand says the service is stopped
+	ActionStop    = "stop"    // StopCommand
+	ActionStart   = "start"   // StartCommand
+	ActionCommand = "command" // Schedule's own Command (log rotation, cache purge, ...)
+	ActionCheck   = "check"   // CheckCommand, restarting on failure like the monitor loop
+)
+
+// Catch-up policies for runs missed while the daemon was down
+const (
+	CatchupSkip  = "skip"  // Record the missed run, don't run it
+	CatchupOnce  = "once"  // Run once on startup, however many runs were missed
+	CatchupGrace = "grace" // Run once if the latest missed run is within CatchupGrace
+)
+
+// ValidCatchup reports whether policy is one of the catch-up policies above.
+func ValidCatchup(policy string) bool {
+	switch policy {
+	case CatchupSkip, CatchupOnce, CatchupGrace:
+		return true
+	}
+	return false
+}
+
+// ValidAction reports whether action is one of the schedule actions above.
+func ValidAction(action string) bool {
+	switch action {
+	case ActionRestart, ActionStop, ActionStart, ActionCommand, ActionCheck:
+		return true
+	}
+	return false
+}
+
+// Schedule is a cron entry attached to a service. A service can have any number of them.
+type Schedule struct {
+	ID           int
+	ServiceID    int
+	ServiceName  string // Joined from services, not stored
+	Action       string
+	Command      string // Only used by ActionCommand
+	CronSchedule string
+	Timezone     string        // IANA zone the schedule runs in, empty for the daemon's local zone
+	Jitter       time.Duration // Random delay of up to Jitter before each run
+	Catchup      string        // What to do with runs missed while the daemon was down
+	CatchupGrace time.Duration // Window for CatchupGrace
+	LastRun      *time.Time    // Last time the schedule fired or a missed run was handled
+	Enabled      bool
+}
+
+func (st *SQLiteStore) AddSchedule(s Schedule) error {
+	if s.Catchup == "" {
+		s.Catchup = CatchupSkip
+	}
+	_, err := st.exec("INSERT INTO schedules(service_id, action, command, cron_schedule, timezone, jitter, catchup, catchup_grace, enabled) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		s.ServiceID, s.Action, s.Command, s.CronSchedule, s.Timezone, seconds(s.Jitter), s.Catchup, seconds(s.CatchupGrace), s.Enabled)
+	return err
+}
+
+// UpdateSchedule changes what the schedule sc.ID runs and when. Its service
+// and whether it is enabled are kept, and its last run unless its timing or
+// catch-up changed: runs missed under the old ones aren't missed under the new.
+func (st *SQLiteStore) UpdateSchedule(s Schedule) error {
+	if s.Catchup == "" {
+		s.Catchup = CatchupSkip
+	}
+	// SET sees the old values of the row
+	_, err := st.exec(`UPDATE schedules SET action = ?, command = ?, cron_schedule = ?, timezone = ?, jitter = ?, catchup = ?, catchup_grace = ?,
+			last_run = CASE WHEN cron_schedule = ? AND timezone = ? AND catchup = ? AND catchup_grace = ? THEN last_run END
+		WHERE id = ?`,
+		s.Action, s.Command, s.CronSchedule, s.Timezone, seconds(s.Jitter), s.Catchup, seconds(s.CatchupGrace),
+		s.CronSchedule, s.Timezone, s.Catchup, seconds(s.CatchupGrace), s.ID)
+	return err
+}
+
+// SameTiming reports whether sc and other run at the same times and catch up
+// the same way, so UpdateSchedule keeps the last run.
+func (sc Schedule) SameTiming(other Schedule) bool {
+	return sc.CronSchedule == other.CronSchedule && sc.Timezone == other.Timezone && sc.Catchup == other.Catchup && sc.CatchupGrace == other.CatchupGrace
+}
+
+const scheduleColumns = "sc.id, sc.service_id, s.name, sc.action, sc.command, sc.cron_schedule, sc.timezone, sc.jitter, sc.catchup, sc.catchup_grace, sc.last_run, sc.enabled"
+
+func scanSchedule(row scanner) (Schedule, error) {
+	var sc Schedule
+	var jitter, grace int64 // Seconds
+	err := row.Scan(&sc.ID, &sc.ServiceID, &sc.ServiceName, &sc.Action, &sc.Command, &sc.CronSchedule, &sc.Timezone, &jitter, &sc.Catchup, &grace, &sc.LastRun, &sc.Enabled)
+	sc.Jitter = time.Duration(jitter) * time.Second
+	sc.CatchupGrace = time.Duration(grace) * time.Second
+	return sc, err
+}
+
+// ListSchedules returns all schedules, or only those of serviceName if it is not empty.
+func (st *SQLiteStore) ListSchedules(serviceName string) ([]Schedule, error) {
+	query := "SELECT " + scheduleColumns + " FROM schedules sc JOIN services s ON s.id = sc.service_id"
+	var args []any
+	if serviceName != "" {
+		query += " WHERE s.name = ?"
+		args = append(args, serviceName)
+	}
+	query += " ORDER BY s.name, sc.id"
+
+	rows, err := st.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var schedules []Schedule
+	for rows.Next() {
+		sc, err := scanSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, sc)
+	}
+	return schedules, nil
+}
+
+func (st *SQLiteStore) GetSchedule(id int) (*Schedule, error) {
+	sc, err := scanSchedule(st.db.QueryRow("SELECT "+scheduleColumns+" FROM schedules sc JOIN services s ON s.id = sc.service_id WHERE sc.id = ?", id))
+	if err != nil {
+		return nil, err
+	}
+	return &sc, nil
+}
+
+func (st *SQLiteStore) ToggleSchedule(id int, enable bool) error {
+	_, err := st.exec("UPDATE schedules SET enabled = ? WHERE id = ?", enable, id)
+	return err
+}
+
+func (st *SQLiteStore) UpdateScheduleLastRun(id int, t time.Time) error {
+	_, err := st.exec("UPDATE schedules SET last_run = ? WHERE id = ?", t, id)
+	return err
+}
+
+func (st *SQLiteStore) RemoveSchedule(id int) error {
+	_, err := st.exec("DELETE FROM schedules WHERE id = ?", id)
+	return err
+}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Store is where LSM keeps services, schedules, history and settings. The
+// monitor, scheduler and CLI work through it, so they can run against SQLite
+// (the default), memory (tests, embedding) or a file of services.
+type Store interface {
+	ListServices() ([]Service, error)
+	GetService(name string) (*Service, error)
+	AddService(s Service) error
+	UpdateService(s Service) error
+	RemoveService(name string) error
+	ToggleService(name string, enable bool) error
+	SilenceService(name string, until *time.Time) error
+	UpdateLastChecked(id int, took time.Duration, failing bool) error
+	UpdateLastRestarted(id int) error
+	UpdateServiceScheduleLastRun(id int, t time.Time) error
+	LockService(name string) (unlock func(), err error)
+
+	ListSchedules(serviceName string) ([]Schedule, error)
+	GetSchedule(id int) (*Schedule, error)
+	AddSchedule(sc Schedule) error
+	UpdateSchedule(sc Schedule) error
+	ToggleSchedule(id int, enable bool) error
+	UpdateScheduleLastRun(id int, t time.Time) error
+	RemoveSchedule(id int) error
+
+	AddHistory(serviceName, event, detail string) error
+	ListHistory(serviceName string, limit int) ([]HistoryEntry, error)
+	CountHistory(serviceName, event string, since time.Time) (int, error)
+
+	GetLogConfig() (*LogConfig, error)
+	SetLogConfig(cfg LogConfig) error
+	GetPauseConfig() (bool, error)
+	SetPauseConfig(enabled bool) error
+	GetBackupConfig() (*BackupConfig, error)
+	SetBackupConfig(cfg BackupConfig) error
+}
+
+// ErrReadOnly is returned by stores that can't change what they were loaded with.
+var ErrReadOnly = errors.New("the service configuration is read-only")
+
+// SQLiteStore is the Store of an LSM database file.
+type SQLiteStore struct {
+	db   *sql.DB
+	path string
+}
+
+// OpenSQLite opens (and migrates) the database at path and returns its Store.
+// The directory of path is created if needed.
+func OpenSQLite(path string) (*SQLiteStore, error) {
+	st, err := OpenSQLiteUnmigrated(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := st.migrate(); err != nil {
+		st.Close()
+		return nil, err
+	}
+	return st, nil
+}
+
+// OpenSQLiteUnmigrated opens the database at path as it is, e.g. to check or
+// restore one that can't be migrated because it is damaged or newer.
+func OpenSQLiteUnmigrated(path string) (*SQLiteStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	conn, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLiteStore{db: conn, path: path}, nil
+}
+
+// Path returns the file of the database.
+func (st *SQLiteStore) Path() string {
+	return st.path
+}
+
+// Close closes the database.
+func (st *SQLiteStore) Close() error {
+	return st.db.Close()
+}
+
+var (
+	_ Store = (*SQLiteStore)(nil)
+	_ Store = (*MemoryStore)(nil)
+	_ Store = (*FileStore)(nil)
+)
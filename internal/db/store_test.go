@@ -0,0 +1,219 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// stores returns each Store implementation that can be written to, empty.
+func stores(t *testing.T) map[string]Store {
+	t.Helper()
+	st, err := OpenSQLite(filepath.Join(t.TempDir(), "lsm.db"))
+	if err != nil {
+		t.Fatalf("OpenSQLite: %v", err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return map[string]Store{
+		"sqlite": st,
+		"memory": NewMemoryStore(),
+	}
+}
+
+// near reports whether t is set and within a second of want, SQLite keeps
+// times with less precision.
+func near(t *time.Time, want time.Time) bool {
+	return t != nil && t.Sub(want).Abs() < time.Second
+}
+
+func TestStoreMissingRows(t *testing.T) {
+	for name, st := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := st.GetService("nope"); !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("GetService of a missing service: %v, want sql.ErrNoRows", err)
+			}
+			if _, err := st.GetSchedule(42); !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("GetSchedule of a missing schedule: %v, want sql.ErrNoRows", err)
+			}
+		})
+	}
+}
+
+func TestStoreUpdateServiceKeepsState(t *testing.T) {
+	for name, st := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := st.AddService(Service{Name: "app", RestartCommand: "true", CheckCommand: "true", Enabled: true}); err != nil {
+				t.Fatalf("AddService: %v", err)
+			}
+			if err := st.AddService(Service{Name: "app", RestartCommand: "true", CheckCommand: "true"}); err == nil {
+				t.Errorf("AddService of a duplicate name succeeded")
+			}
+			s, err := st.GetService("app")
+			if err != nil {
+				t.Fatalf("GetService: %v", err)
+			}
+
+			now := time.Now()
+			until := now.Add(time.Hour)
+			for _, err := range []error{
+				st.UpdateLastChecked(s.ID, 1500*time.Millisecond, true),
+				st.UpdateLastRestarted(s.ID),
+				st.SilenceService("app", &until),
+				st.UpdateServiceScheduleLastRun(s.ID, now),
+			} {
+				if err != nil {
+					t.Fatalf("recording state: %v", err)
+				}
+			}
+
+			// A changed configuration, as built by lsm update, has no state
+			if err := st.UpdateService(Service{ID: s.ID, Name: "app", RestartCommand: "systemctl restart app", CheckCommand: "true", Enabled: true}); err != nil {
+				t.Fatalf("UpdateService: %v", err)
+			}
+			got, err := st.GetService("app")
+			if err != nil {
+				t.Fatalf("GetService: %v", err)
+			}
+
+			if got.RestartCommand != "systemctl restart app" {
+				t.Errorf("RestartCommand = %q, the update was lost", got.RestartCommand)
+			}
+			if !got.Failing || got.LastCheckDuration != 1500*time.Millisecond {
+				t.Errorf("Failing, LastCheckDuration = %v, %v, want true, 1.5s", got.Failing, got.LastCheckDuration)
+			}
+			if !near(got.LastChecked, now) || !near(got.LastRestarted, now) {
+				t.Errorf("LastChecked, LastRestarted = %v, %v, want about %v", got.LastChecked, got.LastRestarted, now)
+			}
+			if !near(got.SilencedUntil, until) {
+				t.Errorf("SilencedUntil = %v, want %v", got.SilencedUntil, until)
+			}
+			if !near(got.ScheduleLastRun, now) {
+				t.Errorf("ScheduleLastRun = %v, want %v", got.ScheduleLastRun, now)
+			}
+
+			if err := st.UpdateService(Service{ID: s.ID, Name: "app", RestartCommand: "true", CheckCommand: "true", CronSchedule: "@daily", Enabled: true}); err != nil {
+				t.Fatalf("UpdateService: %v", err)
+			}
+			if got, _ := st.GetService("app"); got.ScheduleLastRun != nil {
+				t.Errorf("ScheduleLastRun = %v after changing --schedule, want none", got.ScheduleLastRun)
+			}
+		})
+	}
+}
+
+func TestStoreSubSecondDurations(t *testing.T) {
+	for name, st := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			s := Service{Name: "app", RestartCommand: "true", CheckCommand: "true", Enabled: true,
+				VerifyDelay: 500 * time.Millisecond, VerifyTimeout: 2500 * time.Millisecond, CommandTimeout: 1500 * time.Millisecond}
+			if err := st.AddService(s); err != nil {
+				t.Fatalf("AddService: %v", err)
+			}
+			got, err := st.GetService("app")
+			if err != nil {
+				t.Fatalf("GetService: %v", err)
+			}
+			if got.VerifyDelay != s.VerifyDelay || got.VerifyTimeout != s.VerifyTimeout || got.CommandTimeout != s.CommandTimeout {
+				t.Errorf("VerifyDelay, VerifyTimeout, CommandTimeout = %v, %v, %v, want %v, %v, %v",
+					got.VerifyDelay, got.VerifyTimeout, got.CommandTimeout, s.VerifyDelay, s.VerifyTimeout, s.CommandTimeout)
+			}
+
+			s.VerifyDelay, s.CommandTimeout = 1200*time.Millisecond, 250*time.Millisecond
+			if err := st.UpdateService(s); err != nil {
+				t.Fatalf("UpdateService: %v", err)
+			}
+			if got, _ := st.GetService("app"); got.VerifyDelay != s.VerifyDelay || got.CommandTimeout != s.CommandTimeout {
+				t.Errorf("VerifyDelay, CommandTimeout after UpdateService = %v, %v, want %v, %v", got.VerifyDelay, got.CommandTimeout, s.VerifyDelay, s.CommandTimeout)
+			}
+		})
+	}
+}
+
+func TestStoreUpdateScheduleKeepsState(t *testing.T) {
+	for name, st := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := st.AddService(Service{Name: "app", RestartCommand: "true", CheckCommand: "true", Enabled: true}); err != nil {
+				t.Fatalf("AddService: %v", err)
+			}
+			s, _ := st.GetService("app")
+			if err := st.AddSchedule(Schedule{ServiceID: s.ID, Action: ActionRestart, CronSchedule: "@daily", Enabled: true}); err != nil {
+				t.Fatalf("AddSchedule: %v", err)
+			}
+			schedules, err := st.ListSchedules("app")
+			if err != nil || len(schedules) != 1 {
+				t.Fatalf("ListSchedules: %v, %d schedules", err, len(schedules))
+			}
+			sc := schedules[0]
+			if sc.Catchup != CatchupSkip {
+				t.Errorf("Catchup = %q, want the default %q", sc.Catchup, CatchupSkip)
+			}
+
+			ran := time.Now().Add(-time.Hour)
+			if err := st.UpdateScheduleLastRun(sc.ID, ran); err != nil {
+				t.Fatalf("UpdateScheduleLastRun: %v", err)
+			}
+			if err := st.ToggleSchedule(sc.ID, false); err != nil {
+				t.Fatalf("ToggleSchedule: %v", err)
+			}
+
+			changed := Schedule{ID: sc.ID, ServiceID: s.ID, Action: ActionCommand, Command: "echo hi", CronSchedule: "@daily", Enabled: true}
+			if err := st.UpdateSchedule(changed); err != nil {
+				t.Fatalf("UpdateSchedule: %v", err)
+			}
+			got, err := st.GetSchedule(sc.ID)
+			if err != nil {
+				t.Fatalf("GetSchedule: %v", err)
+			}
+			if got.Action != ActionCommand || got.Command != "echo hi" {
+				t.Errorf("got %s %q, the update was lost", got.Action, got.Command)
+			}
+			if got.Enabled {
+				t.Errorf("UpdateSchedule enabled the disabled schedule")
+			}
+			if !near(got.LastRun, ran) {
+				t.Errorf("LastRun = %v, want %v", got.LastRun, ran)
+			}
+			if got.ServiceName != "app" {
+				t.Errorf("ServiceName = %q, want app", got.ServiceName)
+			}
+
+			// Runs missed at the old times weren't missed at the new ones
+			changed.CronSchedule = "@hourly"
+			if err := st.UpdateSchedule(changed); err != nil {
+				t.Fatalf("UpdateSchedule: %v", err)
+			}
+			if got, _ := st.GetSchedule(sc.ID); got.CronSchedule != "@hourly" || got.LastRun != nil {
+				t.Errorf("CronSchedule, LastRun = %q, %v after changing the timing, want @hourly, none", got.CronSchedule, got.LastRun)
+			}
+		})
+	}
+}
+
+func TestStoreLockService(t *testing.T) {
+	for name, st := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			unlock, err := st.LockService("app/1")
+			if err != nil {
+				t.Fatalf("LockService: %v", err)
+			}
+			if _, err := st.LockService("app/1"); !errors.Is(err, ErrLocked) {
+				t.Errorf("second LockService: %v, want ErrLocked", err)
+			}
+			other, err := st.LockService("other")
+			if err != nil {
+				t.Errorf("LockService of another service: %v", err)
+			} else {
+				other()
+			}
+
+			unlock()
+			again, err := st.LockService("app/1")
+			if err != nil {
+				t.Fatalf("LockService after unlocking: %v", err)
+			}
+			again()
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package leader
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// FileLock is a Lease held with flock(2) on a file on storage both daemons
+// mount. The kernel (or the NFS server) releases it when its holder dies, so
+// it needs no expiry. The file holds the id of the holder.
+type FileLock struct {
+	path string
+
+	mu   sync.Mutex
+	f    *os.File // Open and locked while held
+	held string   // Id holding it through f
+}
+
+// NewFileLock returns a FileLock on the file at path, created if missing.
+func NewFileLock(path string) *FileLock {
+	return &FileLock{path: path}
+}
+
+func (fl *FileLock) Acquire(id string) (bool, error) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if fl.f != nil {
+		return fl.held == id, nil
+	}
+
+	f, err := os.OpenFile(fl.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return false, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if err := f.Truncate(0); err == nil {
+		_, err = f.WriteAt([]byte(id+"\n"), 0)
+	}
+	if err != nil {
+		f.Close()
+		return false, err
+	}
+	fl.f, fl.held = f, id
+	return true, nil
+}
+
+func (fl *FileLock) Release(id string) error {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if fl.f == nil || fl.held != id {
+		return nil
+	}
+	fl.f.Truncate(0)
+	err := fl.f.Close() // Unlocks
+	fl.f, fl.held = nil, ""
+	return err
+}
+
+func (fl *FileLock) Holder() (string, error) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if fl.f != nil {
+		return fl.held, nil
+	}
+
+	f, err := os.Open(fl.path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// A shared lock is only granted if nobody holds the lock
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err == nil {
+		return "", nil
+	} else if !errors.Is(err, syscall.EWOULDBLOCK) {
+		return "", err
+	}
+	data, err := io.ReadAll(f)
+	return strings.TrimSpace(string(data)), err
+}
+
+func (fl *FileLock) Close() error {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if fl.f == nil {
+		return nil
+	}
+	err := fl.f.Close()
+	fl.f, fl.held = nil, ""
+	return err
+}
@@ -0,0 +1,139 @@
+// Package leader elects one of several LSM daemons that manage the same
+// services, e.g. an active/passive pair behind a VIP, so only one of them
+// restarts them. The daemons compete for a Lease on shared storage.
+package leader
+
+import (
+	"context"
+	"fmt"
+	"linux_service_manager/internal/logger"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Lease is held by at most one daemon at a time.
+type Lease interface {
+	// Acquire takes the lease for id, or renews it if id holds it already,
+	// and reports whether id holds it now.
+	Acquire(id string) (bool, error)
+	// Release gives the lease up if id holds it.
+	Release(id string) error
+	// Holder returns the id holding the lease, "" if nobody does.
+	Holder() (string, error)
+	Close() error
+}
+
+// Roles of a daemon
+const (
+	RoleLeader   = "leader"
+	RoleFollower = "follower"
+)
+
+// DefaultID identifies this daemon as host:pid.
+func DefaultID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+// OnThisHost reports whether id, as made by DefaultID, is of a daemon on this
+// host.
+func OnThisHost(id string) bool {
+	host, err := os.Hostname()
+	return err == nil && strings.HasPrefix(id, host+":")
+}
+
+// Elector keeps trying to acquire a lease, renewing it once it holds it.
+type Elector struct {
+	lease    Lease
+	id       string
+	interval time.Duration
+	leading  atomic.Bool
+}
+
+// NewElector returns an Elector that competes for lease as id every interval.
+func NewElector(lease Lease, id string, interval time.Duration) *Elector {
+	return &Elector{lease: lease, id: id, interval: interval}
+}
+
+// ID returns who this Elector competes as.
+func (e *Elector) ID() string {
+	return e.id
+}
+
+// Leading reports whether the lease was held at the last attempt.
+func (e *Elector) Leading() bool {
+	return e.leading.Load()
+}
+
+// Role returns RoleLeader or RoleFollower.
+func (e *Elector) Role() string {
+	if e.Leading() {
+		return RoleLeader
+	}
+	return RoleFollower
+}
+
+// Attempt tries to acquire the lease once, like every round of Run, and
+// reports whether this daemon leads. Run only reports changes after it.
+func (e *Elector) Attempt() bool {
+	leading, _ := e.attempt()
+	return leading
+}
+
+// attempt tries to acquire the lease and reports whether it is held and
+// whether that changed.
+func (e *Elector) attempt() (leading, changed bool) {
+	l := logger.Component("leader").With("id", e.id)
+	leading, err := e.lease.Acquire(e.id)
+	if err != nil {
+		// The lease may run out meanwhile, it is safer to stand by
+		l.Error("Failed to acquire the leader lock", "error", err)
+		leading = false
+	}
+	if e.leading.Swap(leading) == leading {
+		return leading, false
+	}
+	if leading {
+		l.Info("Became leader")
+	} else {
+		l.Warn("Became follower, leaving restarts and schedules to the leader")
+	}
+	return leading, true
+}
+
+// Run competes for the lease until ctx is done, then releases it. changed is
+// called in Run's goroutine whenever this daemon became leader or follower.
+func (e *Elector) Run(ctx context.Context, changed func(leading bool)) {
+	l := logger.Component("leader").With("id", e.id)
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		if leading, ok := e.attempt(); ok {
+			changed(leading)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if e.leading.Swap(false) {
+				if err := e.lease.Release(e.id); err != nil {
+					l.Error("Failed to release the leader lock", "error", err)
+				} else {
+					l.Info("Released the leader lock")
+				}
+			}
+			return
+		}
+	}
+}
+
+var (
+	_ Lease = (*FileLock)(nil)
+	_ Lease = (*SQLiteLease)(nil)
+)
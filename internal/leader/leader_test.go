@@ -0,0 +1,106 @@
+package leader
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOnThisHost(t *testing.T) {
+	host, err := os.Hostname()
+	if err != nil {
+		t.Skipf("no host name: %v", err)
+	}
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{DefaultID(), true},
+		{host + ":1", true},
+		{host + "-other:1", false},
+		{"other:" + host, false},
+		{host, false}, // Not made by DefaultID
+	}
+	for _, tt := range tests {
+		if got := OnThisHost(tt.id); got != tt.want {
+			t.Errorf("OnThisHost(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestFileLockContention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lsm.lock")
+	// flock(2) locks belong to open files, so two FileLocks contend like two hosts
+	a, b := NewFileLock(path), NewFileLock(path)
+	defer a.Close()
+	defer b.Close()
+
+	if ok, err := a.Acquire("web-a:1"); !ok || err != nil {
+		t.Fatalf("a.Acquire = %v, %v, want true", ok, err)
+	}
+	if ok, err := b.Acquire("web-b:1"); ok || err != nil {
+		t.Errorf("b.Acquire while a holds it = %v, %v, want false", ok, err)
+	}
+	if holder, err := b.Holder(); holder != "web-a:1" || err != nil {
+		t.Errorf("b.Holder = %q, %v, want web-a:1", holder, err)
+	}
+	if ok, _ := a.Acquire("web-a:1"); !ok {
+		t.Errorf("renewing by the holder failed")
+	}
+
+	// Closing stands in for the holder dying
+	a.Close()
+	if holder, err := b.Holder(); holder != "" || err != nil {
+		t.Errorf("b.Holder after a closed = %q, %v, want none", holder, err)
+	}
+	if ok, err := b.Acquire("web-b:1"); !ok || err != nil {
+		t.Errorf("b.Acquire after a closed = %v, %v, want true", ok, err)
+	}
+	if holder, _ := a.Holder(); holder != "web-b:1" {
+		t.Errorf("a.Holder = %q, want web-b:1", holder)
+	}
+}
+
+func TestSQLiteLeaseTTLTakeover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lease.db")
+	const ttl = 200 * time.Millisecond
+	a, err := OpenSQLiteLease(path, ttl)
+	if err != nil {
+		t.Fatalf("OpenSQLiteLease: %v", err)
+	}
+	defer a.Close()
+	b, err := OpenSQLiteLease(path, ttl)
+	if err != nil {
+		t.Fatalf("OpenSQLiteLease: %v", err)
+	}
+	defer b.Close()
+
+	if ok, err := a.Acquire("web-a:1"); !ok || err != nil {
+		t.Fatalf("a.Acquire = %v, %v, want true", ok, err)
+	}
+	if ok, err := b.Acquire("web-b:1"); ok || err != nil {
+		t.Errorf("b.Acquire before the TTL = %v, %v, want false", ok, err)
+	}
+	if err := b.Release("web-b:1"); err != nil {
+		t.Errorf("b.Release: %v", err)
+	}
+	if holder, _ := b.Holder(); holder != "web-a:1" {
+		t.Errorf("Holder after a release by another = %q, want web-a:1", holder)
+	}
+
+	// The leader stops renewing, e.g. its host hangs
+	time.Sleep(ttl + 50*time.Millisecond)
+	if holder, err := b.Holder(); holder != "" || err != nil {
+		t.Errorf("Holder after the TTL = %q, %v, want none", holder, err)
+	}
+	if ok, err := b.Acquire("web-b:1"); !ok || err != nil {
+		t.Fatalf("b.Acquire after the TTL = %v, %v, want true", ok, err)
+	}
+	if ok, _ := a.Acquire("web-a:1"); ok {
+		t.Errorf("the old leader took the lease back from the new one")
+	}
+	if holder, _ := a.Holder(); holder != "web-b:1" {
+		t.Errorf("Holder = %q, want web-b:1", holder)
+	}
+}
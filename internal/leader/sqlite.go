@@ -0,0 +1,73 @@
+package leader
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// leaseName is the row of the lease in the leases table
+const leaseName = "lsm"
+
+// SQLiteLease is a Lease kept as a row of a SQLite database on storage both
+// daemons mount. The holder renews it at every attempt; once it is older
+// than its TTL another daemon may take it over, so the clocks of the hosts
+// must agree (NTP) to well within the TTL.
+type SQLiteLease struct {
+	db  *sql.DB
+	ttl time.Duration
+}
+
+// OpenSQLiteLease opens (creating it if needed) the database at path for a
+// lease that expires ttl after it was last acquired. The database uses a
+// rollback journal, as WAL doesn't work over network file systems.
+func OpenSQLiteLease(path string, ttl time.Duration) (*SQLiteLease, error) {
+	db, err := sql.Open("sqlite", fmt.Sprintf("%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(DELETE)", path))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS leases (
+		name TEXT PRIMARY KEY,
+		holder TEXT NOT NULL,
+		expires_at INTEGER NOT NULL -- Unix nanoseconds
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create leases table in %s: %w", path, err)
+	}
+	return &SQLiteLease{db: db, ttl: ttl}, nil
+}
+
+func (sl *SQLiteLease) Acquire(id string) (bool, error) {
+	now := time.Now()
+	res, err := sl.db.Exec(`INSERT INTO leases (name, holder, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET holder = excluded.holder, expires_at = excluded.expires_at
+		WHERE leases.holder = excluded.holder OR leases.expires_at < ?`,
+		leaseName, id, now.Add(sl.ttl).UnixNano(), now.UnixNano())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (sl *SQLiteLease) Release(id string) error {
+	_, err := sl.db.Exec("DELETE FROM leases WHERE name = ? AND holder = ?", leaseName, id)
+	return err
+}
+
+func (sl *SQLiteLease) Holder() (string, error) {
+	var holder string
+	err := sl.db.QueryRow("SELECT holder FROM leases WHERE name = ? AND expires_at >= ?", leaseName, time.Now().UnixNano()).Scan(&holder)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return holder, err
+}
+
+func (sl *SQLiteLease) Close() error {
+	return sl.db.Close()
+}
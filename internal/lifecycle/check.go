@@ -0,0 +1,181 @@
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"linux_service_manager/internal/db"
+	"linux_service_manager/internal/logger"
+	"linux_service_manager/internal/runner"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CheckResult is the outcome of one check of a service.
+type CheckResult struct {
+	db.Check
+	Passed   bool
+	ExitCode int
+	Output   string
+	Duration time.Duration
+	Err      error // Why the check failed, nil if it passed
+}
+
+// Health is the combined outcome of all checks of a service.
+type Health struct {
+	Healthy bool
+	Mode    string
+	Passed  int // Weight of the passing checks
+	Needed  int // Weight needed to be healthy
+	Results []CheckResult
+}
+
+// Checks returns the checks of s in the order they are reported: the check
+// command (named "check") first, then the named checks.
+func Checks(s db.Service) []db.Check {
+	var checks []db.Check
+	if s.CheckCommand != "" {
+		checks = append(checks, db.Check{Name: "check", Command: s.CheckCommand})
+	}
+	return append(checks, s.Checks.Checks...)
+}
+
+// HasCheck reports whether anything can find s unhealthy: a check command,
+// named checks or a log check.
+func HasCheck(s db.Service) bool {
+	return len(Checks(s)) > 0 || s.LogCheck.File != "" || s.LogCheck.Command != ""
+}
+
+// weight returns the weight a check counts with.
+func weight(c db.Check) int {
+	if c.Weight <= 0 {
+		return 1
+	}
+	return c.Weight
+}
+
+// RunChecks runs all checks of s in parallel and combines their results by the
+// service's check mode. A service without checks is healthy. The checks are
+// killed if ctx ends.
+func RunChecks(ctx context.Context, s db.Service) Health {
+	checks := Checks(s)
+	h := Health{Mode: s.Checks.Mode, Results: make([]CheckResult, len(checks))}
+	if h.Mode == "" {
+		h.Mode = db.CheckModeAll
+	}
+
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cmd := runner.Service(s, c.Command)
+			if c.Timeout > 0 {
+				cmd.Timeout = c.Timeout
+			}
+			res, err := cmd.Run(ctx)
+			h.Results[i] = CheckResult{
+				Check:    c,
+				Passed:   err == nil,
+				ExitCode: res.ExitCode,
+				Output:   res.Output,
+				Duration: res.Duration,
+				Err:      err,
+			}
+		}()
+	}
+	wg.Wait()
+
+	total := 0
+	for _, r := range h.Results {
+		total += weight(r.Check)
+		if r.Passed {
+			h.Passed += weight(r.Check)
+		}
+	}
+
+	switch h.Mode {
+	case db.CheckModeAny:
+		h.Needed = 1
+	case db.CheckModeQuorum:
+		h.Needed = s.Checks.Quorum
+	default:
+		h.Needed = total
+	}
+	h.Healthy = len(h.Results) == 0 || h.Passed >= h.Needed
+	return h
+}
+
+// ExitCode returns the exit code of the first failed check, 0 if none failed.
+func (h Health) ExitCode() int {
+	for _, r := range h.Results {
+		if !r.Passed {
+			return r.ExitCode
+		}
+	}
+	return 0
+}
+
+// Summary describes which checks failed, e.g. "http: exit 7, socket: exit 1".
+// With a single check it keeps the "check exited N" form of the history.
+func (h Health) Summary() string {
+	if len(h.Results) == 1 && h.Results[0].Name == "check" {
+		return fmt.Sprintf("check exited %d", h.Results[0].ExitCode)
+	}
+
+	var failed []string
+	for _, r := range h.Results {
+		if r.Passed {
+			continue
+		}
+		if r.ExitCode >= 0 {
+			failed = append(failed, fmt.Sprintf("%s: exit %d", r.Name, r.ExitCode))
+		} else {
+			failed = append(failed, fmt.Sprintf("%s: %v", r.Name, r.Err))
+		}
+	}
+	summary := strings.Join(failed, ", ")
+	if h.Mode != db.CheckModeAll {
+		summary = fmt.Sprintf("%s (%d/%d passed, %s)", summary, h.Passed, h.Needed, h.Mode)
+	}
+	return summary
+}
+
+// Checker is a check that runs for every service besides its own checks, e.g.
+// one compiled into a program that embeds LSM. A non-nil error fails the
+// service like a failing check command; services it doesn't apply to pass.
+type Checker interface {
+	Name() string
+	Check(ctx context.Context, s db.Service) error
+}
+
+// RunCheckers runs checkers for s in turn and returns why the first failing
+// one failed, or "".
+func RunCheckers(ctx context.Context, s db.Service, checkers []Checker, ev Event) string {
+	for _, c := range checkers {
+		start := time.Now()
+		err := c.Check(ctx, s)
+		l := ev.Logger(s, "check").With("check", c.Name(), logger.Duration(time.Since(start)))
+		if err != nil {
+			l.Warn("Check failed", "error", err)
+			return fmt.Sprintf("%s: %v", c.Name(), err)
+		}
+		l.Debug("Check passed")
+	}
+	return ""
+}
+
+// Check runs the checks of s and logs each result, failed ones with their output.
+func Check(ctx context.Context, s db.Service, ev Event) Health {
+	h := RunChecks(ctx, s)
+	l := ev.Logger(s, "check")
+	for _, r := range h.Results {
+		rl := l.With("check", r.Name, "exit_code", r.ExitCode, logger.Duration(r.Duration))
+		if r.Passed {
+			rl.Debug("Check passed", "output", r.Output)
+		} else {
+			rl.Warn("Check failed", "cmd", r.Command, "error", r.Err, "output", r.Output)
+		}
+	}
+	return h
+}
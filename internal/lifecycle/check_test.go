@@ -0,0 +1,148 @@
+package lifecycle
+
+import (
+	"context"
+	"linux_service_manager/internal/db"
+	"testing"
+)
+
+func TestRunChecksModes(t *testing.T) {
+	pass := func(name string, weight int) db.Check { return db.Check{Name: name, Command: "true", Weight: weight} }
+	fail := func(name string, weight int) db.Check { return db.Check{Name: name, Command: "false", Weight: weight} }
+
+	tests := []struct {
+		name         string
+		checkCommand string
+		checks       db.CheckSet
+		healthy      bool
+		passed       int
+		needed       int
+		wantMode     string
+		results      int
+	}{
+		{
+			name:     "no checks",
+			healthy:  true,
+			wantMode: db.CheckModeAll,
+		},
+		{
+			name:         "check command passes",
+			checkCommand: "true",
+			healthy:      true,
+			passed:       1,
+			needed:       1,
+			wantMode:     db.CheckModeAll,
+			results:      1,
+		},
+		{
+			name:         "all, one fails",
+			checkCommand: "true",
+			checks:       db.CheckSet{Checks: []db.Check{pass("http", 0), fail("socket", 0)}},
+			healthy:      false,
+			passed:       2,
+			needed:       3,
+			wantMode:     db.CheckModeAll,
+			results:      3,
+		},
+		{
+			name:     "any, one passes",
+			checks:   db.CheckSet{Mode: db.CheckModeAny, Checks: []db.Check{fail("http", 0), pass("socket", 0)}},
+			healthy:  true,
+			passed:   1,
+			needed:   1,
+			wantMode: db.CheckModeAny,
+			results:  2,
+		},
+		{
+			name:     "any, all fail",
+			checks:   db.CheckSet{Mode: db.CheckModeAny, Checks: []db.Check{fail("http", 0), fail("socket", 0)}},
+			healthy:  false,
+			passed:   0,
+			needed:   1,
+			wantMode: db.CheckModeAny,
+			results:  2,
+		},
+		{
+			name:     "quorum reached by weight",
+			checks:   db.CheckSet{Mode: db.CheckModeQuorum, Quorum: 3, Checks: []db.Check{pass("primary", 3), fail("replica", 1)}},
+			healthy:  true,
+			passed:   3,
+			needed:   3,
+			wantMode: db.CheckModeQuorum,
+			results:  2,
+		},
+		{
+			name:         "quorum missed",
+			checkCommand: "false",
+			checks:       db.CheckSet{Mode: db.CheckModeQuorum, Quorum: 2, Checks: []db.Check{pass("http", 1), fail("socket", 2)}},
+			healthy:      false,
+			passed:       1,
+			needed:       2,
+			wantMode:     db.CheckModeQuorum,
+			results:      3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := db.Service{Name: "app", CheckCommand: tt.checkCommand, Checks: tt.checks}
+			h := RunChecks(context.Background(), s)
+
+			if h.Healthy != tt.healthy {
+				t.Errorf("Healthy = %v, want %v (%s)", h.Healthy, tt.healthy, h.Summary())
+			}
+			if h.Passed != tt.passed || h.Needed != tt.needed {
+				t.Errorf("Passed/Needed = %d/%d, want %d/%d", h.Passed, h.Needed, tt.passed, tt.needed)
+			}
+			if h.Mode != tt.wantMode {
+				t.Errorf("Mode = %q, want %q", h.Mode, tt.wantMode)
+			}
+			if len(h.Results) != tt.results {
+				t.Fatalf("got %d results, want %d", len(h.Results), tt.results)
+			}
+			if tt.checkCommand != "" && h.Results[0].Name != "check" {
+				t.Errorf("first result is %q, want the check command", h.Results[0].Name)
+			}
+		})
+	}
+}
+
+func TestHealthSummary(t *testing.T) {
+	tests := []struct {
+		name string
+		h    Health
+		want string
+	}{
+		{
+			name: "single check command",
+			h: Health{Mode: db.CheckModeAll, Results: []CheckResult{
+				{Check: db.Check{Name: "check"}, ExitCode: 3},
+			}},
+			want: "check exited 3",
+		},
+		{
+			name: "all",
+			h: Health{Mode: db.CheckModeAll, Results: []CheckResult{
+				{Check: db.Check{Name: "http"}, ExitCode: 7},
+				{Check: db.Check{Name: "socket"}, Passed: true},
+			}},
+			want: "http: exit 7",
+		},
+		{
+			name: "quorum",
+			h: Health{Mode: db.CheckModeQuorum, Passed: 1, Needed: 2, Results: []CheckResult{
+				{Check: db.Check{Name: "http"}, Passed: true},
+				{Check: db.Check{Name: "socket"}, ExitCode: 1},
+			}},
+			want: "socket: exit 1 (1/2 passed, quorum)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.h.Summary(); got != tt.want {
+				t.Errorf("Summary() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"linux_service_manager/internal/db"
+	"linux_service_manager/internal/logger"
+	"linux_service_manager/internal/logwatch"
+	"linux_service_manager/internal/runner"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Triggers describe who initiated an action
+const (
+	TriggerMonitor   = "monitor"
+	TriggerScheduler = "scheduler"
+	TriggerResource  = "resource"
+	TriggerManual    = "manual" // A key in lsm top
+)
+
+// Hook names, also passed to hook commands as LSM_HOOK
+const (
+	HookPreRestart     = "pre_restart"
+	HookPostRestart    = "post_restart"
+	HookOnFailure      = "on_failure"
+	HookOnRecovery     = "on_recovery"
+	HookOnVerifyFailed = "on_verify_failed"
+)
+
+// verifyInterval is the pause between check attempts while verifying a restart
+const verifyInterval = 2 * time.Second
+
+// Event describes why an action or hook runs.
+type Event struct {
+	ID       string // Ties the log lines of one event together, see logger.NewEventID
+	Trigger  string
+	ExitCode int // Exit code of the command that caused the event, 0 if none
+}
+
+// NewEvent returns an Event with a fresh ID.
+func NewEvent(trigger string) Event {
+	return Event{ID: logger.NewEventID(), Trigger: trigger}
+}
+
+// Logger returns a logger for lines about ev and service s in component.
+func (ev Event) Logger(s db.Service, component string) *slog.Logger {
+	return logger.Component(component).With("service", s.Name, "trigger", ev.Trigger, "event_id", ev.ID)
+}
+
+// RunCommand runs one of the service's commands with the service's settings and
+// logs the captured output if it fails. The command is killed if ctx ends.
+func RunCommand(ctx context.Context, s db.Service, cmdStr string, ev Event) (runner.Result, error) {
+	res, err := runner.Service(s, cmdStr).Run(ctx)
+	l := ev.Logger(s, "command").With("cmd", cmdStr, "exit_code", res.ExitCode, logger.Duration(res.Duration))
+	if err != nil {
+		l.Warn("Command failed", "error", err, "output", res.Output)
+	} else {
+		l.Debug("Command succeeded", "output", res.Output)
+	}
+	return res, err
+}
+
+// RunHook runs a hook command of the service. Hooks see the event through
+// LSM_SERVICE, LSM_HOOK, LSM_TRIGGER and LSM_EXIT_CODE. An empty cmdStr is a no-op.
+func RunHook(ctx context.Context, s db.Service, hook, cmdStr string, ev Event) error {
+	if cmdStr == "" {
+		return nil
+	}
+
+	l := ev.Logger(s, "hook").With("hook", hook, "cmd", cmdStr)
+	l.Info("Running hook")
+	c := runner.Service(s, cmdStr)
+	c.Env = append(c.Env,
+		"LSM_SERVICE="+s.Name,
+		"LSM_HOOK="+hook,
+		"LSM_TRIGGER="+ev.Trigger,
+		fmt.Sprintf("LSM_EXIT_CODE=%d", ev.ExitCode),
+	)
+
+	res, err := c.Run(ctx)
+	if err != nil {
+		l.Error("Hook failed", "exit_code", res.ExitCode, logger.Duration(res.Duration), "error", err, "output", res.Output)
+	}
+	return err
+}
+
+// ErrBusy is returned by Restart while the service is already being restarted,
+// also by another process.
+var ErrBusy = errors.New("a restart of the service is already in progress")
+
+// restarting holds the IDs of services with a restart in progress in this
+// process, so the monitor, the scheduler and top never restart the same
+// service at once. Store.LockService keeps out other processes.
+var (
+	restartMu  sync.Mutex
+	restarting = make(map[int]bool)
+)
+
+// Restarting reports whether a restart of the service with id is in progress.
+func Restarting(id int) bool {
+	restartMu.Lock()
+	defer restartMu.Unlock()
+	return restarting[id]
+}
+
+// Restart runs the service's restart command and then verifies that it came back.
+// A failing pre_restart hook vetoes the restart. It returns nil only if the restart
+// command succeeded and, when verification is enabled, the check passed again
+// before the deadline, checkers included. LastRestarted is only updated on
+// success. If ctx ends first, the restart is recorded as interrupted. It
+// returns ErrBusy without doing anything if the service is being restarted
+// already.
+func Restart(ctx context.Context, st db.Store, s db.Service, ev Event, checkers ...Checker) error {
+	restartMu.Lock()
+	if restarting[s.ID] {
+		restartMu.Unlock()
+		return ErrBusy
+	}
+	restarting[s.ID] = true
+	restartMu.Unlock()
+
+	defer func() {
+		restartMu.Lock()
+		delete(restarting, s.ID)
+		restartMu.Unlock()
+	}()
+
+	// The daemon and lsm top run in different processes
+	unlock, err := st.LockService(s.Name)
+	if errors.Is(err, db.ErrLocked) {
+		return ErrBusy
+	}
+	if err != nil {
+		// A restart that might overlap beats none at all
+		ev.Logger(s, "command").Warn("Restarting without the service lock", "error", err)
+	} else {
+		defer unlock()
+	}
+
+	if err := RunHook(ctx, s, HookPreRestart, s.PreRestart, ev); err != nil {
+		if Interrupted(ctx, st, s, ev, "pre_restart hook") {
+			return err
+		}
+		Record(st, s, db.EventRestartVetoed, fmt.Sprintf("trigger %s: pre_restart: %v", ev.Trigger, err))
+		return fmt.Errorf("vetoed by pre_restart hook: %v", err)
+	}
+
+	res, err := RunCommand(ctx, s, s.RestartCommand, ev)
+	if err != nil {
+		if Interrupted(ctx, st, s, ev, "restart command") {
+			return err
+		}
+		Record(st, s, db.EventRestartFailed, fmt.Sprintf("trigger %s: %v", ev.Trigger, err))
+		return fmt.Errorf("restart command failed: %v", err)
+	}
+
+	after := Event{ID: ev.ID, Trigger: ev.Trigger, ExitCode: res.ExitCode}
+	if err := verify(ctx, s, checkers, ev); err != nil {
+		if Interrupted(ctx, st, s, ev, "verification") {
+			return err
+		}
+		ev.Logger(s, "verify").Error("Service did not recover after restart", "error", err)
+		Record(st, s, db.EventVerifyFailed, fmt.Sprintf("trigger %s: %v", ev.Trigger, err))
+		RunHook(ctx, s, HookOnVerifyFailed, s.OnVerifyFailed, after)
+		return err
+	}
+
+	st.UpdateLastRestarted(s.ID)
+	Record(st, s, db.EventRestarted, "trigger "+ev.Trigger)
+	RunHook(ctx, s, HookPostRestart, s.PostRestart, after)
+	return nil
+}
+
+// verify waits VerifyDelay for the service to settle, then re-runs the checks
+// and checkers until they pass or VerifyTimeout has elapsed. A log check takes
+// part with what the service logged since the restart.
+func verify(ctx context.Context, s db.Service, checkers []Checker, ev Event) error {
+	if s.VerifyTimeout <= 0 {
+		return nil
+	}
+
+	w, err := logwatch.Start(s)
+	if err != nil {
+		ev.Logger(s, "verify").Warn("Log check not verified", "error", err)
+	}
+	if w != nil {
+		defer w.Stop()
+	}
+
+	if err := sleep(ctx, s.VerifyDelay); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(s.VerifyTimeout)
+
+	for {
+		failure := ""
+		if h := RunChecks(ctx, s); !h.Healthy {
+			failure = h.Summary()
+		} else if w != nil {
+			failure = w.Failure()
+		}
+		if failure == "" {
+			failure = RunCheckers(ctx, s, checkers, ev)
+		}
+		if failure == "" {
+			ev.Logger(s, "verify").Debug("Checks pass again after restart")
+			return nil
+		}
+		if time.Now().Add(verifyInterval).After(deadline) {
+			return fmt.Errorf("check still failing %v after restart: %s", s.VerifyDelay+s.VerifyTimeout, failure)
+		}
+		if err := sleep(ctx, verifyInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// sleep waits for d, or returns the error of ctx if it ends first.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("interrupted: %v", context.Cause(ctx))
+	}
+}
+
+// Interrupted reports whether ctx has ended, cutting off the action of ev at
+// step. If so, it records that in the service's history.
+func Interrupted(ctx context.Context, st db.Store, s db.Service, ev Event, step string) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+	cause := context.Cause(ctx)
+	ev.Logger(s, "shutdown").Warn("Action interrupted", "step", step, "cause", cause)
+	Record(st, s, db.EventInterrupted, fmt.Sprintf("trigger %s: %s: %v", ev.Trigger, step, cause))
+	return true
+}
+
+// Record adds an event to the service's history, logging instead of failing.
+func Record(st db.Store, s db.Service, event, detail string) {
+	if err := st.AddHistory(s.Name, event, detail); err != nil {
+		logger.Component("history").Error("Failed to record history", "service", s.Name, "event", event, "error", err)
+	}
+}
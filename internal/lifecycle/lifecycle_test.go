@@ -0,0 +1,36 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"linux_service_manager/internal/db"
+	"testing"
+	"time"
+)
+
+type failingChecker struct{}
+
+func (failingChecker) Name() string                            { return "embedded" }
+func (failingChecker) Check(context.Context, db.Service) error { return errors.New("not ready") }
+
+func TestRestartVerifiesWithCheckers(t *testing.T) {
+	st := db.NewMemoryStore()
+	s := db.Service{Name: "app", RestartCommand: "true", CheckCommand: "true", VerifyTimeout: time.Millisecond, Enabled: true}
+	if err := st.AddService(s); err != nil {
+		t.Fatalf("AddService: %v", err)
+	}
+	got, _ := st.GetService("app")
+	s = *got
+
+	if err := Restart(context.Background(), st, s, NewEvent(TriggerManual)); err != nil {
+		t.Fatalf("Restart without checkers: %v", err)
+	}
+	err := Restart(context.Background(), st, s, NewEvent(TriggerManual), failingChecker{})
+	if err == nil {
+		t.Fatalf("Restart verified although a checker fails")
+	}
+	history, _ := st.ListHistory("app", 1)
+	if len(history) != 1 || history[0].Event != db.EventVerifyFailed {
+		t.Errorf("got history %+v, want %s", history, db.EventVerifyFailed)
+	}
+}
@@ -1,56 +1,226 @@
 package logger
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"linux_service_manager/internal/db"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
-func Init(logFile string) {
-	if logFile == "" {
-		// Default to stdout
-		log.SetOutput(os.Stdout)
-		return
-	}
+// Levels and formats accepted by config-log
+var (
+	Levels  = []string{"debug", "info", "warn", "error"}
+	Formats = []string{"text", "json"}
+)
 
-	// Ensure directory exists
-	// We assume logFile contains a path
-	if err := os.MkdirAll(filepath.Dir(logFile), 0755); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to create log dir: %v\n", err)
+// ParseLevel converts a config-log level name to a slog level.
+func ParseLevel(name string) (slog.Level, error) {
+	var l slog.Level
+	if name == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := l.UnmarshalText([]byte(name)); err != nil {
+		return l, fmt.Errorf("invalid log level '%s' (expected %s)", name, strings.Join(Levels, ", "))
 	}
+	return l, nil
+}
+
+// ValidFormat reports whether format is one of Formats. Empty means text.
+func ValidFormat(format string) bool {
+	return format == "" || format == "text" || format == "json"
+}
+
+// What the last Init opened: the log files, which Reopen closes for external
+// rotation, and everything else to close when Init runs again.
+var (
+	openMu sync.Mutex
+	files  []*lumberjack.Logger
+	others []io.Closer
+)
+
+// track adds c to what the next Init closes.
+func track(c io.Closer) {
+	openMu.Lock()
+	others = append(others, c)
+	openMu.Unlock()
+}
+
+// Init sets up the default slog logger, which the standard log package also
+// writes through, for the sinks chosen with config-log. logFile is used by the
+// file sink and, for services with their own log, to place services/<name>.log
+// next to it; if it is empty, logs go to stdout only. Log lines carry these fields where they apply:
+//
+//	component    monitor, scheduler, hook, verify, ...
+//	service      service name
+//	trigger      monitor, scheduler or resource
+//	exit_code    exit code of the command the line is about
+//	duration_ms  run time of that command
+//	event_id     shared by all lines of one check, restart or scheduled run
+//
+// Init can run again to apply a changed config; it closes the files and
+// connections of the previous run.
+func Init(st db.Store, logFile string) {
+	openMu.Lock()
+	oldFiles, oldOthers := files, others
+	files, others = nil, nil
+	openMu.Unlock()
+	defer func() {
+		for _, f := range oldFiles {
+			f.Close()
+		}
+		for _, c := range oldOthers {
+			c.Close()
+		}
+	}()
 
 	// Load config
-	cfg, err := db.GetLogConfig()
+	cfg, err := st.GetLogConfig()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to load log config: %v. Using defaults.\n", err)
-		cfg = &db.LogConfig{
-			MaxSize:    10,
-			MaxBackups: 3,
-			MaxAge:     28,
-			Compress:   true,
+		cfg = db.DefaultLogConfig()
+	}
+
+	level, err := ParseLevel(cfg.Level)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v. Using info.\n", err)
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	format := func(w io.Writer) slog.Handler {
+		if cfg.Format == "json" {
+			return slog.NewJSONHandler(w, opts)
+		}
+		return slog.NewTextHandler(w, opts)
+	}
+
+	sinks := cfg.Sinks
+	if logFile == "" {
+		// Default to stdout
+		sinks = []string{SinkStdout}
+	}
+
+	var handlers multiHandler
+	for _, sink := range sinks {
+		switch sink {
+		case SinkFile:
+			handlers = append(handlers, format(rotating(logFile, cfg)))
+		case SinkStdout:
+			handlers = append(handlers, format(os.Stdout))
+		case SinkStderr:
+			handlers = append(handlers, format(os.Stderr))
+		case SinkSyslog:
+			h, err := newSyslogHandler(cfg.SyslogAddr, opts)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to connect to syslog: %v. Skipping the syslog sink.\n", err)
+				continue
+			}
+			handlers = append(handlers, h)
+		case SinkJournald:
+			h, err := newJournalHandler(opts)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to connect to journald: %v. Skipping the journald sink.\n", err)
+				continue
+			}
+			handlers = append(handlers, h)
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown log sink '%s'. Skipping it.\n", sink)
 		}
 	}
+	if len(handlers) == 0 {
+		// Never log into the void
+		handlers = append(handlers, format(os.Stderr))
+	}
+
+	var h slog.Handler = handlers
+	if len(handlers) == 1 {
+		h = handlers[0]
+	}
 
-	// Setup Lumberjack
-	lj := &lumberjack.Logger{
-		Filename:   logFile,
+	// Services with their own log get their lines at every level, so the
+	// output of passing checks and restarts is kept too
+	var own []string
+	if logFile != "" {
+		services, err := st.ListServices()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list services for their own logs: %v\n", err)
+		}
+		files := map[string]slog.Handler{}
+		debug := &slog.HandlerOptions{Level: slog.LevelDebug}
+		for _, s := range services {
+			if !s.OwnLog {
+				continue
+			}
+			w := rotating(ServiceLogPath(logFile, s.Name), cfg)
+			if cfg.Format == "json" {
+				files[s.Name] = slog.NewJSONHandler(w, debug)
+			} else {
+				files[s.Name] = slog.NewTextHandler(w, debug)
+			}
+			own = append(own, s.Name)
+		}
+		if len(files) > 0 {
+			h = &serviceRouter{inner: h, files: files}
+		}
+	}
+	current.Store(&h)
+	slog.SetDefault(slog.New(&swapHandler{}))
+
+	slog.Info("Logger initialized", "sinks", strings.Join(sinks, ","), "file", logFile, "log_level", level.String(), "log_format", cfg.Format,
+		"max_size_mb", cfg.MaxSize, "max_backups", cfg.MaxBackups, "max_age_days", cfg.MaxAge, "own_logs", strings.Join(own, ","))
+}
+
+// rotating returns a lumberjack writer for path with the rotation settings of cfg.
+func rotating(path string, cfg *db.LogConfig) io.Writer {
+	// Ensure directory exists
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create log dir: %v\n", err)
+	}
+
+	l := &lumberjack.Logger{
+		Filename:   path,
 		MaxSize:    cfg.MaxSize, // megabytes
 		MaxBackups: cfg.MaxBackups,
 		MaxAge:     cfg.MaxAge,   // days
 		Compress:   cfg.Compress, // disabled by default
 	}
+	openMu.Lock()
+	files = append(files, l)
+	openMu.Unlock()
+	return l
+}
+
+// Reopen closes the log files; the next line written opens them again. That
+// lets an external logrotate move them away.
+func Reopen() {
+	openMu.Lock()
+	defer openMu.Unlock()
+	for _, f := range files {
+		f.Close()
+	}
+}
 
-	// Multiwriter to write to both stdout and file?
-	// Usually daemons write to file only, but for debugging stdout is nice.
-	// Let's stick to file mostly, or maybe both.
-	// For this task, let's write to file only if daemonized, but we can't easily tell.
-	// Let's us configured file.
+// Component returns a logger whose lines carry the component field.
+func Component(name string) *slog.Logger {
+	return slog.Default().With("component", name)
+}
+
+// NewEventID returns a random ID that ties together the log lines of one event.
+func NewEventID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
 
-	log.SetOutput(lj)
-	log.Printf("Logger initialized. File: %s, MaxSize: %dMB, MaxBackups: %d, MaxAge: %d days",
-		logFile, cfg.MaxSize, cfg.MaxBackups, cfg.MaxAge)
+// Duration returns the duration_ms field.
+func Duration(d time.Duration) slog.Attr {
+	return slog.Int64("duration_ms", d.Milliseconds())
 }
@@ -0,0 +1,99 @@
+package logger
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"strings"
+)
+
+// ServiceLogPath returns the file a service with its own log writes to,
+// services/<name>.log next to the main log file.
+func ServiceLogPath(logFile, name string) string {
+	safe := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, name)
+	if strings.Trim(safe, ".") == "" {
+		safe = "_" + safe
+	}
+	return filepath.Join(filepath.Dir(logFile), "services", safe+".log")
+}
+
+// serviceRouter passes every record to inner and, when the record carries the
+// service field of a service with its own log, to that service's handler too.
+// The field may come from WithAttrs (ev.Logger) or from the record itself.
+type serviceRouter struct {
+	inner   slog.Handler
+	files   map[string]slog.Handler // By service name, nil once the service is known
+	attrs   []slog.Attr             // From WithAttrs, replayed on a service handler found in a record
+	service slog.Handler            // Handler of the service named by WithAttrs
+}
+
+func (h *serviceRouter) Enabled(ctx context.Context, l slog.Level) bool {
+	// Service logs take every level
+	return h.inner.Enabled(ctx, l) || h.service != nil || len(h.files) > 0
+}
+
+func (h *serviceRouter) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	if h.inner.Enabled(ctx, r.Level) {
+		errs = append(errs, h.inner.Handle(ctx, r.Clone()))
+	}
+
+	service := h.service
+	if service == nil && len(h.files) > 0 {
+		r.Attrs(func(a slog.Attr) bool {
+			if a.Key != "service" {
+				return true
+			}
+			if f, ok := h.files[a.Value.String()]; ok {
+				service = f.WithAttrs(h.attrs)
+			}
+			return false
+		})
+	}
+	if service != nil {
+		errs = append(errs, service.Handle(ctx, r))
+	}
+	return errors.Join(errs...)
+}
+
+func (h *serviceRouter) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := *h
+	out.inner = h.inner.WithAttrs(attrs)
+	if h.service != nil {
+		out.service = h.service.WithAttrs(attrs)
+		return &out
+	}
+	if len(h.files) == 0 {
+		return &out
+	}
+
+	out.attrs = append(append([]slog.Attr(nil), h.attrs...), attrs...)
+	for _, a := range attrs {
+		if a.Key == "service" {
+			if f, ok := h.files[a.Value.String()]; ok {
+				out.service = f.WithAttrs(out.attrs)
+			}
+			out.files, out.attrs = nil, nil
+			break
+		}
+	}
+	return &out
+}
+
+func (h *serviceRouter) WithGroup(name string) slog.Handler {
+	out := *h
+	out.inner = h.inner.WithGroup(name)
+	if h.service != nil {
+		out.service = h.service.WithGroup(name)
+	}
+	// A service field inside a group doesn't name the service
+	out.files, out.attrs = nil, nil
+	return &out
+}
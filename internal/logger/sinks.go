@@ -0,0 +1,326 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode"
+)
+
+// Sinks accepted by config-log
+const (
+	SinkFile     = "file"     // Rotating file (lumberjack)
+	SinkStdout   = "stdout"   // Standard output
+	SinkStderr   = "stderr"   // Standard error
+	SinkSyslog   = "syslog"   // Local syslog daemon over its Unix socket
+	SinkJournald = "journald" // systemd journal, native protocol with structured fields
+)
+
+// ValidSink reports whether name is one of the sinks above.
+func ValidSink(name string) bool {
+	switch name {
+	case SinkFile, SinkStdout, SinkStderr, SinkSyslog, SinkJournald:
+		return true
+	}
+	return false
+}
+
+// journalSocket is where journald accepts native protocol datagrams.
+const journalSocket = "/run/systemd/journal/socket"
+
+// identifier is the syslog tag and SYSLOG_IDENTIFIER of LSM's log lines.
+const identifier = "lsm"
+
+// priority maps a slog level to a syslog priority, which journald uses too.
+func priority(l slog.Level) syslog.Priority {
+	switch {
+	case l >= slog.LevelError:
+		return syslog.LOG_ERR
+	case l >= slog.LevelWarn:
+		return syslog.LOG_WARNING
+	case l >= slog.LevelInfo:
+		return syslog.LOG_INFO
+	}
+	return syslog.LOG_DEBUG
+}
+
+// multiHandler passes every record to each of its handlers.
+type multiHandler []slog.Handler
+
+func (m multiHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	for _, h := range m {
+		if h.Enabled(ctx, l) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m multiHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range m {
+		if h.Enabled(ctx, r.Level) {
+			if err := h.Handle(ctx, r.Clone()); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(multiHandler, len(m))
+	for i, h := range m {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (m multiHandler) WithGroup(name string) slog.Handler {
+	out := make(multiHandler, len(m))
+	for i, h := range m {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
+
+// current is the handler built by the last Init.
+var current atomic.Pointer[slog.Handler]
+
+// swapHandler passes records to the current handler, replaying its WithAttrs
+// and WithGroup calls on it. Loggers made before Init runs again, e.g. by an
+// action in progress, then write to the new sinks instead of closed ones.
+type swapHandler struct {
+	with []func(slog.Handler) slog.Handler
+}
+
+func (h *swapHandler) handler() slog.Handler {
+	inner := *current.Load()
+	for _, w := range h.with {
+		inner = w(inner)
+	}
+	return inner
+}
+
+func (h *swapHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return h.handler().Enabled(ctx, l)
+}
+
+func (h *swapHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler().Handle(ctx, r)
+}
+
+func (h *swapHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.then(func(inner slog.Handler) slog.Handler { return inner.WithAttrs(attrs) })
+}
+
+func (h *swapHandler) WithGroup(name string) slog.Handler {
+	return h.then(func(inner slog.Handler) slog.Handler { return inner.WithGroup(name) })
+}
+
+func (h *swapHandler) then(w func(slog.Handler) slog.Handler) slog.Handler {
+	return &swapHandler{with: append(h.with[:len(h.with):len(h.with)], w)}
+}
+
+// syslogHandler formats records with a text handler and sends each one to
+// syslog with the priority of its level. Time is left to syslog.
+type syslogHandler struct {
+	inner slog.Handler
+	state *syslogState // Shared with handlers derived by WithAttrs/WithGroup
+}
+
+type syslogState struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+	w   *syslog.Writer
+}
+
+func newSyslogHandler(addr string, opts *slog.HandlerOptions) (slog.Handler, error) {
+	var w *syslog.Writer
+	var err error
+	if addr == "" {
+		w, err = syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, identifier)
+	} else {
+		w, err = syslog.Dial("unixgram", addr, syslog.LOG_DAEMON|syslog.LOG_INFO, identifier)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	track(w)
+	st := &syslogState{w: w}
+	textOpts := *opts
+	textOpts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+		if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey) {
+			return slog.Attr{}
+		}
+		return a
+	}
+	return &syslogHandler{inner: slog.NewTextHandler(&st.buf, &textOpts), state: st}, nil
+}
+
+func (h *syslogHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return h.inner.Enabled(ctx, l)
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	st := h.state
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.buf.Reset()
+	if err := h.inner.Handle(ctx, r); err != nil {
+		return err
+	}
+	line := strings.TrimSpace(st.buf.String())
+
+	switch priority(r.Level) {
+	case syslog.LOG_ERR:
+		return st.w.Err(line)
+	case syslog.LOG_WARNING:
+		return st.w.Warning(line)
+	case syslog.LOG_INFO:
+		return st.w.Info(line)
+	}
+	return st.w.Debug(line)
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &syslogHandler{inner: h.inner.WithAttrs(attrs), state: h.state}
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return &syslogHandler{inner: h.inner.WithGroup(name), state: h.state}
+}
+
+// journalHandler sends records to journald using its native protocol, so
+// every attribute becomes a journal field (service=api -> SERVICE=api) that
+// can be queried with e.g. journalctl SERVICE=api.
+type journalHandler struct {
+	level  slog.Leveler
+	conn   *net.UnixConn
+	prefix string      // Group prefix for field names
+	fields [][2]string // From WithAttrs
+}
+
+func newJournalHandler(opts *slog.HandlerOptions) (slog.Handler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	track(conn)
+	return &journalHandler{level: opts.Level, conn: conn}, nil
+}
+
+func (h *journalHandler) Enabled(_ context.Context, l slog.Level) bool {
+	minLevel := slog.LevelInfo
+	if h.level != nil {
+		minLevel = h.level.Level()
+	}
+	return l >= minLevel
+}
+
+func (h *journalHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	writeJournalField(&buf, "MESSAGE", r.Message)
+	writeJournalField(&buf, "PRIORITY", fmt.Sprintf("%d", priority(r.Level)))
+	writeJournalField(&buf, "SYSLOG_IDENTIFIER", identifier)
+	for _, f := range h.fields {
+		writeJournalField(&buf, f[0], f[1])
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		for _, f := range flattenAttr(h.prefix, a) {
+			writeJournalField(&buf, f[0], f[1])
+		}
+		return true
+	})
+
+	_, err := h.conn.Write(buf.Bytes())
+	return err
+}
+
+func (h *journalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := *h
+	out.fields = append([][2]string(nil), h.fields...)
+	for _, a := range attrs {
+		out.fields = append(out.fields, flattenAttr(h.prefix, a)...)
+	}
+	return &out
+}
+
+func (h *journalHandler) WithGroup(name string) slog.Handler {
+	out := *h
+	out.prefix = h.prefix + name + "_"
+	return &out
+}
+
+// flattenAttr turns an attribute into journal fields, expanding groups.
+func flattenAttr(prefix string, a slog.Attr) [][2]string {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return nil
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		var out [][2]string
+		for _, ga := range a.Value.Group() {
+			out = append(out, flattenAttr(prefix+a.Key+"_", ga)...)
+		}
+		return out
+	}
+	return [][2]string{{journalFieldName(prefix + a.Key), a.Value.String()}}
+}
+
+// journalReserved are the fields the handler sets itself or that journald
+// and its clients give a meaning of their own. Attributes with these names
+// are prefixed, so e.g. message=x doesn't become a second MESSAGE.
+var journalReserved = map[string]bool{
+	"MESSAGE": true, "MESSAGE_ID": true, "PRIORITY": true, "CODE_FILE": true, "CODE_LINE": true,
+	"CODE_FUNC": true, "ERRNO": true, "INVOCATION_ID": true, "USER_INVOCATION_ID": true, "TID": true,
+	"DOCUMENTATION": true, "SYSLOG_FACILITY": true, "SYSLOG_IDENTIFIER": true, "SYSLOG_PID": true,
+	"SYSLOG_TIMESTAMP": true, "SYSLOG_RAW": true,
+}
+
+// journalFieldName converts a key to a valid journal field name: upper case
+// letters, digits and underscores, not starting with an underscore (those
+// are reserved for fields journald adds itself) and not one of
+// journalReserved.
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return unicode.ToUpper(r)
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+	name = strings.TrimLeft(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') || journalReserved[name] {
+		name = "F_" + name
+	}
+	return name
+}
+
+// writeJournalField appends one field in the native protocol. Values with a
+// newline use the length-prefixed binary form.
+func writeJournalField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
@@ -0,0 +1,284 @@
+package logwatch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"linux_service_manager/internal/db"
+	"linux_service_manager/internal/logger"
+	"linux_service_manager/internal/runner"
+)
+
+// pollInterval is how often a followed file is checked for new lines and rotation.
+const pollInterval = time.Second
+
+// retryDelay is the pause before re-running a log command that exited.
+const retryDelay = 5 * time.Second
+
+// maxLine caps a single line; longer lines are split.
+const maxLine = 64 * 1024
+
+// Watcher follows the log of one service in the background and keeps enough
+// state to tell whether the service should be considered failed.
+type Watcher struct {
+	name   string
+	lc     db.LogCheck
+	re     *regexp.Regexp
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	matches  []time.Time // Times of pattern matches, oldest first
+	lastLine string      // Last matching line
+	lastSeen time.Time   // Last line of any kind, or the last reset
+}
+
+// Validate checks lc without starting anything.
+func Validate(lc db.LogCheck) error {
+	if lc.File == "" && lc.Command == "" {
+		if lc != (db.LogCheck{}) {
+			return fmt.Errorf("log check needs a file or a command")
+		}
+		return nil
+	}
+	if lc.File != "" && lc.Command != "" {
+		return fmt.Errorf("log check takes a file or a command, not both")
+	}
+	if lc.Pattern == "" && lc.Stall == 0 {
+		return fmt.Errorf("log check needs a pattern or a stall timeout")
+	}
+	if _, err := regexp.Compile(lc.Pattern); err != nil {
+		return fmt.Errorf("invalid log pattern: %v", err)
+	}
+	if lc.Count < 0 || lc.Window < 0 || lc.Stall < 0 {
+		return fmt.Errorf("log check settings must not be negative")
+	}
+	return nil
+}
+
+// Start begins following the log configured for s. It returns nil if s has
+// no log check.
+func Start(s db.Service) (*Watcher, error) {
+	lc := s.LogCheck
+	if lc.File == "" && lc.Command == "" {
+		return nil, nil
+	}
+	if err := Validate(lc); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &Watcher{
+		name:     s.Name,
+		lc:       lc,
+		cancel:   cancel,
+		lastSeen: time.Now(),
+	}
+	if lc.Pattern != "" {
+		w.re = regexp.MustCompile(lc.Pattern)
+	}
+
+	if lc.File != "" {
+		go w.followFile(ctx, lc.File)
+	} else {
+		go w.followCommand(ctx, runner.Service(s, lc.Command))
+	}
+	return w, nil
+}
+
+// Stop ends following the log.
+func (w *Watcher) Stop() {
+	w.cancel()
+}
+
+// Reset forgets earlier matches and restarts the stall timer, e.g. after the
+// service was restarted.
+func (w *Watcher) Reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.matches = nil
+	w.lastSeen = time.Now()
+}
+
+// Failure describes why the log marks the service as failed, or returns "" if
+// it does not.
+func (w *Watcher) Failure() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	if w.lc.Window > 0 {
+		keep := 0
+		for keep < len(w.matches) && now.Sub(w.matches[keep]) > w.lc.Window {
+			keep++
+		}
+		w.matches = w.matches[keep:]
+	}
+
+	count := w.lc.Count
+	if count <= 0 {
+		count = 1
+	}
+	if w.re != nil && len(w.matches) >= count {
+		within := "since the last restart"
+		if w.lc.Window > 0 {
+			within = fmt.Sprintf("within %v", w.lc.Window)
+		}
+		return fmt.Sprintf("log pattern matched %d times %s: %s", len(w.matches), within, w.lastLine)
+	}
+
+	if w.lc.Stall > 0 {
+		if idle := now.Sub(w.lastSeen); idle > w.lc.Stall {
+			return fmt.Sprintf("no log lines for %v", idle.Round(time.Second))
+		}
+	}
+	return ""
+}
+
+// line records one line of the log.
+func (w *Watcher) line(text []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	w.lastSeen = now
+	if w.re != nil && w.re.Match(text) {
+		w.matches = append(w.matches, now)
+		w.lastLine = string(text)
+	}
+}
+
+// followFile follows the log file of the watcher.
+func (w *Watcher) followFile(ctx context.Context, path string) {
+	Follow(ctx, path, -1, w.line, func(err error) {
+		logger.Component("logcheck").Warn("Cannot open log file", "service", w.name, "error", err)
+	})
+}
+
+// Follow calls onLine for each line of path from offset on until ctx is done.
+// A negative offset starts at the end of the file, one past the end (the file
+// shrank meanwhile) at its beginning. The file is reopened when
+// it is replaced (rotation by rename, compared by inode) or truncated
+// (copytruncate). onErr is called once when the file can't be opened, and
+// again only after it could be opened in between.
+func Follow(ctx context.Context, path string, offset int64, onLine func([]byte), onErr func(error)) {
+	var (
+		f       *os.File
+		r       *bufio.Reader
+		partial []byte
+		failed  bool
+	)
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+
+	open := func(offset int64) {
+		nf, err := os.Open(path)
+		if err != nil {
+			if !failed {
+				onErr(err)
+				failed = true
+			}
+			return
+		}
+		failed = false
+		if offset < 0 {
+			nf.Seek(0, io.SeekEnd)
+		} else if st, err := nf.Stat(); err == nil && offset <= st.Size() {
+			nf.Seek(offset, io.SeekStart)
+		}
+		if f != nil {
+			f.Close()
+		}
+		f, r, partial = nf, bufio.NewReader(nf), nil
+	}
+	open(offset)
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		if f != nil {
+			for {
+				chunk, err := r.ReadSlice('\n')
+				partial = append(partial, chunk...)
+				if err == nil || len(partial) >= maxLine {
+					onLine(bytes.TrimRight(partial, "\r\n"))
+					partial = nil
+					continue
+				}
+				if err != bufio.ErrBufferFull {
+					break
+				}
+			}
+
+			// Drained, see whether the file behind the path changed
+			cur, err1 := f.Stat()
+			next, err2 := os.Stat(path)
+			switch {
+			case err2 != nil:
+				// Rotated away and not recreated yet, keep the old file
+			case err1 != nil || !os.SameFile(cur, next):
+				open(0)
+			default:
+				if pos, err := f.Seek(0, io.SeekCurrent); err == nil && next.Size() < pos {
+					open(0)
+				}
+			}
+		} else {
+			// A file that appears after the start is read from its beginning
+			open(0)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// followCommand runs cmd and reads lines from its output, running it again if
+// it exits.
+func (w *Watcher) followCommand(ctx context.Context, cmd *runner.Command) {
+	for {
+		pr, pw := io.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			sc := bufio.NewScanner(pr)
+			sc.Buffer(make([]byte, 4096), maxLine)
+			for sc.Scan() {
+				w.line(sc.Bytes())
+			}
+			// Keep draining so the command never blocks on a full pipe
+			io.Copy(io.Discard, pr)
+		}()
+
+		err := cmd.Stream(ctx, pw)
+		pw.Close()
+		<-done
+
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			err = errors.New("exited")
+		}
+		logger.Component("logcheck").Warn("Log command ended, restarting", "service", w.name, "error", err, "retry_in", retryDelay.String())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryDelay):
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package monitor
+
+import (
+	"linux_service_manager/internal/db"
+	"linux_service_manager/internal/logger"
+	"linux_service_manager/internal/logwatch"
+)
+
+// startLogWatchers starts following logs right away, so lines written before
+// the first tick are not missed.
+func (m *Monitor) startLogWatchers() {
+	services, err := m.store.ListServices()
+	if err != nil {
+		logger.Component("monitor").Error("Error listing services", "error", err)
+		return
+	}
+	for _, s := range services {
+		if s.Enabled {
+			m.watcher(s)
+		}
+	}
+}
+
+// ReloadLogWatchers starts the log watchers over, for changed log checks.
+func (m *Monitor) ReloadLogWatchers() {
+	m.stopLogWatchers()
+	m.startLogWatchers()
+}
+
+// logFailure returns why the service's log marks it as failed, or "".
+func (m *Monitor) logFailure(s db.Service) string {
+	if w := m.watcher(s); w != nil {
+		return w.Failure()
+	}
+	return ""
+}
+
+// watcher returns the log watcher of s, starting it if needed. It returns nil
+// if s has no log check or it could not be started.
+func (m *Monitor) watcher(s db.Service) *logwatch.Watcher {
+	if s.LogCheck.File == "" && s.LogCheck.Command == "" {
+		return nil
+	}
+
+	m.watcherMu.Lock()
+	defer m.watcherMu.Unlock()
+	w, ok := m.watchers[s.ID]
+	if !ok {
+		var err error
+		if w, err = logwatch.Start(s); err != nil {
+			logger.Component("logcheck").Error("Log check disabled", "service", s.Name, "error", err)
+		}
+		// A nil entry remembers the failed start, it is not retried every tick
+		m.watchers[s.ID] = w
+	}
+	return w
+}
+
+// resetLogWatch forgets what the service logged before a restart.
+func (m *Monitor) resetLogWatch(id int) {
+	m.watcherMu.Lock()
+	defer m.watcherMu.Unlock()
+	if w := m.watchers[id]; w != nil {
+		w.Reset()
+	}
+}
+
+func (m *Monitor) stopLogWatchers() {
+	m.watcherMu.Lock()
+	defer m.watcherMu.Unlock()
+	for id, w := range m.watchers {
+		if w != nil {
+			w.Stop()
+		}
+		delete(m.watchers, id)
+	}
+}
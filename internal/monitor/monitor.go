@@ -1,48 +1,139 @@
 package monitor
 
 import (
+	"context"
+	"errors"
 	"linux_service_manager/internal/db"
-	"log"
+	"linux_service_manager/internal/lifecycle"
+	"linux_service_manager/internal/logger"
+	"linux_service_manager/internal/logwatch"
 	"os/exec"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var stopChan = make(chan struct{})
+// Checker is a check that runs for every service besides its own checks,
+// also when verifying a restart.
+type Checker = lifecycle.Checker
 
-func RunLoop(interval time.Duration) {
-	ticker := time.NewTicker(interval)
+// Monitor checks the enabled services of a store every interval and restarts
+// those whose checks fail.
+type Monitor struct {
+	store    db.Store
+	interval time.Duration
+	checkers []Checker
+	isLeader func() bool     // nil if there is no leader election
+	work     context.Context // Of checks and restarts, interrupts them when done
+	running  sync.WaitGroup  // Checks and restarts in progress
+	lastTick atomic.Int64    // UnixNano of the last loop iteration, 0 if not running
+
+	// busy holds the IDs of services with a check or restart in progress. A restart
+	// plus verification can outlast the loop interval, the next tick must not pile on.
+	// failing holds the IDs of services whose check is currently failing.
+	busyMu  sync.Mutex
+	busy    map[int]bool
+	failing map[int]bool
+
+	// watchers follow the logs of services with a log check. They are started with
+	// the monitor (or on the first check of a service) and run until it stops.
+	watcherMu sync.Mutex
+	watchers  map[int]*logwatch.Watcher
+
+	resourceMu sync.Mutex
+	resources  map[int]*resourceState
+}
+
+// New returns a Monitor of the services in st that also runs checkers. The
+// checks and restarts it runs are interrupted when work is done. If isLeader
+// is not nil, the Monitor only acts on failed checks while it returns true.
+func New(work context.Context, st db.Store, interval time.Duration, isLeader func() bool, checkers ...Checker) *Monitor {
+	return &Monitor{
+		store:     st,
+		interval:  interval,
+		checkers:  checkers,
+		isLeader:  isLeader,
+		work:      work,
+		busy:      make(map[int]bool),
+		failing:   make(map[int]bool),
+		watchers:  make(map[int]*logwatch.Watcher),
+		resources: make(map[int]*resourceState),
+	}
+}
+
+// setFailing records the health of a service and reports whether it changed.
+func (m *Monitor) setFailing(id int, f bool) bool {
+	m.busyMu.Lock()
+	defer m.busyMu.Unlock()
+	changed := m.failing[id] != f
+	if f {
+		m.failing[id] = true
+	} else {
+		delete(m.failing, id)
+	}
+	return changed
+}
+
+// Run checks the services every interval until ctx is done. Checks and restarts
+// still in progress keep running, see Wait.
+func (m *Monitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
 	defer ticker.Stop()
 
-	log.Printf("Starting monitoring loop with interval %v", interval)
+	logger.Component("monitor").Info("Starting monitoring loop", "interval", m.interval.String())
+	m.lastTick.Store(time.Now().UnixNano())
+	defer m.lastTick.Store(0)
+	m.startLogWatchers()
 
 	for {
 		select {
 		case <-ticker.C:
+			m.lastTick.Store(time.Now().UnixNano())
 			// Check for Smart Pause
-			pause, err := db.GetPauseConfig()
+			pause, err := m.store.GetPauseConfig()
 			if err != nil {
-				log.Printf("Error reading pause config: %v", err)
+				logger.Component("monitor").Error("Error reading pause config", "error", err)
 			}
 			if pause && IsUserActive() {
-				log.Println("[Smart Pause] Active user session detected. Skipping checks...")
+				logger.Component("smart_pause").Info("Active user session detected. Skipping checks...")
 				continue
 			}
-			checkAllServices()
-		case <-stopChan:
-			log.Println("Stopping monitoring loop")
+			m.checkAllServices()
+		case <-ctx.Done():
+			logger.Component("monitor").Info("Stopping monitoring loop")
+			m.stopLogWatchers()
 			return
 		}
 	}
 }
 
-func Stop() {
-	close(stopChan)
+// LastTick returns when the loop last woke up to check the services, the zero
+// time if it isn't running. A loop stuck e.g. on the database falls behind.
+func (m *Monitor) LastTick() time.Time {
+	if t := m.lastTick.Load(); t != 0 {
+		return time.Unix(0, t)
+	}
+	return time.Time{}
 }
 
-func checkAllServices() {
-	services, err := db.ListServices()
+// State reports whether the last check of the service with id failed and
+// whether a check or restart of it is in progress.
+func (m *Monitor) State(id int) (failing, busy bool) {
+	m.busyMu.Lock()
+	defer m.busyMu.Unlock()
+	return m.failing[id], m.busy[id]
+}
+
+// Wait waits for the checks and restarts in progress. Call it once Run returned
+// and nothing else calls CheckAndRestart.
+func (m *Monitor) Wait() {
+	m.running.Wait()
+}
+
+func (m *Monitor) checkAllServices() {
+	services, err := m.store.ListServices()
 	if err != nil {
-		log.Printf("Error listing services: %v", err)
+		logger.Component("monitor").Error("Error listing services", "error", err)
 		return
 	}
 
@@ -50,39 +141,140 @@ func checkAllServices() {
 		if !s.Enabled {
 			continue
 		}
-		go checkAndRestart(s)
+		go m.CheckAndRestart(s)
 	}
 }
 
-func checkAndRestart(s db.Service) {
-	// Execute Check Command
+// CheckAndRestart runs the service's check and restarts it if the check fails.
+// It returns immediately if the service is already being checked or restarted.
+func (m *Monitor) CheckAndRestart(s db.Service) {
+	m.busyMu.Lock()
+	if m.busy[s.ID] {
+		m.busyMu.Unlock()
+		return
+	}
+	m.busy[s.ID] = true
+	m.running.Add(1)
+	m.busyMu.Unlock()
+
+	defer func() {
+		m.busyMu.Lock()
+		delete(m.busy, s.ID)
+		m.busyMu.Unlock()
+		m.running.Done()
+	}()
+
+	if lifecycle.Restarting(s.ID) {
+		// A scheduled restart is in progress, the service may well be down meanwhile
+		logger.Component("monitor").Debug("Restart in progress, skipping check", "service", s.Name)
+		return
+	}
+
+	// Execute the check command and any further checks
 	// We assume a non-zero exit code means failure -> Restart needed.
 	// For 'systemctl is-failed', user should use '! systemctl is-failed <service>' so that:
 	// - Not Failed (Active/Inactive) -> is-failed returns 1 -> ! makes it 0 (OK)
 	// - Failed -> is-failed returns 0 -> ! makes it 1 (FAIL)
-	err := runCommand(s.CheckCommand)
+	ev := lifecycle.NewEvent(lifecycle.TriggerMonitor)
+	l := ev.Logger(s, "monitor")
+	start := time.Now()
+	health := lifecycle.Check(m.work, s, ev)
+	failed, reason := !health.Healthy, health.Summary()
+	if !failed {
+		// The log check fails the service just like a failing check command
+		if reason = m.logFailure(s); reason != "" {
+			failed = true
+		}
+	}
+	if !failed {
+		if reason = lifecycle.RunCheckers(m.work, s, m.checkers, ev); reason != "" {
+			failed = true
+		}
+	}
+
+	if m.work.Err() != nil {
+		// Checks killed by the shutdown say nothing about the service
+		l.Debug("Check interrupted")
+		return
+	}
+	// Followers record their checks too, for list and top on their host
+	m.store.UpdateLastChecked(s.ID, time.Since(start), failed)
+	if !m.leading() {
+		m.follow(s, failed, reason, ev, "not the leader")
+		return
+	}
+	if s.Silenced() {
+		m.follow(s, failed, reason, ev, "silenced until "+s.SilencedUntil.Format(time.RFC3339))
+		return
+	}
 
-	db.UpdateLastChecked(s.ID)
+	if failed {
+		ev.ExitCode = health.ExitCode()
+		if m.setFailing(s.ID, true) {
+			lifecycle.Record(m.store, s, db.EventFailing, reason)
+			lifecycle.RunHook(m.work, s, lifecycle.HookOnFailure, s.OnFailure, ev)
+		}
 
-	if err != nil {
-		log.Printf("[Monitor] Service %s check failed (cmd: %s). Restarting...", s.Name, s.CheckCommand)
-		restartErr := runCommand(s.RestartCommand)
+		l.Warn("Service check failed. Restarting...", "reason", reason, "exit_code", ev.ExitCode)
+		restartErr := lifecycle.Restart(m.work, m.store, s, ev, m.checkers...)
+		if errors.Is(restartErr, lifecycle.ErrBusy) {
+			l.Info("Not restarting, a restart is already in progress")
+			return
+		}
 		if restartErr != nil {
-			log.Printf("[Monitor] Failed to restart service %s: %v", s.Name, restartErr)
-		} else {
-			log.Printf("[Monitor] Successfully restarted service %s", s.Name)
-			db.UpdateLastRestarted(s.ID)
+			l.Error("Failed to restart service", "error", restartErr)
+			return
+		}
+		l.Info("Successfully restarted service")
+		m.resetLogWatch(s.ID)
+
+		// A verified restart means the check passes again. Without verification
+		// the next tick finds out.
+		if s.VerifyTimeout > 0 {
+			m.recovered(s, ev)
 		}
 	} else {
-		// Log verbose if needed, but keeping quiet for success is better for logs
-		// log.Printf("[Monitor] Service %s is healthy.", s.Name)
+		l.Debug("Service healthy")
+		if m.setFailing(s.ID, false) {
+			m.recovered(s, ev)
+		}
+		if detail := m.checkResources(s, ev); detail != "" {
+			m.restartForResources(s, detail, ev)
+		}
 	}
 }
 
-func runCommand(cmdStr string) error {
-	// Use sh -c to allow shell features (pipes, redirection, negation !)
-	cmd := exec.Command("sh", "-c", cmdStr)
-	return cmd.Run()
+// leading reports whether the monitor acts on failed checks, see New.
+func (m *Monitor) leading() bool {
+	return m.isLeader == nil || m.isLeader()
+}
+
+// follow keeps track of the health of a service the monitor doesn't act on,
+// on a follower or while it is silenced, and only logs it: no history, hooks
+// or restarts. why says why it doesn't act.
+func (m *Monitor) follow(s db.Service, failed bool, reason string, ev lifecycle.Event, why string) {
+	l := ev.Logger(s, "monitor")
+	if !m.setFailing(s.ID, failed) {
+		l.Debug("Service check done", "failed", failed, "passive", why)
+		return
+	}
+	if failed {
+		l.Warn("Service check failed, not restarting: "+why, "reason", reason)
+	} else {
+		l.Info("Service recovered", "passive", why)
+	}
+}
+
+// Checkers returns the extra checkers, which restarts by others verify with.
+func (m *Monitor) Checkers() []Checker {
+	return m.checkers
+}
+
+func (m *Monitor) recovered(s db.Service, ev lifecycle.Event) {
+	m.setFailing(s.ID, false)
+	ev.Logger(s, "monitor").Info("Service recovered")
+	lifecycle.Record(m.store, s, db.EventRecovered, "")
+	lifecycle.RunHook(m.work, s, lifecycle.HookOnRecovery, s.OnRecovery, lifecycle.Event{ID: ev.ID, Trigger: ev.Trigger})
 }
 
 // IsUserActive checks if any user is logged in using the 'who' command
@@ -90,7 +282,7 @@ func IsUserActive() bool {
 	cmd := exec.Command("who")
 	output, err := cmd.Output()
 	if err != nil {
-		log.Printf("Error checking active users: %v", err)
+		logger.Component("smart_pause").Error("Error checking active users", "error", err)
 		return false // Assume no user if check fails, to be safe? Or fail open? Safe is assume no user -> monitor.
 	}
 	// If output is not empty, someone is logged in
@@ -0,0 +1,116 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"linux_service_manager/internal/db"
+	"linux_service_manager/internal/lifecycle"
+	"linux_service_manager/internal/procstat"
+	"strings"
+	"time"
+)
+
+// resourceState is what the monitor remembers about a service's process between ticks.
+type resourceState struct {
+	prev    *procstat.Sample // For CPU usage
+	since   time.Time        // Start of the current breach, zero if none
+	missing bool             // Process was not found on the last tick
+}
+
+// Breaches lists the thresholds of rc that sample exceeds. cpu is the CPU usage
+// in percent, or negative if unknown.
+func Breaches(rc db.ResourceCheck, sample *procstat.Sample, cpu float64) []string {
+	var out []string
+	if rc.MaxRSS > 0 && sample.RSS > int64(rc.MaxRSS)<<20 {
+		out = append(out, fmt.Sprintf("rss %dMB > %dMB", sample.RSS>>20, rc.MaxRSS))
+	}
+	if rc.MaxCPU > 0 && cpu > rc.MaxCPU {
+		out = append(out, fmt.Sprintf("cpu %.1f%% > %.1f%%", cpu, rc.MaxCPU))
+	}
+	if rc.MaxFDs > 0 && sample.FDs > rc.MaxFDs {
+		out = append(out, fmt.Sprintf("fds %d > %d", sample.FDs, rc.MaxFDs))
+	}
+	if rc.MaxThreads > 0 && sample.Threads > rc.MaxThreads {
+		out = append(out, fmt.Sprintf("threads %d > %d", sample.Threads, rc.MaxThreads))
+	}
+	if rc.MaxUptime > 0 && sample.Uptime > rc.MaxUptime {
+		out = append(out, fmt.Sprintf("uptime %v > %v", sample.Uptime.Round(time.Second), rc.MaxUptime))
+	}
+	return out
+}
+
+// checkResources samples the service's process. It returns a description of the
+// exceeded thresholds once they have been exceeded for longer than rc.For, and
+// "" otherwise.
+func (m *Monitor) checkResources(s db.Service, ev lifecycle.Event) string {
+	rc := s.Resources
+	if rc.Target == "" {
+		return ""
+	}
+
+	m.resourceMu.Lock()
+	st := m.resources[s.ID]
+	if st == nil {
+		st = &resourceState{}
+		m.resources[s.ID] = st
+	}
+	m.resourceMu.Unlock()
+
+	pid, err := procstat.FindPID(rc.Target)
+	var sample *procstat.Sample
+	if err == nil {
+		sample, err = procstat.Read(pid)
+	}
+	if err != nil {
+		// Whether the service runs at all is the check command's job
+		if !st.missing {
+			ev.Logger(s, "resources").Warn("Resource check could not sample the process", "target", rc.Target, "error", err)
+		}
+		st.missing, st.prev, st.since = true, nil, time.Time{}
+		return ""
+	}
+	st.missing = false
+
+	cpu := sample.CPUPercent(st.prev)
+	st.prev = sample
+
+	breaches := Breaches(rc, sample, cpu)
+	if len(breaches) == 0 {
+		st.since = time.Time{}
+		return ""
+	}
+	if st.since.IsZero() {
+		st.since = sample.TakenAt
+		ev.Logger(s, "resources").Warn("Service exceeds resource limits", "pid", pid, "breaches", strings.Join(breaches, ", "))
+	}
+
+	sustained := sample.TakenAt.Sub(st.since)
+	if sustained < rc.For {
+		return ""
+	}
+	return fmt.Sprintf("pid %d: %s for %v", pid, strings.Join(breaches, ", "), sustained.Round(time.Second))
+}
+
+// restartForResources restarts a service whose process exceeded its resource
+// limits. ev is the monitor event that found the breach.
+func (m *Monitor) restartForResources(s db.Service, detail string, ev lifecycle.Event) {
+	ev.Trigger = lifecycle.TriggerResource
+	l := ev.Logger(s, "resources")
+	l.Warn("Service exceeded resource limits. Restarting...", "reason", detail)
+	lifecycle.Record(m.store, s, db.EventResourceLimit, detail)
+
+	// Start over with fresh samples of the new process
+	m.resourceMu.Lock()
+	delete(m.resources, s.ID)
+	m.resourceMu.Unlock()
+
+	if err := lifecycle.Restart(m.work, m.store, s, ev, m.checkers...); errors.Is(err, lifecycle.ErrBusy) {
+		l.Info("Not restarting, a restart is already in progress")
+		return
+	} else if err != nil {
+		l.Error("Failed to restart service", "error", err)
+		return
+	}
+	l.Info("Successfully restarted service")
+	m.resetLogWatch(s.ID)
+}
@@ -0,0 +1,188 @@
+package procstat
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicks is USER_HZ, the unit of CPU times in /proc. It is 100 on every
+// Linux architecture LSM builds for.
+const clockTicks = 100
+
+// Sample is a snapshot of a process read from /proc.
+type Sample struct {
+	PID     int
+	RSS     int64         // Bytes
+	CPUTime time.Duration // User + system time since start
+	FDs     int
+	Threads int
+	Uptime  time.Duration
+	TakenAt time.Time
+}
+
+// CPUPercent returns the CPU usage between prev and s, 100 = one full CPU.
+// It returns -1 if prev is not an earlier sample of the same process.
+func (s Sample) CPUPercent(prev *Sample) float64 {
+	if prev == nil || prev.PID != s.PID || !s.TakenAt.After(prev.TakenAt) {
+		return -1
+	}
+	wall := s.TakenAt.Sub(prev.TakenAt)
+	return float64(s.CPUTime-prev.CPUTime) / float64(wall) * 100
+}
+
+// FindPID resolves a target to a PID. Targets are
+//
+//	pidfile:/run/app.pid   PID read from a file
+//	systemd:nginx.service  MainPID of a systemd unit
+//	name:redis-server      Oldest process with that name (comm)
+func FindPID(target string) (int, error) {
+	kind, arg, ok := strings.Cut(target, ":")
+	if !ok || arg == "" {
+		return 0, fmt.Errorf("invalid target '%s' (expected pidfile:, systemd: or name:)", target)
+	}
+
+	switch kind {
+	case "pidfile":
+		data, err := os.ReadFile(arg)
+		if err != nil {
+			return 0, err
+		}
+		return parsePID(strings.TrimSpace(string(data)))
+	case "systemd":
+		out, err := exec.Command("systemctl", "show", "--property=MainPID", "--value", arg).Output()
+		if err != nil {
+			return 0, fmt.Errorf("systemctl show %s: %v", arg, err)
+		}
+		pid, err := parsePID(strings.TrimSpace(string(out)))
+		if err != nil {
+			return 0, fmt.Errorf("unit %s is not running", arg)
+		}
+		return pid, nil
+	case "name":
+		return findByName(arg)
+	}
+	return 0, fmt.Errorf("invalid target '%s' (expected pidfile:, systemd: or name:)", target)
+}
+
+// ValidTarget checks the syntax of a target without resolving it.
+func ValidTarget(target string) error {
+	kind, arg, ok := strings.Cut(target, ":")
+	if !ok || arg == "" || (kind != "pidfile" && kind != "systemd" && kind != "name") {
+		return fmt.Errorf("invalid target '%s' (expected pidfile:<path>, systemd:<unit> or name:<process>)", target)
+	}
+	return nil
+}
+
+func parsePID(s string) (int, error) {
+	pid, err := strconv.Atoi(s)
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("invalid pid '%s'", s)
+	}
+	return pid, nil
+}
+
+func findByName(name string) (int, error) {
+	dirs, err := filepath.Glob("/proc/[0-9]*")
+	if err != nil {
+		return 0, err
+	}
+
+	best, bestStart := 0, int64(-1)
+	for _, dir := range dirs {
+		comm, err := os.ReadFile(filepath.Join(dir, "comm"))
+		if err != nil || strings.TrimSpace(string(comm)) != name {
+			continue
+		}
+		pid, _ := strconv.Atoi(filepath.Base(dir))
+		fields, err := statFields(pid)
+		if err != nil {
+			continue
+		}
+		start, _ := strconv.ParseInt(fields[19], 10, 64)
+		// The oldest match is the main process, not one of its workers
+		if bestStart < 0 || start < bestStart {
+			best, bestStart = pid, start
+		}
+	}
+	if best == 0 {
+		return 0, fmt.Errorf("no process named '%s'", name)
+	}
+	return best, nil
+}
+
+// statFields returns the fields of /proc/<pid>/stat after the command name,
+// so fields[0] is the state (field 3 in proc(5)).
+func statFields(pid int) ([]string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+	// The command name is in parentheses and may contain spaces
+	end := strings.LastIndexByte(string(data), ')')
+	if end < 0 {
+		return nil, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 22 {
+		return nil, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	return fields, nil
+}
+
+// Read takes a sample of process pid.
+func Read(pid int) (*Sample, error) {
+	fields, err := statFields(pid)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+
+	utime, _ := strconv.ParseInt(fields[11], 10, 64)
+	stime, _ := strconv.ParseInt(fields[12], 10, 64)
+	threads, _ := strconv.Atoi(fields[17])
+	startTicks, _ := strconv.ParseInt(fields[19], 10, 64)
+	rssPages, _ := strconv.ParseInt(fields[21], 10, 64)
+
+	s := &Sample{
+		PID:     pid,
+		RSS:     rssPages * int64(os.Getpagesize()),
+		CPUTime: time.Duration(utime+stime) * time.Second / clockTicks,
+		Threads: threads,
+		TakenAt: now,
+	}
+
+	if boot, err := bootTime(); err == nil {
+		started := boot.Add(time.Duration(startTicks) * time.Second / clockTicks)
+		s.Uptime = now.Sub(started)
+	}
+
+	fds, err := os.ReadDir(fmt.Sprintf("/proc/%d/fd", pid))
+	if err != nil {
+		return nil, err
+	}
+	s.FDs = len(fds)
+
+	return s, nil
+}
+
+func bootTime() (time.Time, error) {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if v, ok := strings.CutPrefix(line, "btime "); ok {
+			sec, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Unix(sec, 0), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("btime not found in /proc/stat")
+}
@@ -0,0 +1,162 @@
+package runner
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Identity is who a command runs as and in which environment. The zero value
+// runs as the daemon (root) with the daemon's environment.
+type Identity struct {
+	User    string   // Name or numeric uid
+	Group   string   // Name or numeric gid, defaults to the user's primary group
+	Groups  []string // Supplementary groups, names or numeric gids
+	Dir     string   // Working directory, defaults to the user's home
+	EnvFile string   // KEY=VALUE lines, applied before Command.Env
+	Umask   string   // Octal, empty keeps the daemon's
+}
+
+// Validate checks that the user and groups exist and the umask parses.
+func (id Identity) Validate() error {
+	if _, _, err := id.credential(); err != nil {
+		return err
+	}
+	if _, err := id.umask(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// credential resolves the identity to a syscall credential. It returns nil
+// if no user is configured. home is the user's home directory.
+func (id Identity) credential() (cred *syscall.Credential, home string, err error) {
+	if id.User == "" {
+		if id.Group != "" || len(id.Groups) > 0 {
+			return nil, "", fmt.Errorf("group settings require a user")
+		}
+		return nil, "", nil
+	}
+
+	u, err := lookupUser(id.User)
+	if err != nil {
+		return nil, "", err
+	}
+	uid, _ := strconv.ParseUint(u.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(u.Gid, 10, 32)
+
+	if id.Group != "" {
+		if gid, err = lookupGid(id.Group); err != nil {
+			return nil, "", err
+		}
+	}
+
+	// An empty list still replaces root's supplementary groups
+	groups := []uint32{}
+	for _, g := range id.Groups {
+		sgid, err := lookupGid(g)
+		if err != nil {
+			return nil, "", err
+		}
+		groups = append(groups, uint32(sgid))
+	}
+
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: groups}, u.HomeDir, nil
+}
+
+func (id Identity) umask() (int, error) {
+	if id.Umask == "" {
+		return -1, nil
+	}
+	m, err := strconv.ParseUint(id.Umask, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("invalid umask '%s' (expected octal, e.g. 027)", id.Umask)
+	}
+	return int(m), nil
+}
+
+// environ builds the environment for a command. Commands running as another
+// user don't inherit the daemon's environment, only a minimal login-like one.
+func (id Identity) environ(home string, extra []string) ([]string, error) {
+	var env []string
+	if id.User == "" {
+		env = os.Environ()
+	} else {
+		name := id.User
+		if u, err := lookupUser(id.User); err == nil {
+			name = u.Username
+		}
+		env = []string{
+			"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+			"HOME=" + home,
+			"USER=" + name,
+			"LOGNAME=" + name,
+			"SHELL=/bin/sh",
+		}
+	}
+
+	if id.EnvFile != "" {
+		fileEnv, err := readEnvFile(id.EnvFile)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, fileEnv...)
+	}
+
+	// exec uses the last value of duplicate keys, so later entries win
+	return append(env, extra...), nil
+}
+
+// readEnvFile parses KEY=VALUE lines. Blank lines, # comments and a leading
+// "export " are allowed, and values may be quoted.
+func readEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("env file: %v", err)
+	}
+	defer f.Close()
+
+	var env []string
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		key, val, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("env file %s:%d: expected KEY=VALUE", path, n)
+		}
+		val = strings.TrimSpace(val)
+		if len(val) >= 2 && (val[0] == '"' || val[0] == '\'') && val[len(val)-1] == val[0] {
+			val = val[1 : len(val)-1]
+		}
+		env = append(env, key+"="+val)
+	}
+	return env, sc.Err()
+}
+
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return user.LookupId(name)
+	}
+	return user.Lookup(name)
+}
+
+func lookupGid(name string) (uint64, error) {
+	if gid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(g.Gid, 10, 32)
+}
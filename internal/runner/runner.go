@@ -0,0 +1,325 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"linux_service_manager/internal/db"
+)
+
+// DefaultTimeout applies to commands that don't set one
+const DefaultTimeout = 5 * time.Minute
+
+// maxOutput is how much of a command's output is kept (the tail end)
+const maxOutput = 4096
+
+// Command is one execution of a service command or hook.
+type Command struct {
+	Identity
+	Name    string     // Service name, used to label transient cgroups
+	Sandbox db.Sandbox // Zero value runs unrestricted
+	Cmd     string
+	Env     []string      // Extra KEY=VALUE pairs, applied last
+	Timeout time.Duration // 0 means DefaultTimeout
+}
+
+// Result describes a finished command.
+type Result struct {
+	ExitCode int    // -1 if the command did not exit normally (killed, not started)
+	Output   string // Combined stdout/stderr, truncated to the last few KB
+	Duration time.Duration
+}
+
+// Running describes a command in progress.
+type Running struct {
+	Service string
+	Cmd     string
+	Since   time.Time
+}
+
+// running holds the commands Run is waiting for, by a sequence number.
+var (
+	runningMu  sync.Mutex
+	running    = map[int]Running{}
+	runningSeq int
+)
+
+// InProgress returns the commands in progress, oldest first. Log commands
+// followed with Stream are not included.
+func InProgress() []Running {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+
+	out := make([]Running, 0, len(running))
+	for _, r := range running {
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Since.Before(out[j].Since) })
+	return out
+}
+
+// track adds c to the commands in progress until the returned func is called.
+func track(c *Command) func() {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+
+	runningSeq++
+	id := runningSeq
+	running[id] = Running{Service: c.Name, Cmd: c.Cmd, Since: time.Now()}
+	return func() {
+		runningMu.Lock()
+		delete(running, id)
+		runningMu.Unlock()
+	}
+}
+
+// Service returns a Command that runs cmdStr with the settings of service s.
+func Service(s db.Service, cmdStr string) *Command {
+	return &Command{
+		Identity: Identity{
+			User:    s.RunAsUser,
+			Group:   s.RunAsGroup,
+			Groups:  s.Groups,
+			Dir:     s.WorkDir,
+			EnvFile: s.EnvFile,
+			Umask:   s.Umask,
+		},
+		Name:    s.Name,
+		Sandbox: s.Sandbox,
+		Cmd:     cmdStr,
+		Env:     append([]string(nil), s.Env...),
+		Timeout: s.CommandTimeout,
+	}
+}
+
+// ParseArgv reports whether cmdStr is an argv-style command, a JSON array of
+// strings such as ["systemctl", "restart", "nginx"], which is executed directly
+// without a shell. Anything else, including "[ -f /run/app.pid ]", is a shell
+// command, unless ValidateCommand rejects it.
+func ParseArgv(cmdStr string) ([]string, bool) {
+	trimmed := strings.TrimSpace(cmdStr)
+	if !strings.HasPrefix(trimmed, "[") {
+		return nil, false
+	}
+	var argv []string
+	if err := json.Unmarshal([]byte(trimmed), &argv); err != nil || len(argv) == 0 || argv[0] == "" {
+		return nil, false
+	}
+	return argv, true
+}
+
+// ValidateCommand reports a mistyped argv command: one that starts with [" or
+// is [], so it can only be meant as a JSON array (the shell's [ needs a space
+// after it), but isn't a valid one. Run refuses such commands rather than
+// handing them to the shell.
+func ValidateCommand(cmdStr string) error {
+	trimmed := strings.TrimSpace(cmdStr)
+	if !strings.HasPrefix(trimmed, `["`) && !strings.HasPrefix(trimmed, "[]") {
+		return nil
+	}
+	var argv []string
+	if err := json.Unmarshal([]byte(trimmed), &argv); err != nil {
+		return fmt.Errorf("invalid argv command %s: %v", trimmed, err)
+	}
+	if len(argv) == 0 || argv[0] == "" {
+		return fmt.Errorf("invalid argv command %s: no program", trimmed)
+	}
+	return nil
+}
+
+// Validate checks the identity and sandbox settings without running anything.
+func (c *Command) Validate() error {
+	if err := c.Identity.Validate(); err != nil {
+		return err
+	}
+	return validateSandbox(c.Sandbox, c.User != "")
+}
+
+// Run executes the command and waits for it. A non-nil error means the command
+// could not run, timed out, was interrupted by ctx or exited non-zero.
+func (c *Command) Run(ctx context.Context) (Result, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	runCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := ValidateCommand(c.Cmd); err != nil {
+		return Result{ExitCode: -1}, err
+	}
+	cmd, cleanup, err := c.prepare(runCtx)
+	if err != nil {
+		return Result{ExitCode: -1}, err
+	}
+	defer cleanup()
+
+	var out tailBuffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	start := time.Now()
+	defer track(c)()
+	if err = c.start(cmd); err == nil {
+		err = cmd.Wait()
+	}
+	res := Result{
+		ExitCode: -1,
+		Output:   strings.TrimSpace(out.String()),
+		Duration: time.Since(start),
+	}
+	if cmd.ProcessState != nil {
+		res.ExitCode = cmd.ProcessState.ExitCode()
+	}
+
+	if ctx.Err() != nil {
+		return res, fmt.Errorf("interrupted: %v", context.Cause(ctx))
+	}
+	if runCtx.Err() == context.DeadlineExceeded {
+		return res, fmt.Errorf("timed out after %v", timeout)
+	}
+	return res, err
+}
+
+// Stream runs the command until it exits or ctx is cancelled, writing its
+// combined output to w as it arrives. Unlike Run it has no timeout, it is
+// meant for long-running commands such as log followers.
+func (c *Command) Stream(ctx context.Context, w io.Writer) error {
+	if err := ValidateCommand(c.Cmd); err != nil {
+		return err
+	}
+	cmd, cleanup, err := c.prepare(ctx)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	cmd.Stdout = w
+	cmd.Stderr = w
+	if err := c.start(cmd); err != nil {
+		return err
+	}
+	return cmd.Wait()
+}
+
+// umaskMu is held for writing while the daemon's umask is changed to start a
+// command with its own, and for reading while starting any other command.
+var umaskMu sync.RWMutex
+
+// start starts cmd, a process built by prepare, with c's umask. The umask is
+// per process and inherited at fork, so the daemon's is set just while
+// starting; files the daemon itself creates meanwhile get it too.
+func (c *Command) start(cmd *exec.Cmd) error {
+	mask, err := c.umask()
+	if err != nil {
+		return err
+	}
+	if mask < 0 {
+		umaskMu.RLock()
+		defer umaskMu.RUnlock()
+		return cmd.Start()
+	}
+
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	defer syscall.Umask(syscall.Umask(mask))
+	return cmd.Start()
+}
+
+// prepare builds the process for c, to be started with start. The process is
+// killed with its whole process group when ctx is done. cleanup must be called
+// once it has exited.
+func (c *Command) prepare(ctx context.Context) (cmd *exec.Cmd, cleanup func(), err error) {
+	cleanup = func() {}
+
+	cred, home, err := c.credential()
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := c.umask(); err != nil {
+		return nil, nil, err
+	}
+	env, err := c.environ(home, c.Env)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	argv, ok := ParseArgv(c.Cmd)
+	if !ok {
+		// Use sh -c to allow shell features (pipes, redirection, negation !)
+		argv = []string{"sh", "-c", c.Cmd}
+	}
+
+	// Own process group, so a timeout kills whatever the shell started too
+	attr := &syscall.SysProcAttr{Setpgid: true, Credential: cred}
+
+	if c.Sandbox != (db.Sandbox{}) {
+		// The sandbox chain drops privileges itself after its root-only steps
+		argv = wrapSandbox(c.Sandbox, argv, cred)
+		attr.Credential = nil
+		if c.Sandbox.PrivateTmp {
+			attr.Unshareflags = syscall.CLONE_NEWNS
+		}
+		if usesCgroup(c.Sandbox) {
+			fd, remove, err := createCgroup(c.Sandbox, c.Name)
+			if err != nil {
+				return nil, nil, err
+			}
+			cleanup = remove
+			attr.UseCgroupFD = true
+			attr.CgroupFD = fd
+		}
+	}
+
+	cmd = exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Env = env
+	cmd.Dir = c.Dir
+	if cmd.Dir == "" && cred != nil {
+		// The daemon's own working directory (/root) is not accessible to other users
+		cmd.Dir = home
+		if _, err := os.Stat(home); err != nil {
+			cmd.Dir = "/"
+		}
+	}
+	cmd.SysProcAttr = attr
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = 5 * time.Second
+	return cmd, cleanup, nil
+}
+
+// tailBuffer keeps the last maxOutput bytes written to it.
+type tailBuffer struct {
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	t.buf.Write(p)
+	if t.buf.Len() > maxOutput {
+		tail := append([]byte(nil), t.buf.Bytes()[t.buf.Len()-maxOutput:]...)
+		t.buf.Reset()
+		t.buf.Write(tail)
+		t.truncated = true
+	}
+	return n, nil
+}
+
+func (t *tailBuffer) String() string {
+	if t.truncated {
+		return "..." + t.buf.String()
+	}
+	return t.buf.String()
+}
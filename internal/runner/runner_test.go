@@ -0,0 +1,96 @@
+package runner
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestParseArgv(t *testing.T) {
+	tests := []struct {
+		name   string
+		cmd    string
+		want   []string
+		wantOK bool
+	}{
+		{
+			name:   "argv",
+			cmd:    `["systemctl", "restart", "nginx"]`,
+			want:   []string{"systemctl", "restart", "nginx"},
+			wantOK: true,
+		},
+		{
+			name:   "surrounding space",
+			cmd:    "  [\"true\"]\n",
+			want:   []string{"true"},
+			wantOK: true,
+		},
+		{
+			name:   "arguments with spaces and quotes",
+			cmd:    `["sh", "-c", "echo \"a b\" | tr a b"]`,
+			want:   []string{"sh", "-c", `echo "a b" | tr a b`},
+			wantOK: true,
+		},
+		{name: "shell command", cmd: "systemctl restart nginx"},
+		{name: "shell test", cmd: "[ -f /run/app.pid ]"},
+		{name: "empty array", cmd: "[]"},
+		{name: "empty program", cmd: `["", "restart"]`},
+		{name: "not strings", cmd: `["sleep", 5]`},
+		{name: "unterminated", cmd: `["systemctl", "restart"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ParseArgv(tt.cmd)
+			if ok != tt.wantOK || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseArgv(%q) = %q, %v, want %q, %v", tt.cmd, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRunUmask(t *testing.T) {
+	tests := []struct {
+		name  string
+		cmd   func(path string) string
+		umask string
+		want  os.FileMode
+	}{
+		{
+			name:  "argv",
+			cmd:   func(path string) string { return `["touch", "` + path + `"]` },
+			umask: "077",
+			want:  0600,
+		},
+		{
+			name:  "shell",
+			cmd:   func(path string) string { return "touch " + path },
+			umask: "027",
+			want:  0640,
+		},
+	}
+
+	defer syscall.Umask(syscall.Umask(022))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "created")
+			c := &Command{Identity: Identity{Umask: tt.umask}, Cmd: tt.cmd(path)}
+			if res, err := c.Run(context.Background()); err != nil {
+				t.Fatalf("Run: %v (%s)", err, res.Output)
+			}
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode := fi.Mode().Perm(); mode != tt.want {
+				t.Errorf("created with mode %o, want %o", mode, tt.want)
+			}
+			if daemon := syscall.Umask(022); daemon != 022 {
+				t.Errorf("the daemon's umask was left at %03o", daemon)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"linux_service_manager/internal/db"
+)
+
+// Sandboxed commands run through a chain of standard tools, each of which
+// applies one restriction and execs the next:
+//
+//	[sh -c 'mount tmpfs /tmp && exec "$@"'] [prlimit] [ionice] [nice] [setpriv] <cmd>
+//
+// where <cmd> is either sh -c <script> or the argv of an argv-style command.
+//
+// Everything up to setpriv runs as root, so raising priority or mounting works
+// even when the command itself runs as another user.
+
+// cgroupRoot is where cgroup v2 is mounted. Transient cgroups go below cgroupParent.
+const (
+	cgroupRoot   = "/sys/fs/cgroup"
+	cgroupParent = cgroupRoot + "/lsm"
+)
+
+var ioClasses = map[string]string{
+	"realtime":    "1",
+	"best-effort": "2",
+	"idle":        "3",
+}
+
+// validateSandbox checks sb. withUser tells whether the command runs as
+// another user, which the chain then switches to with setpriv.
+func validateSandbox(sb db.Sandbox, withUser bool) error {
+	if sb == (db.Sandbox{}) {
+		return nil
+	}
+	if sb.LimitCPU < 0 || sb.LimitMemory < 0 || sb.LimitNoFile < 0 || sb.LimitNProc < 0 ||
+		sb.CgroupMemoryMax < 0 || sb.CgroupCPUPercent < 0 {
+		return fmt.Errorf("sandbox limits must not be negative")
+	}
+	if sb.Nice < -20 || sb.Nice > 19 {
+		return fmt.Errorf("nice must be between -20 and 19")
+	}
+	if sb.IOClass != "" {
+		if _, ok := ioClasses[sb.IOClass]; !ok {
+			return fmt.Errorf("invalid io class '%s' (expected realtime, best-effort or idle)", sb.IOClass)
+		}
+	}
+	if sb.IOPriority < 0 || sb.IOPriority > 7 {
+		return fmt.Errorf("io priority must be between 0 and 7")
+	}
+
+	tools := sandboxTools(sb)
+	if withUser && !sb.NoNewPrivs {
+		tools = append(tools, "setpriv")
+	}
+	for _, tool := range tools {
+		if _, err := exec.LookPath(tool); err != nil {
+			return fmt.Errorf("sandbox needs '%s', which was not found in PATH", tool)
+		}
+	}
+	if usesCgroup(sb) {
+		if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+			return fmt.Errorf("cgroup limits need cgroup v2 mounted at %s", cgroupRoot)
+		}
+	}
+	return nil
+}
+
+// sandboxTools lists the external programs the sandbox chain uses.
+func sandboxTools(sb db.Sandbox) []string {
+	var tools []string
+	if hasRlimits(sb) {
+		tools = append(tools, "prlimit")
+	}
+	if sb.IOClass != "" {
+		tools = append(tools, "ionice")
+	}
+	if sb.Nice != 0 {
+		tools = append(tools, "nice")
+	}
+	if sb.PrivateTmp {
+		tools = append(tools, "mount")
+	}
+	if sb.NoNewPrivs {
+		tools = append(tools, "setpriv")
+	}
+	return tools
+}
+
+func hasRlimits(sb db.Sandbox) bool {
+	return sb.LimitCPU > 0 || sb.LimitMemory > 0 || sb.LimitNoFile > 0 || sb.LimitNProc > 0
+}
+
+func usesCgroup(sb db.Sandbox) bool {
+	return sb.CgroupMemoryMax > 0 || sb.CgroupCPUPercent > 0
+}
+
+// wrapSandbox returns the argv that runs argv inside sb. If cred is set, the
+// chain drops to it with setpriv as its last step, and the caller must not
+// set cred on the process itself.
+func wrapSandbox(sb db.Sandbox, argv []string, cred *syscall.Credential) []string {
+	if cred != nil || sb.NoNewPrivs {
+		setpriv := []string{"setpriv"}
+		if sb.NoNewPrivs {
+			setpriv = append(setpriv, "--no-new-privs")
+		}
+		if cred != nil {
+			setpriv = append(setpriv,
+				fmt.Sprintf("--reuid=%d", cred.Uid),
+				fmt.Sprintf("--regid=%d", cred.Gid),
+			)
+			if len(cred.Groups) == 0 {
+				setpriv = append(setpriv, "--clear-groups")
+			} else {
+				gids := make([]string, len(cred.Groups))
+				for i, g := range cred.Groups {
+					gids[i] = strconv.FormatUint(uint64(g), 10)
+				}
+				setpriv = append(setpriv, "--groups="+strings.Join(gids, ","))
+			}
+		}
+		argv = append(append(setpriv, "--"), argv...)
+	}
+
+	if sb.Nice != 0 {
+		argv = append([]string{"nice", "-n", strconv.Itoa(sb.Nice)}, argv...)
+	}
+
+	if sb.IOClass != "" {
+		ionice := []string{"ionice", "-c", ioClasses[sb.IOClass]}
+		if sb.IOClass != "idle" {
+			ionice = append(ionice, "-n", strconv.Itoa(sb.IOPriority))
+		}
+		argv = append(ionice, argv...)
+	}
+
+	if hasRlimits(sb) {
+		prlimit := []string{"prlimit"}
+		if sb.LimitCPU > 0 {
+			prlimit = append(prlimit, fmt.Sprintf("--cpu=%d", sb.LimitCPU))
+		}
+		if sb.LimitMemory > 0 {
+			prlimit = append(prlimit, fmt.Sprintf("--as=%d", int64(sb.LimitMemory)<<20))
+		}
+		if sb.LimitNoFile > 0 {
+			prlimit = append(prlimit, fmt.Sprintf("--nofile=%d", sb.LimitNoFile))
+		}
+		if sb.LimitNProc > 0 {
+			prlimit = append(prlimit, fmt.Sprintf("--nproc=%d", sb.LimitNProc))
+		}
+		argv = append(append(prlimit, "--"), argv...)
+	}
+
+	if sb.PrivateTmp {
+		// Runs in its own mount namespace (Unshareflags), so the tmpfs is only visible to the command
+		mount := `mount -t tmpfs -o mode=1777,nosuid,nodev lsm-tmp /tmp && exec "$@"`
+		argv = append([]string{"sh", "-c", mount, "lsm-sandbox"}, argv...)
+	}
+
+	return argv
+}
+
+var cgroupNameChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// createCgroup creates a transient cgroup v2 for one command run and returns
+// an open fd for SysProcAttr.CgroupFD. cleanup kills anything left in the
+// cgroup and removes it.
+func createCgroup(sb db.Sandbox, service string) (fd int, cleanup func(), err error) {
+	if err := os.MkdirAll(cgroupParent, 0755); err != nil {
+		return -1, nil, fmt.Errorf("cgroup: %v", err)
+	}
+
+	var controllers []string
+	if sb.CgroupMemoryMax > 0 {
+		controllers = append(controllers, "+memory")
+	}
+	if sb.CgroupCPUPercent > 0 {
+		controllers = append(controllers, "+cpu")
+	}
+	enable := strings.Join(controllers, " ")
+	// The root usually has them enabled already, ignore errors there
+	os.WriteFile(filepath.Join(cgroupRoot, "cgroup.subtree_control"), []byte(enable), 0644)
+	if err := os.WriteFile(filepath.Join(cgroupParent, "cgroup.subtree_control"), []byte(enable), 0644); err != nil {
+		return -1, nil, fmt.Errorf("cgroup: enabling controllers: %v", err)
+	}
+
+	dir := filepath.Join(cgroupParent, fmt.Sprintf("%s-%d", cgroupNameChars.ReplaceAllString(service, "_"), time.Now().UnixNano()))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return -1, nil, fmt.Errorf("cgroup: %v", err)
+	}
+	remove := func() {
+		os.WriteFile(filepath.Join(dir, "cgroup.kill"), []byte("1"), 0644)
+		// The kernel needs a moment to reap killed processes before rmdir succeeds
+		for i := 0; i < 10; i++ {
+			if err := os.Remove(dir); err == nil || os.IsNotExist(err) {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	if sb.CgroupMemoryMax > 0 {
+		if err := os.WriteFile(filepath.Join(dir, "memory.max"), []byte(strconv.FormatInt(int64(sb.CgroupMemoryMax)<<20, 10)), 0644); err != nil {
+			remove()
+			return -1, nil, fmt.Errorf("cgroup: memory.max: %v", err)
+		}
+	}
+	if sb.CgroupCPUPercent > 0 {
+		// Quota per 100ms period
+		if err := os.WriteFile(filepath.Join(dir, "cpu.max"), []byte(fmt.Sprintf("%d 100000", sb.CgroupCPUPercent*1000)), 0644); err != nil {
+			remove()
+			return -1, nil, fmt.Errorf("cgroup: cpu.max: %v", err)
+		}
+	}
+
+	fd, err = syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		remove()
+		return -1, nil, fmt.Errorf("cgroup: %v", err)
+	}
+	return fd, func() {
+		syscall.Close(fd)
+		remove()
+	}, nil
+}
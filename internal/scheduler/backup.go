@@ -0,0 +1,62 @@
+package scheduler
+
+import (
+	"linux_service_manager/internal/db"
+	"linux_service_manager/internal/logger"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// backupStore is a store that can back itself up, the database.
+type backupStore interface {
+	AutoBackup(cfg db.BackupConfig) (string, []string, error)
+	BackupDir(cfg db.BackupConfig) string
+}
+
+// asBackupStore returns st, or the store it wraps (see Unwrap), as a backupStore.
+func asBackupStore(st db.Store) (backupStore, bool) {
+	for {
+		if bs, ok := st.(backupStore); ok {
+			return bs, true
+		}
+		w, ok := st.(interface{ Unwrap() db.Store })
+		if !ok {
+			return nil, false
+		}
+		st = w.Unwrap()
+	}
+}
+
+// scheduleBackup adds the automatic database backup set with 'lsm db auto-backup'.
+// Stores other than the database have nothing to back up.
+func (sch *Scheduler) scheduleBackup() error {
+	bs, ok := asBackupStore(sch.store)
+	if !ok {
+		return nil
+	}
+	cfg, err := sch.store.GetBackupConfig()
+	if err != nil || cfg.Schedule == "" {
+		return err
+	}
+	parsed, err := Parse(cfg.Schedule, "")
+	if err != nil {
+		return err
+	}
+
+	l := logger.Component("backup")
+	id := sch.c.Schedule(parsed, sch.leaderOnly(cron.FuncJob(func() {
+		start := time.Now()
+		path, removed, err := bs.AutoBackup(*cfg)
+		if err != nil {
+			l.Error("Automatic backup failed", "error", err)
+			return
+		}
+		l.Info("Database backed up", "file", path, "removed", strings.Join(removed, ","), logger.Duration(time.Since(start)))
+	})))
+	sch.entries[id] = Entry{Action: "backup"}
+	l.Info("Scheduled automatic backup", "cron", cfg.Schedule, "dir", bs.BackupDir(*cfg), "keep", cfg.Keep,
+		"next", parsed.Next(time.Now()).Format(time.RFC3339))
+	return nil
+}
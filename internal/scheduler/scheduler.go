@@ -1,35 +1,172 @@
 package scheduler
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"linux_service_manager/internal/db"
-	"log"
-	"os/exec"
+	"linux_service_manager/internal/lifecycle"
+	"linux_service_manager/internal/logger"
+	"linux_service_manager/internal/monitor"
+	"log/slog"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/robfig/cron/v3"
 )
 
-var c *cron.Cron
+// Scheduler runs the cron schedules of the services in a store. Scheduled
+// checks go through the monitor, so they don't overlap with its own.
+type Scheduler struct {
+	store    db.Store
+	monitor  *monitor.Monitor
+	work     context.Context // Of the scheduled actions, interrupts them when done
+	isLeader func() bool     // nil if there is no leader election
 
-func Start() {
-	c = cron.New()
+	mu       sync.Mutex
+	c        *cron.Cron
+	entries  map[cron.EntryID]Entry // What the entries of c run
+	replaced []context.Context      // Of crons replaced by Reload, done when their jobs finished
 
-	err := loadJobs()
+	stopOnce sync.Once
+	stopping chan struct{}  // Closed by Stop, ends jitter delays
+	catchups sync.WaitGroup // Catch-up runs, which cron doesn't track
+}
+
+// New returns a Scheduler of the services in st. The actions it runs are
+// interrupted when work is done. If isLeader is not nil, jobs only run while
+// it returns true; a follower keeps the schedules to show their next runs.
+func New(work context.Context, st db.Store, mon *monitor.Monitor, isLeader func() bool) *Scheduler {
+	return &Scheduler{
+		store:    st,
+		monitor:  mon,
+		work:     work,
+		isLeader: isLeader,
+		stopping: make(chan struct{}),
+	}
+}
+
+// Entry is a scheduled job and its next run.
+type Entry struct {
+	Service    string // Empty for the backup
+	Action     string // An action of a schedule, restart for a service's --schedule, or backup
+	ScheduleID int    // 0 for a service's --schedule and the backup
+	Next       time.Time
+}
+
+// How load treats the last runs of the schedules
+type loadMode int
+
+const (
+	loadStart    loadMode = iota // The leader catches up on the runs missed since
+	loadReload                   // Kept, runs missed while the daemon is up were not missed because it was down
+	loadPromoted                 // Start over: the runs since were the old leader's
+)
+
+func (sch *Scheduler) Start() {
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+	sch.load(loadStart)
+	logger.Component("scheduler").Info("Started cron scheduler")
+}
+
+// Reload replaces the jobs with those of the services and schedules now in
+// the store. Runs in progress are not interrupted. Catch-up policies only
+// apply at Start: runs missed while the daemon is up were not missed because
+// it was down. It does nothing once Stop was called.
+func (sch *Scheduler) Reload() {
+	if sch.reload(loadReload) {
+		logger.Component("scheduler").Info("Reloaded cron scheduler")
+	}
+}
+
+// Promoted reloads the jobs once this daemon became leader, without catching
+// up on missed runs: those due while it followed or before it started were the
+// old leader's. Followers don't record runs, so the last runs start over.
+func (sch *Scheduler) Promoted() {
+	if sch.reload(loadPromoted) {
+		logger.Component("scheduler").Info("Reloaded cron scheduler as leader")
+	}
+}
+
+// reload replaces the cron, see load. It reports false once Stop was called.
+func (sch *Scheduler) reload(mode loadMode) bool {
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+	select {
+	case <-sch.stopping:
+		return false
+	default:
+	}
+	sch.replaced = append(sch.replaced, sch.c.Stop())
+	sch.load(mode)
+	return true
+}
+
+// load starts a new cron with the jobs of the store, treating their last runs
+// as mode says.
+func (sch *Scheduler) load(mode loadMode) {
+	sch.c = cron.New(cron.WithParser(parser))
+	sch.entries = map[cron.EntryID]Entry{}
+
+	err := sch.loadJobs(mode)
 	if err != nil {
-		log.Printf("[Scheduler] Failed to load jobs: %v", err)
+		logger.Component("scheduler").Error("Failed to load jobs", "error", err)
+	}
+	if err := sch.scheduleBackup(); err != nil {
+		logger.Component("backup").Error("Failed to schedule automatic backup", "error", err)
 	}
+	sch.c.Start()
+}
+
+// leading reports whether jobs run, see New.
+func (sch *Scheduler) leading() bool {
+	return sch.isLeader == nil || sch.isLeader()
+}
+
+// leaderOnly wraps a job so it is skipped on a follower.
+func (sch *Scheduler) leaderOnly(j cron.Job) cron.Job {
+	return cron.FuncJob(func() {
+		if !sch.leading() {
+			logger.Component("scheduler").Debug("Skipping scheduled run: not the leader")
+			return
+		}
+		j.Run()
+	})
+}
+
+// Stop stops scheduling and waits for the actions in progress to finish.
+func (sch *Scheduler) Stop() {
+	sch.stopOnce.Do(func() { close(sch.stopping) })
 
-	c.Start()
-	log.Println("[Scheduler] Started cron scheduler")
+	sch.mu.Lock()
+	running := append(sch.replaced, sch.c.Stop())
+	sch.mu.Unlock()
+	for _, ctx := range running {
+		<-ctx.Done()
+	}
+	sch.catchups.Wait()
 }
 
-func Stop() {
-	if c != nil {
-		c.Stop()
+// Entries returns the scheduled jobs, the next to run first.
+func (sch *Scheduler) Entries() []Entry {
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+
+	var out []Entry
+	for _, e := range sch.c.Entries() {
+		entry := sch.entries[e.ID]
+		entry.Next = e.Next
+		out = append(out, entry)
 	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Next.Before(out[j].Next) })
+	return out
 }
 
-func loadJobs() error {
-	services, err := db.ListServices()
+func (sch *Scheduler) loadJobs(mode loadMode) error {
+	services, err := sch.store.ListServices()
 	if err != nil {
 		return err
 	}
@@ -39,47 +176,258 @@ func loadJobs() error {
 		if s.CronSchedule == "" || !s.Enabled {
 			continue
 		}
+		sch.addSchedule(s, serviceSchedule(s), mode)
+	}
 
-		// Capture variable for closure
-		svc := s
+	return sch.loadSchedules(services, mode)
+}
 
-		_, err := c.AddFunc(svc.CronSchedule, func() {
-			safeRestart(svc)
-		})
-		if err != nil {
-			log.Printf("[Scheduler] Failed to schedule service %s with schedule '%s': %v", svc.Name, svc.CronSchedule, err)
-		} else {
-			log.Printf("[Scheduler] Scheduled restart for %s at '%s'", svc.Name, svc.CronSchedule)
+// serviceSchedule returns the --schedule of s as a restart schedule with ID 0.
+// Runs it missed are skipped, like those of schedules added without --catchup.
+func serviceSchedule(s db.Service) db.Schedule {
+	return db.Schedule{
+		ServiceID:    s.ID,
+		ServiceName:  s.Name,
+		Action:       db.ActionRestart,
+		CronSchedule: s.CronSchedule,
+		Catchup:      db.CatchupSkip,
+		LastRun:      s.ScheduleLastRun,
+		Enabled:      true,
+	}
+}
+
+// loadSchedules adds the entries of the schedules table
+func (sch *Scheduler) loadSchedules(services []db.Service, mode loadMode) error {
+	schedules, err := sch.store.ListSchedules("")
+	if err != nil {
+		return err
+	}
+
+	byID := make(map[int]db.Service, len(services))
+	for _, s := range services {
+		byID[s.ID] = s
+	}
+
+	for _, sc := range schedules {
+		svc, ok := byID[sc.ServiceID]
+		if !ok || !sc.Enabled || !svc.Enabled {
+			continue
 		}
+		sch.addSchedule(svc, sc, mode)
 	}
 	return nil
 }
 
-func safeRestart(s db.Service) {
-	log.Printf("[Scheduler] Triggered scheduled restart for %s", s.Name)
+// addSchedule adds sc to the cron, after handling its last run as mode says.
+// Only the leader records runs.
+func (sch *Scheduler) addSchedule(svc db.Service, sched db.Schedule, mode loadMode) {
+	l := scheduleLogger(svc, sched)
+
+	parsed, err := Parse(sched.CronSchedule, sched.Timezone)
+	if err != nil {
+		l.Error("Failed to schedule", "error", err)
+		return
+	}
+
+	switch {
+	case !sch.leading():
+		// A follower leaves missed runs to the leader
+	case mode == loadStart:
+		sch.catchUp(svc, sched, parsed)
+	case mode == loadPromoted || sched.LastRun == nil:
+		// Count missed runs from now
+		if err := sch.recordRun(sched, time.Now()); err != nil {
+			l.Error("Failed to record run of schedule", "error", err)
+		}
+	}
+
+	id := sch.c.Schedule(parsed, cron.FuncJob(func() {
+		sch.run(svc, sched, lifecycle.NewEvent(lifecycle.TriggerScheduler))
+	}))
+	sch.entries[id] = Entry{Service: svc.Name, Action: sched.Action, ScheduleID: sched.ID}
+	l.Info("Scheduled action", "cron", sched.CronSchedule, "next", parsed.Next(time.Now()).Format(time.RFC3339))
+}
+
+// run runs sc on the leader after its jitter and records the run.
+func (sch *Scheduler) run(svc db.Service, sc db.Schedule, ev lifecycle.Event) {
+	l := scheduleLogger(svc, sc)
+	if !sch.leading() {
+		l.Debug("Skipping scheduled run: not the leader", "event_id", ev.ID)
+		return
+	}
+	if sc.Jitter > 0 {
+		// Spread fleet-wide runs so hosts don't all restart in the same second
+		delay := rand.N(sc.Jitter)
+		l.Info("Delaying run (jitter)", "event_id", ev.ID, "delay", delay.Round(time.Second).String())
+		select {
+		case <-time.After(delay):
+		case <-sch.stopping:
+			// Not recorded, so it counts as missed at the next start
+			l.Info("Skipping delayed run: shutting down", "event_id", ev.ID)
+			return
+		}
+	}
+	if err := sch.recordRun(sc, time.Now()); err != nil {
+		l.Error("Failed to record run of schedule", "event_id", ev.ID, "error", err)
+	}
+	sch.runSchedule(svc, sc, ev)
+}
+
+// recordRun records that sc ran at t, in the service for its --schedule.
+func (sch *Scheduler) recordRun(sc db.Schedule, t time.Time) error {
+	if sc.ID == 0 {
+		return sch.store.UpdateServiceScheduleLastRun(sc.ServiceID, t)
+	}
+	return sch.store.UpdateScheduleLastRun(sc.ID, t)
+}
+
+// scheduleLogger returns a logger for lines about schedule sc of service s.
+func scheduleLogger(s db.Service, sc db.Schedule) *slog.Logger {
+	return logger.Component("scheduler").With("service", s.Name, "schedule_id", sc.ID, "action", sc.Action)
+}
+
+// maxMissedRuns bounds the walk over missed activations of very frequent schedules
+const maxMissedRuns = 10000
+
+// catchUp applies the schedule's catch-up policy to runs that were due while the
+// daemon was down, and records the decision in history.
+func (sch *Scheduler) catchUp(s db.Service, sc db.Schedule, sched cron.Schedule) {
+	now := time.Now()
+	l := scheduleLogger(s, sc)
+
+	if sc.LastRun == nil {
+		// Never ran before: nothing can have been missed, start tracking from now
+		if err := sch.recordRun(sc, now); err != nil {
+			l.Error("Failed to record run of schedule", "error", err)
+		}
+		return
+	}
+
+	missed := 0
+	var latest time.Time
+	for t := sched.Next(*sc.LastRun); !t.IsZero() && !t.After(now); t = sched.Next(t) {
+		latest = t
+		missed++
+		if missed >= maxMissedRuns {
+			break
+		}
+	}
+	if missed == 0 {
+		return
+	}
+
+	run := false
+	switch sc.Catchup {
+	case db.CatchupOnce:
+		run = true
+	case db.CatchupGrace:
+		run = now.Sub(latest) <= sc.CatchupGrace
+	}
+
+	decision := "skipped"
+	if run {
+		decision = "running now"
+	}
+	which := fmt.Sprintf("schedule #%d", sc.ID)
+	if sc.ID == 0 {
+		which = "service schedule"
+	}
+	detail := fmt.Sprintf("%s (%s '%s'): %d run(s) missed, latest due %s; policy %s: %s",
+		which, sc.Action, sc.CronSchedule, missed, latest.Format(time.RFC3339), sc.Catchup, decision)
+	l.Warn("Missed run", "missed", missed, "latest", latest.Format(time.RFC3339), "policy", sc.Catchup, "decision", decision)
+	if err := sch.store.AddHistory(s.Name, db.EventScheduleMissed, detail); err != nil {
+		l.Error("Failed to record history", "error", err)
+	}
+
+	if !run {
+		// Handled, don't report them again on next startup
+		if err := sch.recordRun(sc, now); err != nil {
+			l.Error("Failed to record run of schedule", "error", err)
+		}
+		return
+	}
+	// Recorded by run, with a jitter like any other run
+	sch.catchups.Add(1)
+	go func() {
+		defer sch.catchups.Done()
+		sch.run(s, sc, lifecycle.NewEvent(lifecycle.TriggerScheduler))
+	}()
+}
+
+func (sch *Scheduler) runSchedule(s db.Service, sc db.Schedule, ev lifecycle.Event) {
+	switch sc.Action {
+	case db.ActionRestart:
+		sch.safeRestart(s, ev)
+	case db.ActionStop:
+		sch.runAction(s, sc, s.StopCommand, ev)
+	case db.ActionStart:
+		sch.runAction(s, sc, s.StartCommand, ev)
+	case db.ActionCommand:
+		sch.runAction(s, sc, sc.Command, ev)
+	case db.ActionCheck:
+		// The check gets its own monitor event
+		ev.Logger(s, "scheduler").Info("Triggered scheduled check", "schedule_id", sc.ID)
+		sch.monitor.CheckAndRestart(s)
+	default:
+		ev.Logger(s, "scheduler").Error("Unknown action", "schedule_id", sc.ID, "action", sc.Action)
+	}
+}
+
+func (sch *Scheduler) runAction(s db.Service, sc db.Schedule, cmdStr string, ev lifecycle.Event) {
+	l := ev.Logger(s, "scheduler").With("schedule_id", sc.ID, "action", sc.Action)
+	l.Info("Triggered scheduled action")
+
+	if cmdStr == "" {
+		l.Warn("Skipping action: no command configured")
+		return
+	}
+
+	res, err := lifecycle.RunCommand(sch.work, s, cmdStr, ev)
+	l = l.With("exit_code", res.ExitCode, logger.Duration(res.Duration))
+	if err != nil && lifecycle.Interrupted(sch.work, sch.store, s, ev, fmt.Sprintf("schedule #%d (%s)", sc.ID, sc.Action)) {
+		return
+	}
+	if err != nil {
+		l.Error("Scheduled action failed", "error", err)
+	} else {
+		l.Info("Scheduled action completed")
+	}
+}
+
+// checkers returns the extra checkers of the monitor, which restarts are
+// verified with too.
+func (sch *Scheduler) checkers() []monitor.Checker {
+	if sch.monitor == nil {
+		return nil
+	}
+	return sch.monitor.Checkers()
+}
+
+func (sch *Scheduler) safeRestart(s db.Service, ev lifecycle.Event) {
+	l := ev.Logger(s, "scheduler")
+	l.Info("Triggered scheduled restart")
 
 	// Safe Check: Only restart if running
 	if s.StatusCommand != "" {
-		err := runCommand(s.StatusCommand)
+		res, err := lifecycle.RunCommand(sch.work, s, s.StatusCommand, ev)
+		if err != nil && lifecycle.Interrupted(sch.work, sch.store, s, ev, "status command") {
+			return
+		}
 		if err != nil {
-			log.Printf("[Scheduler] Skipping restart for %s: Status check failed (not running?)", s.Name)
+			l.Info("Skipping restart: status check failed (not running?)", "exit_code", res.ExitCode)
 			return
 		}
 	} else {
-		log.Printf("[Scheduler] Warning: No status_command for %s. Restarting blindly.", s.Name)
+		l.Warn("No status_command. Restarting blindly.")
 	}
 
 	// Restart
-	err := runCommand(s.RestartCommand)
-	if err != nil {
-		log.Printf("[Scheduler] Failed to restart %s: %v", s.Name, err)
+	err := lifecycle.Restart(sch.work, sch.store, s, ev, sch.checkers()...)
+	if errors.Is(err, lifecycle.ErrBusy) {
+		l.Info("Skipping restart: a restart is already in progress")
+	} else if err != nil {
+		l.Error("Failed to restart", "error", err)
 	} else {
-		log.Printf("[Scheduler] Successfully restarted %s", s.Name)
-		db.UpdateLastRestarted(s.ID)
+		l.Info("Successfully restarted")
 	}
 }
-
-func runCommand(cmdStr string) error {
-	cmd := exec.Command("sh", "-c", cmdStr)
-	return cmd.Run()
-}
@@ -0,0 +1,218 @@
+package scheduler
+
+import (
+	"context"
+	"linux_service_manager/internal/db"
+	"linux_service_manager/internal/lifecycle"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCatchUp(t *testing.T) {
+	ago := func(d time.Duration) *time.Time {
+		t := time.Now().Add(-d)
+		return &t
+	}
+
+	tests := []struct {
+		name       string
+		service    bool // The service's --schedule rather than a schedule
+		catchup    string
+		grace      time.Duration
+		lastRun    *time.Time
+		wantDetail string // Part of the schedule_missed history entry, empty for none
+		wantRun    bool
+		wantRecord bool // Whether the last run is set to now
+	}{
+		{
+			name:       "never ran",
+			catchup:    db.CatchupOnce,
+			wantRecord: true,
+		},
+		{
+			name:    "nothing missed",
+			catchup: db.CatchupOnce,
+			lastRun: ago(30 * time.Minute),
+		},
+		{
+			name:       "skip",
+			catchup:    db.CatchupSkip,
+			lastRun:    ago(150 * time.Minute),
+			wantDetail: "2 run(s) missed",
+			wantRecord: true,
+		},
+		{
+			name:       "once",
+			catchup:    db.CatchupOnce,
+			lastRun:    ago(150 * time.Minute),
+			wantDetail: "policy once: running now",
+			wantRun:    true,
+			wantRecord: true,
+		},
+		{
+			name:       "within grace",
+			catchup:    db.CatchupGrace,
+			grace:      time.Hour,
+			lastRun:    ago(90 * time.Minute),
+			wantDetail: "policy grace: running now",
+			wantRun:    true,
+			wantRecord: true,
+		},
+		{
+			name:       "grace exceeded",
+			catchup:    db.CatchupGrace,
+			grace:      10 * time.Minute,
+			lastRun:    ago(90 * time.Minute),
+			wantDetail: "policy grace: skipped",
+			wantRecord: true,
+		},
+		{
+			name:       "service schedule",
+			service:    true,
+			lastRun:    ago(150 * time.Minute),
+			wantDetail: "service schedule (restart '@every 1h'): 2 run(s) missed",
+			wantRecord: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			marker := filepath.Join(t.TempDir(), "ran")
+			st := db.NewMemoryStore()
+			if err := st.AddService(db.Service{Name: "app", RestartCommand: "true", CheckCommand: "true", CronSchedule: "@every 1h", Enabled: true}); err != nil {
+				t.Fatalf("AddService: %v", err)
+			}
+			s, _ := st.GetService("app")
+
+			var sc db.Schedule
+			if tt.service {
+				if tt.lastRun != nil {
+					st.UpdateServiceScheduleLastRun(s.ID, *tt.lastRun)
+				}
+				s, _ = st.GetService("app")
+				sc = serviceSchedule(*s)
+			} else {
+				st.AddSchedule(db.Schedule{ServiceID: s.ID, Action: db.ActionCommand, Command: "touch " + marker,
+					CronSchedule: "@every 1h", Enabled: true, Catchup: tt.catchup, CatchupGrace: tt.grace})
+				schedules, _ := st.ListSchedules("app")
+				sc = schedules[0]
+				if tt.lastRun != nil {
+					st.UpdateScheduleLastRun(sc.ID, *tt.lastRun)
+				}
+				got, _ := st.GetSchedule(sc.ID)
+				sc = *got
+			}
+
+			parsed, err := Parse(sc.CronSchedule, sc.Timezone)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			sch := New(context.Background(), st, nil, nil)
+			start := time.Now()
+			sch.catchUp(*s, sc, parsed)
+			sch.catchups.Wait()
+
+			history, _ := st.ListHistory("app", 10)
+			var details []string
+			for _, h := range history {
+				if h.Event == db.EventScheduleMissed {
+					details = append(details, h.Detail)
+				}
+			}
+			switch {
+			case tt.wantDetail == "" && len(details) > 0:
+				t.Errorf("got missed runs %q, want none", details)
+			case tt.wantDetail != "" && (len(details) != 1 || !strings.Contains(details[0], tt.wantDetail)):
+				t.Errorf("got missed runs %q, want one with %q", details, tt.wantDetail)
+			}
+
+			if _, err := os.Stat(marker); (err == nil) != tt.wantRun {
+				t.Errorf("ran = %v, want %v", err == nil, tt.wantRun)
+			}
+
+			var lastRun *time.Time
+			if tt.service {
+				s, _ := st.GetService("app")
+				lastRun = s.ScheduleLastRun
+			} else {
+				got, _ := st.GetSchedule(sc.ID)
+				lastRun = got.LastRun
+			}
+			if recorded := lastRun != nil && !lastRun.Before(start); recorded != tt.wantRecord {
+				t.Errorf("last run = %v, recorded now = %v, want %v", lastRun, recorded, tt.wantRecord)
+			}
+		})
+	}
+}
+
+func TestReloadDoesNotCatchUp(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "ran")
+	st := db.NewMemoryStore()
+	if err := st.AddService(db.Service{Name: "app", RestartCommand: "true", CheckCommand: "true", Enabled: true}); err != nil {
+		t.Fatalf("AddService: %v", err)
+	}
+	s, _ := st.GetService("app")
+	st.AddSchedule(db.Schedule{ServiceID: s.ID, Action: db.ActionCommand, Command: "touch " + marker,
+		CronSchedule: "@every 1h", Enabled: true, Catchup: db.CatchupOnce})
+	schedules, _ := st.ListSchedules("app")
+	st.UpdateScheduleLastRun(schedules[0].ID, time.Now().Add(-30*time.Minute))
+
+	sch := New(context.Background(), st, nil, nil)
+	sch.Start()
+	// As if runs were missed while the daemon was up, e.g. the clock jumped
+	st.UpdateScheduleLastRun(schedules[0].ID, time.Now().Add(-150*time.Minute))
+	sch.Reload()
+	sch.Stop()
+
+	history, _ := st.ListHistory("app", 10)
+	if len(history) > 0 {
+		t.Errorf("got history %+v after reloading, want none", history)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Errorf("the schedule ran on reload")
+	}
+}
+
+func TestRunRecordsOnlyWhatRan(t *testing.T) {
+	tests := []struct {
+		name     string
+		leader   bool
+		jitter   time.Duration
+		stopping bool // Stop was called during the jitter delay
+		wantRun  bool
+	}{
+		{name: "leader", leader: true, wantRun: true},
+		{name: "follower", leader: false},
+		{name: "stopped during jitter", leader: true, jitter: time.Hour, stopping: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			marker := filepath.Join(t.TempDir(), "ran")
+			st := db.NewMemoryStore()
+			if err := st.AddService(db.Service{Name: "app", RestartCommand: "true", CheckCommand: "true", Enabled: true}); err != nil {
+				t.Fatalf("AddService: %v", err)
+			}
+			s, _ := st.GetService("app")
+			st.AddSchedule(db.Schedule{ServiceID: s.ID, Action: db.ActionCommand, Command: "touch " + marker,
+				CronSchedule: "@every 1h", Jitter: tt.jitter, Enabled: true})
+			schedules, _ := st.ListSchedules("app")
+
+			sch := New(context.Background(), st, nil, func() bool { return tt.leader })
+			if tt.stopping {
+				close(sch.stopping)
+			}
+			sch.run(*s, schedules[0], lifecycle.NewEvent(lifecycle.TriggerScheduler))
+
+			if _, err := os.Stat(marker); (err == nil) != tt.wantRun {
+				t.Errorf("ran = %v, want %v", err == nil, tt.wantRun)
+			}
+			if got, _ := st.GetSchedule(schedules[0].ID); (got.LastRun != nil) != tt.wantRun {
+				t.Errorf("last run = %v, want one recorded: %v", got.LastRun, tt.wantRun)
+			}
+		})
+	}
+}
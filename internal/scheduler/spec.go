@@ -0,0 +1,60 @@
+package scheduler
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// parser accepts the standard 5 fields, an optional leading seconds field,
+// descriptors (@daily, @every 1h) and a CRON_TZ= prefix.
+var parser = cron.NewParser(
+	cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor,
+)
+
+// Parse validates spec and returns its schedule. A non-empty tz (IANA name,
+// e.g. "Europe/Berlin") makes the schedule run in that zone instead of the
+// daemon's local zone.
+func Parse(spec, tz string) (cron.Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, fmt.Errorf("empty schedule")
+	}
+
+	if tz != "" {
+		if strings.HasPrefix(spec, "TZ=") || strings.HasPrefix(spec, "CRON_TZ=") {
+			return nil, fmt.Errorf("schedule '%s' already sets a time zone", spec)
+		}
+		if _, err := time.LoadLocation(tz); err != nil {
+			return nil, fmt.Errorf("invalid time zone '%s': %v", tz, err)
+		}
+		spec = "CRON_TZ=" + tz + " " + spec
+	}
+
+	sched, err := parser.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule '%s': %v", spec, err)
+	}
+	return sched, nil
+}
+
+// NextRuns returns the next n activation times of spec after from.
+func NextRuns(spec, tz string, n int, from time.Time) ([]time.Time, error) {
+	sched, err := Parse(spec, tz)
+	if err != nil {
+		return nil, err
+	}
+
+	runs := make([]time.Time, 0, n)
+	t := from
+	for i := 0; i < n; i++ {
+		t = sched.Next(t)
+		if t.IsZero() {
+			break // Schedule never fires again
+		}
+		runs = append(runs, t)
+	}
+	return runs, nil
+}
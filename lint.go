@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"linux_service_manager/internal/db"
+	"linux_service_manager/internal/lifecycle"
+	"linux_service_manager/internal/logwatch"
+	"linux_service_manager/internal/runner"
+	"linux_service_manager/internal/scheduler"
+)
+
+type lintFinding struct {
+	service  string
+	field    string
+	severity string // "error" or "warning"
+	message  string
+}
+
+// serviceCommands lists a service's commands and hooks by flag name.
+func serviceCommands(s db.Service) [][2]string {
+	cmds := [][2]string{
+		{"restart", s.RestartCommand},
+		{"check", s.CheckCommand},
+		{"status", s.StatusCommand},
+		{"start", s.StartCommand},
+		{"stop", s.StopCommand},
+		{"on-verify-failed", s.OnVerifyFailed},
+		{"pre-restart", s.PreRestart},
+		{"post-restart", s.PostRestart},
+		{"on-failure", s.OnFailure},
+		{"on-recovery", s.OnRecovery},
+		{"log-command", s.LogCheck.Command},
+	}
+	for _, c := range s.Checks.Checks {
+		cmds = append(cmds, [2]string{"check " + c.Name, c.Command})
+	}
+	return cmds
+}
+
+func runLint(args []string) {
+	cmd := flag.NewFlagSet("lint", flag.ExitOnError)
+	name := cmd.String("name", "", "Only lint this service")
+	cmd.Parse(args)
+
+	var services []db.Service
+	if *name != "" {
+		svc, err := store.GetService(*name)
+		if err != nil {
+			log.Fatalf("Failed to get service '%s' (does it exist?): %v", *name, err)
+		}
+		services = []db.Service{*svc}
+	} else {
+		var err error
+		if services, err = store.ListServices(); err != nil {
+			log.Fatalf("Failed to list services: %v", err)
+		}
+	}
+	schedules, err := store.ListSchedules(*name)
+	if err != nil {
+		log.Fatalf("Failed to list schedules: %v", err)
+	}
+
+	var findings []lintFinding
+	for _, s := range services {
+		for _, c := range serviceCommands(s) {
+			if c[1] == "" {
+				continue
+			}
+			if err := runner.ValidateCommand(c[1]); err != nil {
+				findings = append(findings, lintFinding{s.Name, c[0], "error", err.Error()})
+			} else if _, ok := runner.ParseArgv(c[1]); !ok {
+				findings = append(findings, lintFinding{s.Name, c[0], "warning",
+					"shell mode command, consider an argv array (e.g. '[\"systemctl\", \"restart\", \"app\"]')"})
+			}
+		}
+
+		if err := runner.Service(s, "").Validate(); err != nil {
+			findings = append(findings, lintFinding{s.Name, "run settings", "error", err.Error()})
+		}
+		if err := logwatch.Validate(s.LogCheck); err != nil {
+			findings = append(findings, lintFinding{s.Name, "log check", "error", err.Error()})
+		}
+		if err := checkSettingsError(s); err != nil {
+			findings = append(findings, lintFinding{s.Name, "checks", "error", err.Error()})
+		}
+		if !lifecycle.HasCheck(s) {
+			findings = append(findings, lintFinding{s.Name, "checks", "warning",
+				"no check command, named checks or log check, the service always counts as healthy"})
+		}
+
+		if s.CronSchedule != "" {
+			if _, err := scheduler.Parse(s.CronSchedule, ""); err != nil {
+				findings = append(findings, lintFinding{s.Name, "schedule", "error", err.Error()})
+			}
+			if s.StatusCommand == "" {
+				findings = append(findings, lintFinding{s.Name, "status", "warning",
+					"scheduled restarts without a status command restart even a stopped service"})
+			}
+		}
+	}
+
+	for _, sc := range schedules {
+		field := fmt.Sprintf("schedule #%d", sc.ID)
+		if _, err := scheduler.Parse(sc.CronSchedule, sc.Timezone); err != nil {
+			findings = append(findings, lintFinding{sc.ServiceName, field, "error", err.Error()})
+		}
+		if sc.Command != "" {
+			if err := runner.ValidateCommand(sc.Command); err != nil {
+				findings = append(findings, lintFinding{sc.ServiceName, field, "error", err.Error()})
+			} else if _, ok := runner.ParseArgv(sc.Command); !ok {
+				findings = append(findings, lintFinding{sc.ServiceName, field, "warning", "shell mode command, consider an argv array"})
+			}
+		}
+	}
+
+	if len(findings) == 0 {
+		fmt.Println("No problems found.")
+		return
+	}
+
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 2, '\t', 0)
+	fmt.Fprintln(w, "Service\tField\tSeverity\tProblem")
+	for _, f := range findings {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", f.service, f.field, f.severity, f.message)
+	}
+	w.Flush()
+	os.Exit(1)
+}
@@ -4,6 +4,6 @@ set -e
 OUTPUT="lsm-linux"
 echo "Building Linux executable (Standard)..."
 # Native build (assuming running on Linux)
-go build -o "$OUTPUT" main.go
+go build -o "$OUTPUT" .
 
 echo "Success! Binary created at: $(pwd)/$OUTPUT"
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"linux_service_manager/internal/logger"
+	"linux_service_manager/internal/logwatch"
+)
+
+// backupTimeFormat is the timestamp lumberjack puts in the names of rotated logs.
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// runLogs prints the log lines of a service: its own log file if it has one,
+// otherwise the lines of the shared log whose service field names it.
+func runLogs(args []string) {
+	cmd := flag.NewFlagSet("logs", flag.ExitOnError)
+	name := cmd.String("name", "", "Service name")
+	follow := cmd.Bool("follow", false, "Keep printing new lines until interrupted")
+	cmd.BoolVar(follow, "f", false, "Shorthand for --follow")
+	since := cmd.Duration("since", 0, "Only show lines from this long ago (e.g. 1h), rotated logs included")
+	lines := cmd.Int("lines", 0, "Only show the last n lines (0 = all)")
+	shared := cmd.Bool("shared", false, "Read the shared log even if the service has its own")
+	cmd.Parse(args)
+
+	if *name == "" {
+		fmt.Println("Error: --name is required.")
+		os.Exit(1)
+	}
+
+	// Lines of a removed service may still be in the shared log
+	path, filter := logPath, true
+	if svc, err := store.GetService(*name); err != nil {
+		fmt.Fprintf(os.Stderr, "Service '%s' not found, searching the shared log.\n", *name)
+	} else if svc.OwnLog && !*shared {
+		own := logger.ServiceLogPath(logPath, *name)
+		if _, err := os.Stat(own); err == nil || *follow {
+			path, filter = own, false
+		} else {
+			fmt.Fprintf(os.Stderr, "%s does not exist yet, searching the shared log.\n", own)
+		}
+	}
+
+	var cutoff time.Time
+	if *since > 0 {
+		cutoff = time.Now().Add(-*since)
+	}
+	keep := func(line string) bool {
+		if !filter && cutoff.IsZero() {
+			return true
+		}
+		fields := logFields(line)
+		if filter && fields["service"] != *name {
+			return false
+		}
+		if !cutoff.IsZero() {
+			t, err := time.Parse(time.RFC3339Nano, fields["time"])
+			if err != nil || t.Before(cutoff) {
+				return false
+			}
+		}
+		return true
+	}
+
+	var out []string
+	collect := func(line string) {
+		if !keep(line) {
+			return
+		}
+		out = append(out, line)
+		if *lines > 0 && len(out) > *lines {
+			out = out[1:]
+		}
+	}
+
+	if !cutoff.IsZero() {
+		for _, backup := range rotatedLogs(path, cutoff) {
+			if _, err := readLogLines(backup, collect); err != nil {
+				fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", backup, err)
+			}
+		}
+	}
+	offset, err := readLogLines(path, collect)
+	if err != nil && !(*follow && os.IsNotExist(err)) {
+		fmt.Printf("Error: cannot read %s: %v\n", path, err)
+		os.Exit(1)
+	}
+	for _, line := range out {
+		fmt.Println(line)
+	}
+
+	if !*follow {
+		return
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	logwatch.Follow(ctx, path, offset, func(b []byte) {
+		if line := string(b); keep(line) {
+			fmt.Println(line)
+		}
+	}, func(err error) {
+		fmt.Fprintf(os.Stderr, "Waiting for %s: %v\n", path, err)
+	})
+}
+
+// readLogLines calls fn for each complete line of path, which may be gzipped,
+// and returns the number of bytes those lines take up.
+func readLogLines(path string, fn func(string)) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	br := bufio.NewReader(r)
+	var n int64
+	for {
+		line, err := br.ReadString('\n')
+		if err == io.EOF {
+			// A partial last line is left for --follow
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		n += int64(len(line))
+		fn(strings.TrimRight(line, "\r\n"))
+	}
+}
+
+// rotatedLogs returns the backups lumberjack made of path that were written
+// to after cutoff, oldest first.
+func rotatedLogs(path string, cutoff time.Time) []string {
+	ext := filepath.Ext(path)
+	prefix := strings.TrimSuffix(filepath.Base(path), ext) + "-"
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil
+	}
+	var backups []string
+	for _, e := range entries {
+		stamp, ok := strings.CutPrefix(e.Name(), prefix)
+		if !ok {
+			continue
+		}
+		stamp, ok = strings.CutSuffix(strings.TrimSuffix(stamp, ".gz"), ext)
+		if !ok {
+			continue
+		}
+		// Also tells api-2026-...log apart from the log of a service named api-v2
+		if _, err := time.Parse(backupTimeFormat, stamp); err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || info.ModTime().Before(cutoff) {
+			continue
+		}
+		backups = append(backups, filepath.Join(filepath.Dir(path), e.Name()))
+	}
+	sort.Strings(backups)
+	return backups
+}
+
+// logFields returns the top level fields of a log line in the text or JSON
+// format. Lines in neither format give no fields.
+func logFields(line string) map[string]string {
+	fields := map[string]string{}
+	if strings.HasPrefix(line, "{") {
+		var raw map[string]any
+		if json.Unmarshal([]byte(line), &raw) == nil {
+			for k, v := range raw {
+				if s, ok := v.(string); ok {
+					fields[k] = s
+				} else {
+					fields[k] = fmt.Sprint(v)
+				}
+			}
+		}
+		return fields
+	}
+
+	// key=value pairs, values quoted as Go strings when they need it
+	for rest := line; rest != ""; {
+		key, value, ok := strings.Cut(strings.TrimLeft(rest, " "), "=")
+		if !ok || key == "" || strings.ContainsAny(key, " \"") {
+			break
+		}
+		if strings.HasPrefix(value, `"`) {
+			quoted, err := strconv.QuotedPrefix(value)
+			if err != nil {
+				break
+			}
+			rest = value[len(quoted):]
+			value, _ = strconv.Unquote(quoted)
+		} else {
+			value, rest, _ = strings.Cut(value, " ")
+		}
+		fields[key] = value
+	}
+	return fields
+}
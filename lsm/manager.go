@@ -0,0 +1,404 @@
+// Package lsm embeds the LSM supervisor in a Go program. A Manager checks
+// services, restarts them when their checks fail and runs their schedules,
+// like 'lsm daemon', which is built on it:
+//
+//	m := lsm.New(lsm.Config{Store: lsm.NewMemoryStore()})
+//	m.AddService(lsm.Service{Name: "api", RestartCommand: "systemctl restart api", CheckCommand: "curl -fsS localhost:8080/health", Enabled: true})
+//	events, _ := m.Subscribe(lsm.EventRestarted, lsm.EventRestartFailed)
+//	m.Start(ctx)
+//	defer m.Stop()
+//
+// The Manager logs through the default slog logger.
+package lsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"linux_service_manager/internal/leader"
+	"linux_service_manager/internal/lifecycle"
+	"linux_service_manager/internal/logger"
+	"linux_service_manager/internal/logwatch"
+	"linux_service_manager/internal/monitor"
+	"linux_service_manager/internal/runner"
+	"linux_service_manager/internal/scheduler"
+	"sync"
+	"time"
+)
+
+// DefaultInterval is the time between checks if Config.Interval is 0
+const DefaultInterval = 10 * time.Second
+
+// DefaultDrainTimeout is how long Stop waits for actions in progress if
+// Config.DrainTimeout is 0
+const DefaultDrainTimeout = 60 * time.Second
+
+// subscriptionBuffer is how many events a subscriber can fall behind before
+// events are dropped for it.
+const subscriptionBuffer = 64
+
+// Config sets up a Manager.
+type Config struct {
+	Store     Store         // Where the services are, a new MemoryStore if nil
+	Interval  time.Duration // Between checks of each service, DefaultInterval if 0
+	Checkers  []Checker     // Run for every service besides its own checks, also to verify restarts
+	Notifiers []Notifier    // Told about every event
+
+	// DrainTimeout is how long stopping waits for checks, restarts and
+	// scheduled actions in progress before interrupting them,
+	// DefaultDrainTimeout if 0. Negative interrupts them right away.
+	DrainTimeout time.Duration
+
+	// Lease, if set, makes the Manager compete for it with the Managers of
+	// other hosts every Interval. Only the one holding it (the leader)
+	// restarts services and runs schedules; the others (followers) keep
+	// checking and only log. LeaderID names this Manager, host:pid if empty.
+	Lease    Lease
+	LeaderID string
+}
+
+// Event is something that happened to a service, as recorded in its history.
+type Event struct {
+	Service string
+	Kind    string // One of the Event constants
+	Detail  string
+	Time    time.Time
+}
+
+// Manager supervises the services of a Store.
+type Manager struct {
+	cfg   Config
+	store Store // cfg.Store, publishing the events it records
+
+	mu     sync.Mutex
+	cancel context.CancelFunc // Stops the running monitor, nil when stopped
+	done   chan struct{}      // Closed once the running monitor and scheduler stopped
+	mon    *monitor.Monitor
+	sched  *scheduler.Scheduler
+	elect  *leader.Elector // nil without a Lease
+
+	subMu sync.Mutex // Not mu, events are published while starting
+	subs  map[*subscription]bool
+}
+
+type subscription struct {
+	ch    chan Event
+	kinds map[string]bool // Empty means all
+}
+
+// New returns a stopped Manager.
+func New(cfg Config) *Manager {
+	if cfg.Store == nil {
+		cfg.Store = NewMemoryStore()
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.DrainTimeout == 0 {
+		cfg.DrainTimeout = DefaultDrainTimeout
+	}
+	if cfg.LeaderID == "" {
+		cfg.LeaderID = leader.DefaultID()
+	}
+	m := &Manager{cfg: cfg, subs: map[*subscription]bool{}}
+	m.store = eventStore{Store: cfg.Store, m: m}
+	return m
+}
+
+// Store returns the store of the services, to list, change or remove them.
+// Changes of schedules apply with the next Reload.
+func (m *Manager) Store() Store {
+	return m.store
+}
+
+// Start starts checking the services and running their schedules in the
+// background, until ctx is done or Stop is called. Either way the actions in
+// progress are drained like Stop does.
+func (m *Manager) Start(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cancel != nil {
+		return fmt.Errorf("already started")
+	}
+
+	// Actions outlive ctx until they are drained
+	work, interrupt := context.WithCancelCause(context.WithoutCancel(ctx))
+	ctx, cancel := context.WithCancel(ctx)
+	var elect *leader.Elector
+	var isLeader func() bool
+	if m.cfg.Lease != nil {
+		elect = leader.NewElector(m.cfg.Lease, m.cfg.LeaderID, m.cfg.Interval)
+		isLeader = elect.Leading
+		// Before the scheduler starts: only a daemon leading from the start
+		// catches up on the runs missed while it was down
+		elect.Attempt()
+	}
+	mon := monitor.New(work, m.store, m.cfg.Interval, isLeader, m.cfg.Checkers...)
+	sched := scheduler.New(work, m.store, mon, isLeader)
+	sched.Start()
+
+	// The lease is kept until the actions in progress are drained
+	electing, stopElecting := context.WithCancel(context.WithoutCancel(ctx))
+	elected := make(chan struct{})
+	if elect != nil {
+		go func() {
+			defer close(elected)
+			elect.Run(electing, func(leading bool) {
+				if leading {
+					sched.Promoted()
+				}
+			})
+		}()
+	} else {
+		close(elected)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mon.Run(ctx)
+		m.drain(sched, mon, interrupt)
+		stopElecting()
+		<-elected
+
+		// Without a Stop, ctx ended: the Manager can be started again
+		cancel()
+		m.mu.Lock()
+		if m.done == done {
+			m.cancel, m.done, m.mon, m.sched, m.elect = nil, nil, nil, nil, nil
+		}
+		m.mu.Unlock()
+	}()
+	m.cancel, m.done, m.mon, m.sched, m.elect = cancel, done, mon, sched, elect
+	return nil
+}
+
+// drain stops the scheduler and waits for the checks, restarts and scheduled
+// actions in progress, interrupting them after the drain timeout. Interrupted
+// restarts and actions are recorded in the history.
+func (m *Manager) drain(sched *scheduler.Scheduler, mon *monitor.Monitor, interrupt context.CancelCauseFunc) {
+	defer interrupt(nil)
+
+	drained := make(chan struct{})
+	go func() {
+		sched.Stop()
+		mon.Wait()
+		close(drained)
+	}()
+
+	timeout := max(m.cfg.DrainTimeout, 0)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-drained:
+	case <-timer.C:
+		logger.Component("shutdown").Warn("Drain timeout reached, interrupting actions in progress", "drain_timeout", timeout.String())
+		interrupt(fmt.Errorf("stopped after a drain timeout of %v", timeout))
+		<-drained
+	}
+}
+
+// Stop stops the Manager: no further checks or scheduled runs start, and the
+// ones in progress are given the drain timeout to finish before they are
+// interrupted. It returns once they ended. The Manager can be started again
+// afterwards.
+func (m *Manager) Stop() {
+	m.mu.Lock()
+	cancel, done := m.cancel, m.done
+	m.cancel, m.done, m.mon, m.sched, m.elect = nil, nil, nil, nil, nil
+	m.mu.Unlock()
+
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// Reload applies changes made to the store while the Manager runs: schedules
+// are loaded again and log checks start over. A store read from a file (see
+// OpenFile) reads it again first. Runs in progress are not interrupted.
+func (m *Manager) Reload() error {
+	if r, ok := m.cfg.Store.(interface{ Reload() error }); ok {
+		if err := r.Reload(); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cancel == nil {
+		return nil
+	}
+	m.sched.Reload()
+	m.mon.ReloadLogWatchers()
+	return nil
+}
+
+// AddService adds s to the store. Like 'lsm add', it needs a check: a
+// CheckCommand, Checks or a LogCheck. A running Manager checks it from the
+// next tick on; its CronSchedule starts with the next Reload.
+func (m *Manager) AddService(s Service) error {
+	if s.Name == "" || s.RestartCommand == "" {
+		return errors.New("name and restart command are required")
+	}
+	if !lifecycle.HasCheck(s) {
+		return errors.New("a check is required: a check command, named checks or a log check")
+	}
+	if s.CronSchedule != "" {
+		if _, err := scheduler.Parse(s.CronSchedule, ""); err != nil {
+			return err
+		}
+	}
+	if err := logwatch.Validate(s.LogCheck); err != nil {
+		return err
+	}
+	return m.store.AddService(s)
+}
+
+// Alive reports whether the Manager runs and its monitor loop keeps up with
+// its interval. The daemon pings the systemd watchdog only while it does.
+func (m *Manager) Alive() bool {
+	m.mu.Lock()
+	mon := m.mon
+	m.mu.Unlock()
+	if mon == nil {
+		return false
+	}
+	last := mon.LastTick()
+	return !last.IsZero() && time.Since(last) < 3*m.cfg.Interval
+}
+
+// State is a snapshot of a Manager.
+type State struct {
+	Time       time.Time
+	Running    bool
+	Role       string // "leader" or "follower" with a Lease, else ""
+	Leader     string // LeaderID of the Manager holding the Lease, "" if none or without a Lease
+	SmartPause bool   // Smart Pause is enabled...
+	UserActive bool   // ...and skips checks while a user is logged in
+	Services   []ServiceState
+	Commands   []RunningCommand
+	Schedule   []ScheduledJob
+}
+
+// ServiceState is what the monitor knows about a service.
+type ServiceState struct {
+	Name          string
+	Enabled       bool
+	Failing       bool // The last check failed
+	Busy          bool // A check or restart is in progress
+	LastChecked   *time.Time
+	LastRestarted *time.Time
+}
+
+// RunningCommand is a command in progress.
+type RunningCommand = runner.Running
+
+// ScheduledJob is a job of the scheduler and its next run.
+type ScheduledJob = scheduler.Entry
+
+// State returns a snapshot of the services, the commands in progress and the
+// next scheduled runs.
+func (m *Manager) State() (State, error) {
+	m.mu.Lock()
+	mon, sched, elect := m.mon, m.sched, m.elect
+	m.mu.Unlock()
+
+	st := State{Time: time.Now(), Running: mon != nil}
+	if elect != nil {
+		st.Role = elect.Role()
+	}
+	if m.cfg.Lease != nil {
+		holder, err := m.cfg.Lease.Holder()
+		if err != nil {
+			return st, err
+		}
+		st.Leader = holder
+	}
+	services, err := m.store.ListServices()
+	if err != nil {
+		return st, err
+	}
+	if st.SmartPause, err = m.store.GetPauseConfig(); err != nil {
+		return st, err
+	}
+	if st.SmartPause {
+		st.UserActive = monitor.IsUserActive()
+	}
+
+	for _, s := range services {
+		ss := ServiceState{Name: s.Name, Enabled: s.Enabled, LastChecked: s.LastChecked, LastRestarted: s.LastRestarted}
+		if mon != nil {
+			ss.Failing, ss.Busy = mon.State(s.ID)
+		}
+		st.Services = append(st.Services, ss)
+	}
+	st.Commands = runner.InProgress()
+	if sched != nil {
+		st.Schedule = sched.Entries()
+	}
+	return st, nil
+}
+
+// Subscribe returns a channel that receives the events of the given kinds, or
+// all events if none are given. Events are dropped for a subscriber that
+// falls behind. The returned function ends the subscription and closes the
+// channel.
+func (m *Manager) Subscribe(kinds ...string) (<-chan Event, func()) {
+	sub := &subscription{ch: make(chan Event, subscriptionBuffer), kinds: map[string]bool{}}
+	for _, k := range kinds {
+		sub.kinds[k] = true
+	}
+
+	m.subMu.Lock()
+	m.subs[sub] = true
+	m.subMu.Unlock()
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			m.subMu.Lock()
+			delete(m.subs, sub)
+			m.subMu.Unlock()
+			close(sub.ch)
+		})
+	}
+}
+
+// publish hands ev to the notifiers and subscribers.
+func (m *Manager) publish(ev Event) {
+	for _, n := range m.cfg.Notifiers {
+		n.Notify(ev)
+	}
+
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+	for sub := range m.subs {
+		if len(sub.kinds) > 0 && !sub.kinds[ev.Kind] {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+		}
+	}
+}
+
+// eventStore publishes the history events recorded through it.
+type eventStore struct {
+	Store
+	m *Manager
+}
+
+func (s eventStore) AddHistory(serviceName, event, detail string) error {
+	err := s.Store.AddHistory(serviceName, event, detail)
+	s.m.publish(Event{Service: serviceName, Kind: event, Detail: detail, Time: time.Now()})
+	return err
+}
+
+// Unwrap returns the store of the Config, e.g. for the scheduler to find the
+// database it backs up.
+func (s eventStore) Unwrap() Store {
+	return s.Store
+}
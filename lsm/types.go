@@ -0,0 +1,116 @@
+package lsm
+
+import (
+	"context"
+	"errors"
+	"linux_service_manager/internal/db"
+	"linux_service_manager/internal/leader"
+	"linux_service_manager/internal/monitor"
+	"time"
+)
+
+// The service configuration. The fields mean what the flags of 'lsm add' do.
+type (
+	Service       = db.Service
+	Schedule      = db.Schedule
+	Check         = db.Check
+	CheckSet      = db.CheckSet
+	Sandbox       = db.Sandbox
+	ResourceCheck = db.ResourceCheck
+	LogCheck      = db.LogCheck
+	HistoryEntry  = db.HistoryEntry
+)
+
+// Store is where a Manager keeps services, schedules, history and settings.
+type Store = db.Store
+
+// NewMemoryStore returns a Store that keeps everything in memory.
+func NewMemoryStore() Store {
+	return db.NewMemoryStore()
+}
+
+// OpenSQLite opens (and migrates) the LSM database at path, e.g. the one of
+// 'lsm daemon'.
+func OpenSQLite(path string) (Store, error) {
+	st, err := db.OpenSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// OpenFile returns a Store of the services declared in a JSON file, see 'lsm
+// --services'. The services are read-only; their run-time state, the history
+// and the settings are kept in state, which must be a Store of OpenSQLite.
+func OpenFile(path string, state Store) (Store, error) {
+	st, ok := state.(*db.SQLiteStore)
+	if !ok {
+		return nil, errors.New("the state of a file of services must be kept in an SQLite store")
+	}
+	return db.OpenFile(path, st)
+}
+
+// Lease elects the leader of Managers on several hosts, see Config.Lease.
+type Lease = leader.Lease
+
+// NewFileLock returns a Lease held with flock(2) on the file at path, which
+// must be on storage the hosts share (e.g. NFSv4). It is released when the
+// process holding it dies.
+func NewFileLock(path string) Lease {
+	return leader.NewFileLock(path)
+}
+
+// OpenSQLiteLease returns a Lease kept as a row of the SQLite database at path
+// on shared storage. The leader renews it every Config.Interval; ttl, which
+// must be a few intervals, is how long it stays valid when it doesn't.
+func OpenSQLiteLease(path string, ttl time.Duration) (Lease, error) {
+	return leader.OpenSQLiteLease(path, ttl)
+}
+
+// Roles in State.Role
+const (
+	RoleLeader   = leader.RoleLeader
+	RoleFollower = leader.RoleFollower
+)
+
+// Kinds of events, the events of 'lsm history'
+const (
+	EventScheduleMissed = db.EventScheduleMissed
+	EventRestarted      = db.EventRestarted
+	EventRestartFailed  = db.EventRestartFailed
+	EventVerifyFailed   = db.EventVerifyFailed
+	EventRestartVetoed  = db.EventRestartVetoed
+	EventFailing        = db.EventFailing
+	EventRecovered      = db.EventRecovered
+	EventResourceLimit  = db.EventResourceLimit
+	EventInterrupted    = db.EventInterrupted
+)
+
+// Checker is a check that runs for every service after its own checks passed,
+// also while verifying a restart. A non-nil error fails the service like a
+// failing check command; a checker passes the services it doesn't apply to.
+type Checker = monitor.Checker
+
+// CheckerFunc returns a Checker named name that calls fn.
+func CheckerFunc(name string, fn func(ctx context.Context, s Service) error) Checker {
+	return checkerFunc{name, fn}
+}
+
+type checkerFunc struct {
+	name string
+	fn   func(ctx context.Context, s Service) error
+}
+
+func (c checkerFunc) Name() string                               { return c.name }
+func (c checkerFunc) Check(ctx context.Context, s Service) error { return c.fn(ctx, s) }
+
+// Notifier is told about every event, in the goroutine that recorded it, so it
+// must not block for long.
+type Notifier interface {
+	Notify(ev Event)
+}
+
+// NotifierFunc makes a Notifier of a function.
+type NotifierFunc func(ev Event)
+
+func (f NotifierFunc) Notify(ev Event) { f(ev) }
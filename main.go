@@ -5,58 +5,98 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"os/signal"
-	"syscall"
+	"strings"
 	"time"
 
 	"linux_service_manager/internal/db"
+	"linux_service_manager/internal/leader"
+	"linux_service_manager/internal/lifecycle"
 	"linux_service_manager/internal/logger"
-	"linux_service_manager/internal/monitor"
-	"linux_service_manager/internal/scheduler"
+	"linux_service_manager/internal/logwatch"
+	"linux_service_manager/internal/runner"
 	"text/tabwriter"
 )
 
-const dbPath = "/var/lib/lsm/lsm.db"
-const logPath = "/var/log/lsm/lsm.log"
+// store holds the services, the database unless --services names a file.
+var store db.Store
+
+// database is the SQLite database the db commands work on, also with --services.
+var database *db.SQLiteStore
+
+// reloadHint tells how to apply a change of the schedules or settings to a running daemon.
+const reloadHint = "Reload the daemon to apply: sudo systemctl reload lsm (or send it SIGHUP)."
 
 func main() {
-	if len(os.Args) < 2 {
+	args := parseGlobalFlags(os.Args[1:])
+	if len(args) < 1 {
 		printUsage()
 		os.Exit(1)
 	}
 
-	command := os.Args[1]
+	command, args := args[0], args[1:]
 
-	// Commands that require root
-	if requiresRoot(command) {
+	// Commands that require root, unless they work on a user's own database
+	if requiresRoot(command) && !userMode && dbPath == systemDBPath {
 		if os.Geteuid() != 0 {
 			fmt.Println("Error: This command requires root privileges. Please run with sudo.")
 			os.Exit(1)
 		}
 	}
 
-	// Init DB for all commands
-	if err := db.InitDB(dbPath); err != nil {
+	// Init DB for all commands. Checking and restoring it must also work when
+	// it can't be migrated, and db migrate migrates it itself to report on it.
+	open := db.OpenSQLite
+	if command == "db" && len(args) > 0 && (args[0] == "check" || args[0] == "restore" || args[0] == "migrate") {
+		open = db.OpenSQLiteUnmigrated
+	}
+	var err error
+	if database, err = open(dbPath); err != nil {
 		log.Fatalf("Failed to init DB: %v", err)
 	}
+	store = database
+	if servicesPath != "" {
+		fileStore, err := db.OpenFile(servicesPath, database)
+		if err != nil {
+			log.Fatalf("Failed to load services: %v", err)
+		}
+		store = fileStore
+	}
 
 	switch command {
 	case "daemon":
-		runDaemon()
+		runDaemon(args)
 	case "add":
-		runAdd(os.Args[2:])
+		runAdd(args)
 	case "remove":
-		runRemove(os.Args[2:])
+		runRemove(args)
 	case "update":
-		runUpdate(os.Args[2:])
+		runUpdate(args)
 	case "list":
 		runList()
 	case "toggle":
-		runToggle(os.Args[2:])
+		runToggle(args)
+	case "silence":
+		runSilence(args)
+	case "top":
+		runTop(args)
 	case "config-log":
-		runConfigLog(os.Args[2:])
+		runConfigLog(args)
 	case "config-pause":
-		runConfigPause(os.Args[2:])
+		runConfigPause(args)
+	case "schedule":
+		runSchedule(args)
+	case "history":
+		runHistory(args)
+	case "check":
+		runCheck(args)
+	case "lint":
+		runLint(args)
+	case "stats":
+		runStats(args)
+	case "logs":
+		runLogs(args)
+	case "db":
+		runDB(args)
 	default:
 		printUsage()
 		os.Exit(1)
@@ -64,47 +104,97 @@ func main() {
 }
 
 func printUsage() {
-	fmt.Println("Usage: lsm <command> [args]")
+	fmt.Println("Usage: lsm [global flags] <command> [args]")
+	fmt.Println("Global Flags:")
+	fmt.Println("  --db <file>       Database (default /var/lib/lsm/lsm.db, env LSM_DB)")
+	fmt.Println("  --log <file>      Log file (default /var/log/lsm/lsm.log, env LSM_LOG)")
+	fmt.Println("  --config <file>   Config file with 'db = ...' and 'log = ...' lines (default /etc/lsm/lsm.conf)")
+	fmt.Println("  --user            Use ~/.local/share/lsm, ~/.local/state/lsm and ~/.config/lsm (XDG),")
+	fmt.Println("                    no root needed. For user-level services, e.g. 'systemctl --user'")
+	fmt.Println("  --services <file> Read services and schedules from this JSON file instead of the database")
+	fmt.Println("  --leader-lock <file>, --leader-db <file>")
+	fmt.Println("                    Active/passive daemons on several hosts: only the one holding a lock on this file,")
+	fmt.Println("                    or a lease in this SQLite database, on shared storage restarts and runs schedules")
 	fmt.Println("Commands:")
-	fmt.Println("  daemon                    Start the monitoring and scheduling daemon")
+	fmt.Println("  daemon [--drain-timeout <d>] [--state-file <file>]")
+	fmt.Println("                            Start the monitoring and scheduling daemon. On SIGTERM it waits")
+	fmt.Println("                            up to --drain-timeout (default 60s) for running actions.")
+	fmt.Println("                            SIGHUP reloads, SIGUSR1 dumps the state, SIGUSR2 reopens the logs")
 	fmt.Println("  add [flags]               Add a new service")
 	fmt.Println("  remove --name <name>      Remove a service")
 	fmt.Println("  update [flags]            Update an existing service")
 	fmt.Println("  list                      List all services")
 	fmt.Println("  toggle --name <service>   Toggle service monitoring (enable/disable)")
+	fmt.Println("  silence --name <service> --for <d>")
+	fmt.Println("                            Keep checking a service but don't restart it for a while (--for 0 ends it)")
+	fmt.Println("  top                       Live dashboard of the services and events, with keys to act on them")
 	fmt.Println("  config-log [flags]        Configure logging settings")
 	fmt.Println("  config-pause [flags]      Configure Smart Pause (active user detection)")
+	fmt.Println("  schedule <add|list|next|update|remove|toggle> [flags]")
+	fmt.Println("                            Manage scheduled actions (see 'lsm schedule')")
+	fmt.Println("  history [flags]           Show recorded events (--name <service>, --limit <n>)")
+	fmt.Println("  check <add|list|remove> [flags]")
+	fmt.Println("                            Manage a service's named checks (see 'lsm check')")
+	fmt.Println("  check --name <service>    Run a service's checks and show each result")
+	fmt.Println("  lint [--name <service>]   Report shell mode commands and invalid settings")
+	fmt.Println("  stats --name <service>    Show the resource usage of a service's process")
+	fmt.Println("  db <migrate|backup|restore|check|auto-backup> [flags]")
+	fmt.Println("                            Manage the database (see 'lsm db')")
+	fmt.Println("  logs --name <service>     Show a service's log lines (--follow, --since <duration>, --lines <n>)")
 	fmt.Println("\nAdd/Update Flags:")
 	fmt.Println("  --name      Service name (unique)")
+	fmt.Println("  Commands are run with 'sh -c', or directly if given as a JSON array: '[\"systemctl\", \"restart\", \"nginx\"]'")
 	fmt.Println("  --restart   Command to restart the service")
-	fmt.Println("  --check     Command to check health (exit != 0 means failed)")
+	fmt.Println("  --check     Command to check health (exit != 0 means failed). More checks: 'lsm check add'")
+	fmt.Println("  --check-mode    How the check and named checks combine: all (default), any, quorum")
+	fmt.Println("  --check-quorum  With quorum: total weight of passing checks needed")
 	fmt.Println("  --status    Command to check status (exit 0 means running). Used for safe scheduling.")
+	fmt.Println("  --start     Command to start the service. Used by scheduled 'start' actions.")
+	fmt.Println("  --stop      Command to stop the service. Used by scheduled 'stop' actions.")
 	fmt.Println("  --schedule  Cron schedule (e.g. '@daily', '0 0 * * *'). Leave empty for none.")
-}
-
-func runDaemon() {
-	// Init Logger
-	logger.Init(logPath)
-
-	// Start Scheduler
-	scheduler.Start()
-	defer scheduler.Stop()
-
-	// Start Monitor Loop
-	// Run in goroutine? RunLoop blocks.
-	// But we need to handle signals.
-
-	go monitor.RunLoop(10 * time.Second) // Check every 10s
-
-	log.Println("LSM Daemon started. Press Ctrl+C to exit.")
-
-	// Wait for signal
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	<-sigs
-
-	monitor.Stop()
-	log.Println("Shutting down...")
+	fmt.Println("              An optional leading seconds field and a 'CRON_TZ=<zone>' prefix are accepted.")
+	fmt.Println("              Runs missed while the daemon was down are always skipped and there is no")
+	fmt.Println("              jitter; use 'lsm schedule add' for --catchup or --jitter.")
+	fmt.Println("  --verify-delay      Settle time before re-checking after a restart (default 5s)")
+	fmt.Println("  --verify-timeout    Deadline for the check to pass again after a restart (default 30s, 0 disables)")
+	fmt.Println("  --on-verify-failed  Command run if the check does not pass again (rollback, escalation)")
+	fmt.Println("  --timeout           Timeout for each command and hook of the service (default 5m)")
+	fmt.Println("  --own-log           Also log the service's lines, at every level, to services/<name>.log")
+	fmt.Println("                      next to the main log (update: --own-log=false to stop)")
+	fmt.Println("\nIdentity Flags (add/update, pass \"\" to clear):")
+	fmt.Println("  --run-as-user   Run commands and hooks as this user instead of root")
+	fmt.Println("  --run-as-group  Primary group (default: the user's primary group)")
+	fmt.Println("  --groups        Comma separated supplementary groups")
+	fmt.Println("  --workdir       Working directory (default: the user's home)")
+	fmt.Println("  --env           KEY=VALUE environment variable, repeatable")
+	fmt.Println("  --env-file      File with KEY=VALUE lines, read on every run")
+	fmt.Println("  --umask         Umask for commands (octal, e.g. 027)")
+	fmt.Println("\nSandbox Flags (add/update, pass 0/\"\"/false to clear):")
+	fmt.Println("  --limit-cpu, --limit-memory, --limit-nofile, --limit-nproc")
+	fmt.Println("                  Resource limits: CPU seconds, address space MB, open files, processes")
+	fmt.Println("  --nice          Nice value (-20..19)")
+	fmt.Println("  --io-class      I/O class: realtime, best-effort, idle (--io-priority 0..7)")
+	fmt.Println("  --private-tmp   Run commands with a private, empty /tmp")
+	fmt.Println("  --no-new-privs  Prevent privilege gain through setuid binaries")
+	fmt.Println("  --cgroup-memory, --cgroup-cpu")
+	fmt.Println("                  Run in a transient cgroup v2 with memory.max (MB) and a CPU cap (percent)")
+	fmt.Println("\nResource Flags (add/update, pass 0/\"\" to clear):")
+	fmt.Println("  --resource-target  Process to sample: pidfile:<path>, systemd:<unit> or name:<process>")
+	fmt.Println("  --max-rss, --max-cpu, --max-fds, --max-threads, --max-uptime")
+	fmt.Println("                     Restart when RSS (MB), CPU (%), open fds, threads or uptime exceed the limit...")
+	fmt.Println("  --resource-for     ...for at least this long (e.g. 5m)")
+	fmt.Println("\nLog Check Flags (add/update, pass 0/\"\" to clear):")
+	fmt.Println("  --log-file      Follow this log file (across rotation)...")
+	fmt.Println("  --log-command   ...or the output of a long-running command (e.g. 'journalctl -f -u app')")
+	fmt.Println("  --log-pattern   Fail the check when this regexp matches --log-count times (default 1)...")
+	fmt.Println("  --log-window    ...within this window (default: since the last restart)")
+	fmt.Println("  --log-stall     Fail the check if no lines arrive for this long")
+	fmt.Println("\nHook Flags (add/update, pass \"\" to clear):")
+	fmt.Println("  --pre-restart   Run before a restart. A non-zero exit vetoes the restart.")
+	fmt.Println("  --post-restart  Run after a successful restart")
+	fmt.Println("  --on-failure    Run when the check starts failing")
+	fmt.Println("  --on-recovery   Run when the check passes again after failing")
+	fmt.Println("  Hooks get LSM_SERVICE, LSM_HOOK, LSM_TRIGGER and LSM_EXIT_CODE in their environment.")
 }
 
 func runAdd(args []string) {
@@ -113,38 +203,101 @@ func runAdd(args []string) {
 	restart := addCmd.String("restart", "", "Restart command")
 	check := addCmd.String("check", "", "Check command")
 	status := addCmd.String("status", "", "Status command")
+	start := addCmd.String("start", "", "Start command")
+	stop := addCmd.String("stop", "", "Stop command")
 	schedule := addCmd.String("schedule", "", "Cron schedule")
+	verifyDelay := addCmd.Duration("verify-delay", 5*time.Second, "Settle time before verifying a restart")
+	verifyTimeout := addCmd.Duration("verify-timeout", 30*time.Second, "Deadline for the check to pass after a restart (0 disables)")
+	onVerifyFailed := addCmd.String("on-verify-failed", "", "Command run when restart verification fails")
+	timeout := addCmd.Duration("timeout", runner.DefaultTimeout, "Timeout for each command and hook")
+	preRestart := addCmd.String("pre-restart", "", "Hook run before a restart (non-zero exit vetoes it)")
+	postRestart := addCmd.String("post-restart", "", "Hook run after a successful restart")
+	onFailure := addCmd.String("on-failure", "", "Hook run when the check starts failing")
+	onRecovery := addCmd.String("on-recovery", "", "Hook run when the check passes again")
+	runAsUser := addCmd.String("run-as-user", "", "Run commands as this user")
+	runAsGroup := addCmd.String("run-as-group", "", "Primary group (default: the user's)")
+	groups := addCmd.String("groups", "", "Comma separated supplementary groups")
+	workDir := addCmd.String("workdir", "", "Working directory for commands")
+	var env stringList
+	addCmd.Var(&env, "env", "Environment variable KEY=VALUE (repeatable)")
+	envFile := addCmd.String("env-file", "", "File with KEY=VALUE lines")
+	umask := addCmd.String("umask", "", "Umask for commands (octal, e.g. 027)")
+	sandbox := newSandboxFlags(addCmd)
+	resources := newResourceFlags(addCmd)
+	logCheck := newLogCheckFlags(addCmd)
+	checkMode := addCmd.String("check-mode", db.CheckModeAll, "How checks combine: all, any, quorum")
+	checkQuorum := addCmd.Int("check-quorum", 0, "Weight of passing checks needed with --check-mode quorum")
+	ownLog := addCmd.Bool("own-log", false, "Also log the service's lines to a file of its own")
 	// enabled by default
 
 	addCmd.Parse(args)
 
-	if *name == "" || *restart == "" || *check == "" {
-		fmt.Println("Error: name, restart, and check are required.")
+	if *name == "" || *restart == "" {
+		fmt.Println("Error: name and restart are required.")
 		addCmd.PrintDefaults()
 		os.Exit(1)
 	}
+	if *schedule != "" {
+		validateSchedule(*schedule, "")
+	}
 
 	svc := db.Service{
 		Name:           *name,
 		RestartCommand: *restart,
 		CheckCommand:   *check,
 		StatusCommand:  *status,
+		StartCommand:   *start,
+		StopCommand:    *stop,
 		CronSchedule:   *schedule,
+		VerifyDelay:    *verifyDelay,
+		VerifyTimeout:  *verifyTimeout,
+		OnVerifyFailed: *onVerifyFailed,
+		CommandTimeout: *timeout,
+		PreRestart:     *preRestart,
+		PostRestart:    *postRestart,
+		OnFailure:      *onFailure,
+		OnRecovery:     *onRecovery,
+		RunAsUser:      *runAsUser,
+		RunAsGroup:     *runAsGroup,
+		Groups:         splitList(*groups),
+		WorkDir:        *workDir,
+		Env:            env,
+		EnvFile:        *envFile,
+		Umask:          *umask,
+		Checks:         db.CheckSet{Mode: *checkMode, Quorum: *checkQuorum},
+		OwnLog:         *ownLog,
 		Enabled:        true,
 	}
+	sandbox.apply(&svc.Sandbox)
+	resources.apply(&svc.Resources)
+	logCheck.apply(&svc.LogCheck)
+	if !lifecycle.HasCheck(svc) {
+		fmt.Println("Error: a check is required: --check, or a log check (--log-file or --log-command).")
+		fmt.Println("Named checks can be added with 'lsm check add' once the service exists.")
+		os.Exit(1)
+	}
+	validateCommands(svc)
+	validateIdentity(svc)
+	validateChecks(svc)
+	validateResources(svc.Resources)
 
-	if err := db.AddService(svc); err != nil {
+	if err := store.AddService(svc); err != nil {
 		log.Fatalf("Failed to add service: %v", err)
 	}
-	fmt.Printf("Service '%s' added successfully.\n", *name)
+	fmt.Printf("Service '%s' added successfully. The daemon checks it from the next tick on.\n", *name)
+	if svc.CronSchedule != "" || svc.LogCheck != (db.LogCheck{}) {
+		fmt.Println("For its schedule and log check: " + reloadHint)
+	}
 }
 
 func runList() {
-	services, err := db.ListServices()
+	services, err := store.ListServices()
 	if err != nil {
 		log.Fatalf("Failed to list services: %v", err)
 	}
 
+	printLeader()
+
 	w := new(tabwriter.Writer)
 	w.Init(os.Stdout, 0, 8, 2, '\t', 0)
 	fmt.Fprintln(w, "ID\tName\tSchedule\tEnabled\tLast Checked\tLast Restarted")
@@ -166,6 +319,61 @@ func runList() {
 	w.Flush()
 }
 
+// printLeader shows which daemon is the leader, if there is an election.
+func printLeader() {
+	if status, ok := leaderStatus(); ok {
+		fmt.Printf("Leader: %s\n\n", status)
+	}
+}
+
+// leaderStatus describes which daemon is the leader and whether this host's
+// is, false if there is no election.
+func leaderStatus() (string, bool) {
+	lease, err := openLease()
+	if err != nil {
+		log.Fatalf("Failed to open leader lease: %v", err)
+	}
+	if lease == nil {
+		return "", false
+	}
+	defer lease.Close()
+
+	holder, err := lease.Holder()
+	if err != nil {
+		log.Fatalf("Failed to read leader lease: %v", err)
+	}
+	switch {
+	case holder == "":
+		return "none (no daemon holds the lease)", true
+	case leader.OnThisHost(holder):
+		return holder + " (this host, role leader)", true
+	}
+	return holder + " (another host, this one is a follower)", true
+}
+
+func runHistory(args []string) {
+	cmd := flag.NewFlagSet("history", flag.ExitOnError)
+	name := cmd.String("name", "", "Only show events of this service")
+	limit := cmd.Int("limit", 50, "Number of events to show")
+	cmd.Parse(args)
+
+	entries, err := store.ListHistory(*name, *limit)
+	if err != nil {
+		log.Fatalf("Failed to list history: %v", err)
+	}
+
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 2, '\t', 0)
+	fmt.Fprintln(w, "Time\tService\tEvent\tDetail")
+
+	// Oldest first, like a log
+	for i := len(entries) - 1; i >= 0; i-- {
+		h := entries[i]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", h.CreatedAt.Format(time.RFC3339), h.ServiceName, h.Event, h.Detail)
+	}
+	w.Flush()
+}
+
 func runToggle(args []string) {
 	toggleCmd := flag.NewFlagSet("toggle", flag.ExitOnError)
 	name := toggleCmd.String("name", "", "Service name")
@@ -177,19 +385,51 @@ func runToggle(args []string) {
 		os.Exit(1)
 	}
 
-	svc, err := db.GetService(*name)
+	svc, err := store.GetService(*name)
 	if err != nil {
 		log.Fatalf("Failed to get service: %v", err)
 	}
 
 	newState := !svc.Enabled
-	if err := db.ToggleService(*name, newState); err != nil {
+	if err := store.ToggleService(*name, newState); err != nil {
 		log.Fatalf("Failed to toggle service: %v", err)
 	}
 
 	fmt.Printf("Service '%s' enabled set to %t.\n", *name, newState)
 }
 
+func runSilence(args []string) {
+	cmd := flag.NewFlagSet("silence", flag.ExitOnError)
+	name := cmd.String("name", "", "Service name")
+	duration := cmd.Duration("for", time.Hour, "How long, 0 ends the silence")
+	cmd.Parse(args)
+
+	if *name == "" {
+		fmt.Println("Error: --name is required.")
+		os.Exit(1)
+	}
+	if *duration < 0 {
+		fmt.Println("Error: --for must not be negative.")
+		os.Exit(1)
+	}
+	if _, err := store.GetService(*name); err != nil {
+		log.Fatalf("Failed to get service: %v", err)
+	}
+
+	if *duration == 0 {
+		if err := store.SilenceService(*name, nil); err != nil {
+			log.Fatalf("Failed to silence service: %v", err)
+		}
+		fmt.Printf("Service '%s' is no longer silenced.\n", *name)
+		return
+	}
+	until := time.Now().Add(*duration)
+	if err := store.SilenceService(*name, &until); err != nil {
+		log.Fatalf("Failed to silence service: %v", err)
+	}
+	fmt.Printf("Service '%s' silenced until %s: checked, but not restarted.\n", *name, until.Format(time.RFC3339))
+}
+
 func runRemove(args []string) {
 	cmd := flag.NewFlagSet("remove", flag.ExitOnError)
 	name := cmd.String("name", "", "Service name")
@@ -200,10 +440,10 @@ func runRemove(args []string) {
 		os.Exit(1)
 	}
 
-	if err := db.RemoveService(*name); err != nil {
+	if err := store.RemoveService(*name); err != nil {
 		log.Fatalf("Failed to remove service: %v", err)
 	}
-	fmt.Printf("Service '%s' removed. (Restart daemon to fully apply changes if running)\n", *name)
+	fmt.Printf("Service '%s' removed. It is no longer checked; to drop its schedules too: %s\n", *name, reloadHint)
 }
 
 func runUpdate(args []string) {
@@ -212,7 +452,31 @@ func runUpdate(args []string) {
 	restart := cmd.String("restart", "", "Restart command")
 	check := cmd.String("check", "", "Check command")
 	status := cmd.String("status", "", "Status command")
+	start := cmd.String("start", "", "Start command")
+	stop := cmd.String("stop", "", "Stop command")
 	schedule := cmd.String("schedule", "", "Cron schedule")
+	verifyDelay := cmd.Duration("verify-delay", 0, "Settle time before verifying a restart")
+	verifyTimeout := cmd.Duration("verify-timeout", 0, "Deadline for the check to pass after a restart (0 disables)")
+	onVerifyFailed := cmd.String("on-verify-failed", "", "Command run when restart verification fails")
+	timeout := cmd.Duration("timeout", 0, "Timeout for each command and hook")
+	preRestart := cmd.String("pre-restart", "", "Hook run before a restart (non-zero exit vetoes it)")
+	postRestart := cmd.String("post-restart", "", "Hook run after a successful restart")
+	onFailure := cmd.String("on-failure", "", "Hook run when the check starts failing")
+	onRecovery := cmd.String("on-recovery", "", "Hook run when the check passes again")
+	runAsUser := cmd.String("run-as-user", "", "Run commands as this user")
+	runAsGroup := cmd.String("run-as-group", "", "Primary group (default: the user's)")
+	groups := cmd.String("groups", "", "Comma separated supplementary groups")
+	workDir := cmd.String("workdir", "", "Working directory for commands")
+	var env stringList
+	cmd.Var(&env, "env", "Environment variable KEY=VALUE (repeatable, replaces the current list)")
+	envFile := cmd.String("env-file", "", "File with KEY=VALUE lines")
+	umask := cmd.String("umask", "", "Umask for commands (octal, e.g. 027)")
+	sandbox := newSandboxFlags(cmd)
+	resources := newResourceFlags(cmd)
+	logCheck := newLogCheckFlags(cmd)
+	checkMode := cmd.String("check-mode", "", "How checks combine: all, any, quorum")
+	checkQuorum := cmd.Int("check-quorum", 0, "Weight of passing checks needed with --check-mode quorum")
+	ownLog := cmd.Bool("own-log", false, "Also log the service's lines to a file of its own (--own-log=false to stop)")
 	// enabled := cmd.Bool("enabled", true, "Enabled") // Hard to handle optional bool with flags, skipping for now. Use toggle.
 
 	cmd.Parse(args)
@@ -223,7 +487,7 @@ func runUpdate(args []string) {
 	}
 
 	// Fetch existing to mix/match
-	existing, err := db.GetService(*name)
+	existing, err := store.GetService(*name)
 	if err != nil {
 		log.Fatalf("Failed to get service '%s' (does it exist?): %v", *name, err)
 	}
@@ -231,32 +495,267 @@ func runUpdate(args []string) {
 	if *restart != "" {
 		existing.RestartCommand = *restart
 	}
-	if *check != "" {
+	// The check command may be cleared when named checks take over
+	if isFlagSet(cmd, "check") {
 		existing.CheckCommand = *check
 	}
 	if *status != "" {
 		existing.StatusCommand = *status
 	}
+	if *start != "" {
+		existing.StartCommand = *start
+	}
+	if *stop != "" {
+		existing.StopCommand = *stop
+	}
 	// Schedule can be empty string, so we need a way to know if user passed it.
-	// flag.Visit is a good way but for simplicity let's assume if it is explicitly passed as "" it clears it.
-	// But default is "".
-	// Let's assume user must pass -schedule="" to clear it? No, default is empty.
-	// We'll trust user passed what they want if they passed the flag.
-	// Actually, checking if flag was set is safer.
-	isScheduleSet := false
-	cmd.Visit(func(f *flag.Flag) {
-		if f.Name == "schedule" {
-			isScheduleSet = true
+	// Same for the verification settings, where 0 and "" are meaningful.
+	if isFlagSet(cmd, "schedule") {
+		if *schedule != "" {
+			validateSchedule(*schedule, "")
 		}
-	})
-	if isScheduleSet {
 		existing.CronSchedule = *schedule
 	}
+	if isFlagSet(cmd, "verify-delay") {
+		existing.VerifyDelay = *verifyDelay
+	}
+	if isFlagSet(cmd, "verify-timeout") {
+		existing.VerifyTimeout = *verifyTimeout
+	}
+	if isFlagSet(cmd, "on-verify-failed") {
+		existing.OnVerifyFailed = *onVerifyFailed
+	}
+	if *timeout > 0 {
+		existing.CommandTimeout = *timeout
+	}
+	// Hooks are cleared by passing an empty string
+	if isFlagSet(cmd, "pre-restart") {
+		existing.PreRestart = *preRestart
+	}
+	if isFlagSet(cmd, "post-restart") {
+		existing.PostRestart = *postRestart
+	}
+	if isFlagSet(cmd, "on-failure") {
+		existing.OnFailure = *onFailure
+	}
+	if isFlagSet(cmd, "on-recovery") {
+		existing.OnRecovery = *onRecovery
+	}
+	// Identity settings are cleared by passing an empty string
+	if isFlagSet(cmd, "run-as-user") {
+		existing.RunAsUser = *runAsUser
+	}
+	if isFlagSet(cmd, "run-as-group") {
+		existing.RunAsGroup = *runAsGroup
+	}
+	if isFlagSet(cmd, "groups") {
+		existing.Groups = splitList(*groups)
+	}
+	if isFlagSet(cmd, "workdir") {
+		existing.WorkDir = *workDir
+	}
+	if isFlagSet(cmd, "env") {
+		existing.Env = env
+	}
+	if isFlagSet(cmd, "env-file") {
+		existing.EnvFile = *envFile
+	}
+	if isFlagSet(cmd, "umask") {
+		existing.Umask = *umask
+	}
+	sandbox.apply(&existing.Sandbox)
+	resources.apply(&existing.Resources)
+	logCheck.apply(&existing.LogCheck)
+	if isFlagSet(cmd, "check-mode") {
+		existing.Checks.Mode = *checkMode
+	}
+	if isFlagSet(cmd, "check-quorum") {
+		existing.Checks.Quorum = *checkQuorum
+	}
+	if isFlagSet(cmd, "own-log") {
+		existing.OwnLog = *ownLog
+	}
+	validateCommands(*existing)
+	validateIdentity(*existing)
+	validateChecks(*existing)
+	warnUnchecked(*existing)
+	validateResources(existing.Resources)
 
-	if err := db.UpdateService(*existing); err != nil {
+	if err := store.UpdateService(*existing); err != nil {
 		log.Fatalf("Failed to update service: %v", err)
 	}
-	fmt.Printf("Service '%s' updated. (Restart daemon to apply changes)\n", *name)
+	fmt.Printf("Service '%s' updated. Commands and checks apply at the next check; for schedule and log check changes: %s\n", *name, reloadHint)
+}
+
+// stringList is a repeatable string flag. Empty values are dropped, so
+// passing --flag "" once yields an empty list.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ", ") }
+
+func (l *stringList) Set(v string) error {
+	if v != "" {
+		*l = append(*l, v)
+	}
+	return nil
+}
+
+// splitList splits a comma separated flag value
+func splitList(v string) []string {
+	var parts []string
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+// sandboxFlags are the sandbox settings shared by add and update.
+type sandboxFlags struct {
+	fs                      *flag.FlagSet
+	limitCPU, limitMemory   *int
+	limitNoFile, limitNProc *int
+	nice, ioPriority        *int
+	ioClass                 *string
+	privateTmp, noNewPrivs  *bool
+	cgroupMemory, cgroupCPU *int
+}
+
+func newSandboxFlags(fs *flag.FlagSet) *sandboxFlags {
+	return &sandboxFlags{
+		fs:           fs,
+		limitCPU:     fs.Int("limit-cpu", 0, "CPU time limit in seconds (0 = none)"),
+		limitMemory:  fs.Int("limit-memory", 0, "Address space limit in MB (0 = none)"),
+		limitNoFile:  fs.Int("limit-nofile", 0, "Open files limit (0 = none)"),
+		limitNProc:   fs.Int("limit-nproc", 0, "Process limit of the command's user (0 = none)"),
+		nice:         fs.Int("nice", 0, "Nice value, -20..19"),
+		ioClass:      fs.String("io-class", "", "I/O scheduling class: realtime, best-effort, idle"),
+		ioPriority:   fs.Int("io-priority", 4, "I/O priority 0..7 (realtime, best-effort)"),
+		privateTmp:   fs.Bool("private-tmp", false, "Give commands a private, empty /tmp"),
+		noNewPrivs:   fs.Bool("no-new-privs", false, "Prevent privilege gain through setuid binaries"),
+		cgroupMemory: fs.Int("cgroup-memory", 0, "memory.max of a transient cgroup in MB (0 = none)"),
+		cgroupCPU:    fs.Int("cgroup-cpu", 0, "CPU cap of a transient cgroup in percent, 100 = one CPU (0 = none)"),
+	}
+}
+
+// apply copies the sandbox flags that were passed on the command line into sb.
+func (f *sandboxFlags) apply(sb *db.Sandbox) {
+	ints := map[string]struct {
+		dst *int
+		val *int
+	}{
+		"limit-cpu":     {&sb.LimitCPU, f.limitCPU},
+		"limit-memory":  {&sb.LimitMemory, f.limitMemory},
+		"limit-nofile":  {&sb.LimitNoFile, f.limitNoFile},
+		"limit-nproc":   {&sb.LimitNProc, f.limitNProc},
+		"nice":          {&sb.Nice, f.nice},
+		"cgroup-memory": {&sb.CgroupMemoryMax, f.cgroupMemory},
+		"cgroup-cpu":    {&sb.CgroupCPUPercent, f.cgroupCPU},
+	}
+	for name, v := range ints {
+		if isFlagSet(f.fs, name) {
+			*v.dst = *v.val
+		}
+	}
+
+	if isFlagSet(f.fs, "io-class") || isFlagSet(f.fs, "io-priority") {
+		if isFlagSet(f.fs, "io-class") {
+			sb.IOClass = *f.ioClass
+		}
+		sb.IOPriority = *f.ioPriority
+	}
+	if isFlagSet(f.fs, "private-tmp") {
+		sb.PrivateTmp = *f.privateTmp
+	}
+	if isFlagSet(f.fs, "no-new-privs") {
+		sb.NoNewPrivs = *f.noNewPrivs
+	}
+}
+
+// logCheckFlags are the log check settings shared by add and update.
+type logCheckFlags struct {
+	fs            *flag.FlagSet
+	file, command *string
+	pattern       *string
+	count         *int
+	window, stall *time.Duration
+}
+
+func newLogCheckFlags(fs *flag.FlagSet) *logCheckFlags {
+	return &logCheckFlags{
+		fs:      fs,
+		file:    fs.String("log-file", "", "Log file to follow (rotation is followed)"),
+		command: fs.String("log-command", "", "Long-running command whose output is followed, e.g. 'journalctl -f -u app'"),
+		pattern: fs.String("log-pattern", "", "Regexp that marks a log line as a failure"),
+		count:   fs.Int("log-count", 1, "Matches needed within --log-window to fail the check"),
+		window:  fs.Duration("log-window", 0, "Window for --log-count (0 = since the last restart)"),
+		stall:   fs.Duration("log-stall", 0, "Fail the check if no lines arrive for this long (0 = disabled)"),
+	}
+}
+
+// apply copies the log check flags that were passed on the command line into lc.
+func (f *logCheckFlags) apply(lc *db.LogCheck) {
+	if isFlagSet(f.fs, "log-file") {
+		lc.File = *f.file
+	}
+	if isFlagSet(f.fs, "log-command") {
+		lc.Command = *f.command
+	}
+	if isFlagSet(f.fs, "log-pattern") {
+		lc.Pattern = *f.pattern
+	}
+	if isFlagSet(f.fs, "log-count") {
+		lc.Count = *f.count
+	}
+	if isFlagSet(f.fs, "log-window") {
+		lc.Window = *f.window
+	}
+	if isFlagSet(f.fs, "log-stall") {
+		lc.Stall = *f.stall
+	}
+}
+
+// validateCommands exits with an error if one of the service's commands is a
+// mistyped argv array.
+func validateCommands(s db.Service) {
+	for _, c := range serviceCommands(s) {
+		if err := runner.ValidateCommand(c[1]); err != nil {
+			fmt.Printf("Error: %s command: %v\n", c[0], err)
+			os.Exit(1)
+		}
+	}
+}
+
+// validateIdentity exits with an error if the service's user, groups, umask,
+// environment, sandbox or log check settings are unusable.
+func validateIdentity(s db.Service) {
+	for _, kv := range s.Env {
+		if k, _, ok := strings.Cut(kv, "="); !ok || k == "" {
+			fmt.Printf("Error: invalid --env '%s' (expected KEY=VALUE).\n", kv)
+			os.Exit(1)
+		}
+	}
+	if err := runner.Service(s, "").Validate(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := logwatch.Validate(s.LogCheck); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// isFlagSet reports whether the flag was passed on the command line, as opposed to
+// holding its default value.
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
 
 func runConfigLog(args []string) {
@@ -265,10 +764,32 @@ func runConfigLog(args []string) {
 	maxBackups := cmd.Int("max-backups", 0, "Max number of old log files")
 	maxAge := cmd.Int("max-age", 0, "Max age in days")
 	compress := cmd.Bool("compress", true, "Compress old log files")
+	level := cmd.String("level", "", "Log level: debug, info, warn, error")
+	format := cmd.String("format", "", "Log format: text, json")
+	sinks := cmd.String("sinks", "", "Comma separated log sinks: file, stdout, stderr, syslog, journald")
+	syslogAddr := cmd.String("syslog-addr", "", "Unix socket of the syslog daemon (default: system default, e.g. /dev/log)")
 
 	cmd.Parse(args)
 
-	existing, err := db.GetLogConfig()
+	for _, sink := range splitList(*sinks) {
+		if !logger.ValidSink(sink) {
+			fmt.Printf("Error: invalid log sink '%s' (expected file, stdout, stderr, syslog or journald).\n", sink)
+			os.Exit(1)
+		}
+	}
+
+	if *level != "" {
+		if _, err := logger.ParseLevel(*level); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if !logger.ValidFormat(*format) {
+		fmt.Printf("Error: invalid log format '%s' (expected text or json).\n", *format)
+		os.Exit(1)
+	}
+
+	existing, err := store.GetLogConfig()
 	if err != nil {
 		// Ignore err, start fresh
 		existing = &db.LogConfig{}
@@ -286,14 +807,26 @@ func runConfigLog(args []string) {
 	// compress is bool, tricky if user wants false but default is true.
 	// But flags default is true here. If user passes --compress=false it works.
 	existing.Compress = *compress
+	if *level != "" {
+		existing.Level = *level
+	}
+	if *format != "" {
+		existing.Format = *format
+	}
+	if *sinks != "" {
+		existing.Sinks = splitList(*sinks)
+	}
+	if isFlagSet(cmd, "syslog-addr") {
+		existing.SyslogAddr = *syslogAddr
+	}
 
-	if err := db.SetLogConfig(*existing); err != nil {
+	if err := store.SetLogConfig(*existing); err != nil {
 		log.Fatalf("Failed to update log config: %v", err)
 	}
-	if err := db.SetLogConfig(*existing); err != nil {
+	if err := store.SetLogConfig(*existing); err != nil {
 		log.Fatalf("Failed to update log config: %v", err)
 	}
-	fmt.Println("Log configuration updated. Restart daemon to apply.")
+	fmt.Println("Log configuration updated. " + reloadHint)
 }
 
 func runConfigPause(args []string) {
@@ -305,15 +838,15 @@ func runConfigPause(args []string) {
 	cmd.Parse(args)
 
 	// We just blindly set what user requests.
-	if err := db.SetPauseConfig(*enable); err != nil {
+	if err := store.SetPauseConfig(*enable); err != nil {
 		log.Fatalf("Failed to update pause config: %v", err)
 	}
-	fmt.Printf("Smart Pause configuration updated (Enabled: %t). Restart daemon to apply.\n", *enable)
+	fmt.Printf("Smart Pause configuration updated (Enabled: %t). The daemon applies it at the next check.\n", *enable)
 }
 
 func requiresRoot(cmd string) bool {
 	switch cmd {
-	case "daemon", "add", "remove", "update", "toggle", "config-log", "config-pause":
+	case "daemon", "add", "remove", "update", "toggle", "silence", "top", "config-log", "config-pause", "schedule", "check", "db":
 		return true
 	case "list":
 		// List might be allowed if DB is readable, but /var/lib/lsm might be root only.
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"linux_service_manager/internal/db"
+	"linux_service_manager/internal/runner"
+	"linux_service_manager/internal/scheduler"
+)
+
+func printScheduleUsage() {
+	fmt.Println("Usage: lsm schedule <subcommand> [flags]")
+	fmt.Println("Subcommands:")
+	fmt.Println("  add [flags]               Add a scheduled action to a service")
+	fmt.Println("  list [--name <service>]   List scheduled actions")
+	fmt.Println("  next --name <service>     Preview the next run times of a service's schedules")
+	fmt.Println("  update --id <id> [flags]  Change a scheduled action, keeping its last run if the timing stays")
+	fmt.Println("  remove --id <id>          Remove a scheduled action")
+	fmt.Println("  toggle --id <id>          Enable/disable a scheduled action")
+	fmt.Println("\nAdd Flags:")
+	fmt.Println("  --name      Service name")
+	fmt.Println("  --action    One of: restart, stop, start, command, check")
+	fmt.Println("  --cron      Cron schedule (e.g. '@daily', '0 3 * * *')")
+	fmt.Println("  --command   Command to run (only for --action command)")
+	fmt.Println("  --tz        Time zone to run in (e.g. 'Europe/Berlin'). Default: daemon's local zone")
+	fmt.Println("  --jitter    Random delay added to each run (e.g. '5m') to spread restarts across hosts")
+	fmt.Println("  --catchup   Runs missed while the daemon was down: skip (default), once, grace")
+	fmt.Println("  --grace     With --catchup grace: run if the missed run was due within this window (e.g. '2h')")
+	fmt.Println("\nUpdate takes the same flags except --name; only those given are changed.")
+	fmt.Println("\nSchedules take 5 fields, or 6 with a leading seconds field (e.g. '30 0 3 * * *').")
+}
+
+func runSchedule(args []string) {
+	if len(args) < 1 {
+		printScheduleUsage()
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "add":
+		runScheduleAdd(args[1:])
+	case "list":
+		runScheduleList(args[1:])
+	case "next":
+		runScheduleNext(args[1:])
+	case "update":
+		runScheduleUpdate(args[1:])
+	case "remove":
+		runScheduleRemove(args[1:])
+	case "toggle":
+		runScheduleToggle(args[1:])
+	default:
+		printScheduleUsage()
+		os.Exit(1)
+	}
+}
+
+func runScheduleAdd(args []string) {
+	cmd := flag.NewFlagSet("schedule add", flag.ExitOnError)
+	name := cmd.String("name", "", "Service name")
+	action := cmd.String("action", db.ActionRestart, "Action: restart, stop, start, command, check")
+	cron := cmd.String("cron", "", "Cron schedule")
+	command := cmd.String("command", "", "Command to run (action 'command' only)")
+	tz := cmd.String("tz", "", "Time zone (IANA name)")
+	jitter := cmd.Duration("jitter", 0, "Random delay added to each run")
+	catchup := cmd.String("catchup", db.CatchupSkip, "Missed run policy: skip, once, grace")
+	grace := cmd.Duration("grace", 0, "Grace window for --catchup grace")
+
+	cmd.Parse(args)
+
+	if *name == "" || *cron == "" {
+		fmt.Println("Error: --name and --cron are required.")
+		cmd.PrintDefaults()
+		os.Exit(1)
+	}
+
+	svc, err := store.GetService(*name)
+	if err != nil {
+		log.Fatalf("Failed to get service '%s' (does it exist?): %v", *name, err)
+	}
+
+	sc := db.Schedule{
+		ServiceID:    svc.ID,
+		Action:       *action,
+		Command:      *command,
+		CronSchedule: *cron,
+		Timezone:     *tz,
+		Jitter:       jitter.Round(time.Second),
+		Catchup:      *catchup,
+		CatchupGrace: grace.Round(time.Second),
+		Enabled:      true,
+	}
+	validateScheduleSettings(sc, *svc)
+	if err := store.AddSchedule(sc); err != nil {
+		log.Fatalf("Failed to add schedule: %v", err)
+	}
+	fmt.Printf("Scheduled %s for '%s' at '%s'. %s\n", *action, *name, *cron, reloadHint)
+	printNextRuns(*cron, *tz, 3)
+}
+
+func runScheduleUpdate(args []string) {
+	cmd := flag.NewFlagSet("schedule update", flag.ExitOnError)
+	id := cmd.Int("id", 0, "Schedule ID (see 'lsm schedule list')")
+	action := cmd.String("action", "", "Action: restart, stop, start, command, check")
+	cron := cmd.String("cron", "", "Cron schedule")
+	command := cmd.String("command", "", "Command to run (action 'command' only)")
+	tz := cmd.String("tz", "", "Time zone (IANA name)")
+	jitter := cmd.Duration("jitter", 0, "Random delay added to each run")
+	catchup := cmd.String("catchup", "", "Missed run policy: skip, once, grace")
+	grace := cmd.Duration("grace", 0, "Grace window for --catchup grace")
+
+	cmd.Parse(args)
+
+	if *id == 0 {
+		fmt.Println("Error: --id is required.")
+		os.Exit(1)
+	}
+
+	sc, err := store.GetSchedule(*id)
+	if err != nil {
+		log.Fatalf("Failed to get schedule #%d (does it exist?): %v", *id, err)
+	}
+	svc, err := store.GetService(sc.ServiceName)
+	if err != nil {
+		log.Fatalf("Failed to get service '%s': %v", sc.ServiceName, err)
+	}
+	old := *sc
+
+	if isFlagSet(cmd, "action") {
+		sc.Action = *action
+		if *action != db.ActionCommand && !isFlagSet(cmd, "command") {
+			sc.Command = ""
+		}
+	}
+	if isFlagSet(cmd, "cron") {
+		sc.CronSchedule = *cron
+	}
+	if isFlagSet(cmd, "command") {
+		sc.Command = *command
+	}
+	if isFlagSet(cmd, "tz") {
+		sc.Timezone = *tz
+	}
+	if isFlagSet(cmd, "jitter") {
+		sc.Jitter = jitter.Round(time.Second)
+	}
+	if isFlagSet(cmd, "catchup") {
+		sc.Catchup = *catchup
+		if *catchup != db.CatchupGrace {
+			sc.CatchupGrace = 0
+		}
+	}
+	if isFlagSet(cmd, "grace") {
+		sc.CatchupGrace = grace.Round(time.Second)
+	}
+	validateScheduleSettings(*sc, *svc)
+
+	if err := store.UpdateSchedule(*sc); err != nil {
+		log.Fatalf("Failed to update schedule: %v", err)
+	}
+	kept := "its last run is kept"
+	if !sc.SameTiming(old) {
+		kept = "missed runs count from now on"
+	}
+	fmt.Printf("Schedule #%d updated, %s. %s\n", *id, kept, reloadHint)
+	printNextRuns(sc.CronSchedule, sc.Timezone, 3)
+}
+
+func runScheduleList(args []string) {
+	cmd := flag.NewFlagSet("schedule list", flag.ExitOnError)
+	name := cmd.String("name", "", "Only list schedules of this service")
+	cmd.Parse(args)
+
+	schedules, err := store.ListSchedules(*name)
+	if err != nil {
+		log.Fatalf("Failed to list schedules: %v", err)
+	}
+
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 2, '\t', 0)
+	fmt.Fprintln(w, "ID\tService\tAction\tSchedule\tTZ\tJitter\tCatch-up\tEnabled\tLast Run\tCommand")
+
+	for _, sc := range schedules {
+		command := sc.Command
+		if command == "" {
+			command = "-"
+		}
+		tz := sc.Timezone
+		if tz == "" {
+			tz = "-"
+		}
+		jitter := "-"
+		if sc.Jitter > 0 {
+			jitter = sc.Jitter.String()
+		}
+		catchup := sc.Catchup
+		if sc.Catchup == db.CatchupGrace {
+			catchup = fmt.Sprintf("%s (%v)", sc.Catchup, sc.CatchupGrace)
+		}
+		lastRun := "-"
+		if sc.LastRun != nil {
+			lastRun = sc.LastRun.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%t\t%s\t%s\n",
+			sc.ID, sc.ServiceName, sc.Action, sc.CronSchedule, tz, jitter, catchup, sc.Enabled, lastRun, command,
+		)
+	}
+	w.Flush()
+}
+
+func runScheduleRemove(args []string) {
+	cmd := flag.NewFlagSet("schedule remove", flag.ExitOnError)
+	id := cmd.Int("id", 0, "Schedule ID (see 'lsm schedule list')")
+	cmd.Parse(args)
+
+	if *id == 0 {
+		fmt.Println("Error: --id is required.")
+		os.Exit(1)
+	}
+
+	if _, err := store.GetSchedule(*id); err != nil {
+		log.Fatalf("Failed to get schedule #%d (does it exist?): %v", *id, err)
+	}
+	if err := store.RemoveSchedule(*id); err != nil {
+		log.Fatalf("Failed to remove schedule: %v", err)
+	}
+	fmt.Printf("Schedule #%d removed. %s\n", *id, reloadHint)
+}
+
+func runScheduleToggle(args []string) {
+	cmd := flag.NewFlagSet("schedule toggle", flag.ExitOnError)
+	id := cmd.Int("id", 0, "Schedule ID (see 'lsm schedule list')")
+	cmd.Parse(args)
+
+	if *id == 0 {
+		fmt.Println("Error: --id is required.")
+		os.Exit(1)
+	}
+
+	sc, err := store.GetSchedule(*id)
+	if err != nil {
+		log.Fatalf("Failed to get schedule #%d (does it exist?): %v", *id, err)
+	}
+
+	newState := !sc.Enabled
+	if err := store.ToggleSchedule(*id, newState); err != nil {
+		log.Fatalf("Failed to toggle schedule: %v", err)
+	}
+	fmt.Printf("Schedule #%d enabled set to %t. %s\n", *id, newState, reloadHint)
+}
+
+func runScheduleNext(args []string) {
+	cmd := flag.NewFlagSet("schedule next", flag.ExitOnError)
+	name := cmd.String("name", "", "Service name")
+	count := cmd.Int("count", 5, "Number of run times to show per schedule")
+	cmd.Parse(args)
+
+	if *name == "" {
+		fmt.Println("Error: --name is required.")
+		os.Exit(1)
+	}
+	if *count < 1 {
+		fmt.Println("Error: --count must be at least 1.")
+		os.Exit(1)
+	}
+
+	svc, err := store.GetService(*name)
+	if err != nil {
+		log.Fatalf("Failed to get service '%s' (does it exist?): %v", *name, err)
+	}
+	schedules, err := store.ListSchedules(*name)
+	if err != nil {
+		log.Fatalf("Failed to list schedules: %v", err)
+	}
+
+	if svc.CronSchedule == "" && len(schedules) == 0 {
+		fmt.Printf("Service '%s' has no schedules.\n", *name)
+		return
+	}
+
+	if svc.CronSchedule != "" {
+		fmt.Printf("restart (service schedule '%s'):\n", svc.CronSchedule)
+		printNextRuns(svc.CronSchedule, "", *count)
+	}
+	for _, sc := range schedules {
+		state := ""
+		if !sc.Enabled {
+			state = ", disabled"
+		}
+		fmt.Printf("%s #%d ('%s'%s):\n", sc.Action, sc.ID, sc.CronSchedule, state)
+		printNextRuns(sc.CronSchedule, sc.Timezone, *count)
+		if sc.Jitter > 0 {
+			fmt.Printf("  (each run delayed by up to %v)\n", sc.Jitter)
+		}
+	}
+}
+
+// validateScheduleSettings exits with an error if sc is not a valid schedule
+// of svc, e.g. an action svc has no command for.
+func validateScheduleSettings(sc db.Schedule, svc db.Service) {
+	if !db.ValidAction(sc.Action) {
+		fmt.Printf("Error: unknown action '%s'.\n", sc.Action)
+		os.Exit(1)
+	}
+	if sc.Jitter < 0 {
+		fmt.Println("Error: --jitter must not be negative.")
+		os.Exit(1)
+	}
+	if !db.ValidCatchup(sc.Catchup) {
+		fmt.Printf("Error: unknown catch-up policy '%s'.\n", sc.Catchup)
+		os.Exit(1)
+	}
+	if sc.Catchup == db.CatchupGrace && sc.CatchupGrace <= 0 {
+		fmt.Println("Error: --grace is required for --catchup grace.")
+		os.Exit(1)
+	}
+	validateSchedule(sc.CronSchedule, sc.Timezone)
+
+	// Make sure the action has something to run
+	switch sc.Action {
+	case db.ActionCommand:
+		if sc.Command == "" {
+			fmt.Println("Error: --command is required for action 'command'.")
+			os.Exit(1)
+		}
+	case db.ActionStart:
+		if svc.StartCommand == "" {
+			fmt.Printf("Error: service '%s' has no start command. Set one with 'lsm update --name %s --start ...'.\n", svc.Name, svc.Name)
+			os.Exit(1)
+		}
+	case db.ActionStop:
+		if svc.StopCommand == "" {
+			fmt.Printf("Error: service '%s' has no stop command. Set one with 'lsm update --name %s --stop ...'.\n", svc.Name, svc.Name)
+			os.Exit(1)
+		}
+	}
+	if sc.Command != "" && sc.Action != db.ActionCommand {
+		fmt.Println("Error: --command is only used with action 'command'.")
+		os.Exit(1)
+	}
+	if err := runner.ValidateCommand(sc.Command); err != nil {
+		fmt.Printf("Error: --command: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// validateSchedule exits with an error if spec is not a valid cron schedule.
+func validateSchedule(spec, tz string) {
+	if _, err := scheduler.Parse(spec, tz); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func printNextRuns(spec, tz string, n int) {
+	runs, err := scheduler.NextRuns(spec, tz, n, time.Now())
+	if err != nil {
+		fmt.Printf("  Error: %v\n", err)
+		return
+	}
+	if len(runs) == 0 {
+		fmt.Println("  (never runs)")
+	}
+	for _, t := range runs {
+		fmt.Printf("  %s\n", t.Format(time.RFC3339))
+	}
+}
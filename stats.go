@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"linux_service_manager/internal/db"
+	"linux_service_manager/internal/monitor"
+	"linux_service_manager/internal/procstat"
+)
+
+// resourceFlags are the resource check settings shared by add and update.
+type resourceFlags struct {
+	fs                  *flag.FlagSet
+	target              *string
+	maxRSS, maxFDs      *int
+	maxThreads          *int
+	maxCPU              *float64
+	maxUptime, duration *time.Duration
+}
+
+func newResourceFlags(fs *flag.FlagSet) *resourceFlags {
+	return &resourceFlags{
+		fs:         fs,
+		target:     fs.String("resource-target", "", "Process to sample: pidfile:<path>, systemd:<unit> or name:<process>"),
+		maxRSS:     fs.Int("max-rss", 0, "Restart when RSS exceeds this many MB (0 = no limit)"),
+		maxCPU:     fs.Float64("max-cpu", 0, "Restart when CPU usage exceeds this percentage, 100 = one CPU (0 = no limit)"),
+		maxFDs:     fs.Int("max-fds", 0, "Restart when open fds exceed this (0 = no limit)"),
+		maxThreads: fs.Int("max-threads", 0, "Restart when the thread count exceeds this (0 = no limit)"),
+		maxUptime:  fs.Duration("max-uptime", 0, "Restart when the process is older than this (0 = no limit)"),
+		duration:   fs.Duration("resource-for", 0, "How long a limit must be exceeded before restarting"),
+	}
+}
+
+// apply copies the resource flags that were passed on the command line into rc.
+func (f *resourceFlags) apply(rc *db.ResourceCheck) {
+	if isFlagSet(f.fs, "resource-target") {
+		rc.Target = *f.target
+	}
+	if isFlagSet(f.fs, "max-rss") {
+		rc.MaxRSS = *f.maxRSS
+	}
+	if isFlagSet(f.fs, "max-cpu") {
+		rc.MaxCPU = *f.maxCPU
+	}
+	if isFlagSet(f.fs, "max-fds") {
+		rc.MaxFDs = *f.maxFDs
+	}
+	if isFlagSet(f.fs, "max-threads") {
+		rc.MaxThreads = *f.maxThreads
+	}
+	if isFlagSet(f.fs, "max-uptime") {
+		rc.MaxUptime = *f.maxUptime
+	}
+	if isFlagSet(f.fs, "resource-for") {
+		rc.For = *f.duration
+	}
+}
+
+// validateResources exits with an error if the resource check settings are unusable.
+func validateResources(rc db.ResourceCheck) {
+	if rc.Target == "" {
+		if rc != (db.ResourceCheck{}) {
+			fmt.Println("Error: resource limits need --resource-target.")
+			os.Exit(1)
+		}
+		return
+	}
+	if err := procstat.ValidTarget(rc.Target); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if rc.MaxRSS < 0 || rc.MaxCPU < 0 || rc.MaxFDs < 0 || rc.MaxThreads < 0 || rc.MaxUptime < 0 || rc.For < 0 {
+		fmt.Println("Error: resource limits must not be negative.")
+		os.Exit(1)
+	}
+}
+
+// runStats samples a service's process, the same way the monitor does.
+func runStats(args []string) {
+	cmd := flag.NewFlagSet("stats", flag.ExitOnError)
+	name := cmd.String("name", "", "Service name")
+	cmd.Parse(args)
+
+	if *name == "" {
+		fmt.Println("Error: --name is required.")
+		os.Exit(1)
+	}
+
+	svc, err := store.GetService(*name)
+	if err != nil {
+		log.Fatalf("Failed to get service '%s' (does it exist?): %v", *name, err)
+	}
+	rc := svc.Resources
+	if rc.Target == "" {
+		fmt.Printf("Service '%s' has no --resource-target.\n", *name)
+		os.Exit(1)
+	}
+
+	pid, err := procstat.FindPID(rc.Target)
+	if err != nil {
+		log.Fatalf("Failed to find process (%s): %v", rc.Target, err)
+	}
+	// Two samples a second apart for the CPU usage
+	first, err := procstat.Read(pid)
+	if err != nil {
+		log.Fatalf("Failed to read process %d: %v", pid, err)
+	}
+	time.Sleep(time.Second)
+	sample, err := procstat.Read(pid)
+	if err != nil {
+		log.Fatalf("Failed to read process %d: %v", pid, err)
+	}
+	cpu := sample.CPUPercent(first)
+
+	fmt.Printf("Target:  %s (pid %d)\n", rc.Target, pid)
+	fmt.Printf("RSS:     %d MB\n", sample.RSS>>20)
+	fmt.Printf("CPU:     %.1f%%\n", cpu)
+	fmt.Printf("FDs:     %d\n", sample.FDs)
+	fmt.Printf("Threads: %d\n", sample.Threads)
+	fmt.Printf("Uptime:  %v\n", sample.Uptime.Round(time.Second))
+	if status, ok := leaderStatus(); ok {
+		fmt.Printf("Leader:  %s\n", status)
+	}
+
+	if breaches := monitor.Breaches(rc, sample, cpu); len(breaches) > 0 {
+		fmt.Printf("Exceeded: %s (restart after %v)\n", strings.Join(breaches, ", "), rc.For)
+	} else {
+		fmt.Println("Within limits.")
+	}
+}
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"linux_service_manager/internal/db"
+	"linux_service_manager/internal/leader"
+	"linux_service_manager/internal/lifecycle"
+	"linux_service_manager/internal/monitor"
+	"linux_service_manager/internal/scheduler"
+
+	"golang.org/x/sys/unix"
+)
+
+// silenceFor is how long the s key of lsm top silences a service
+const silenceFor = time.Hour
+
+// Terminal control sequences
+const (
+	altScreen   = "\x1b[?1049h\x1b[?25l" // Switch to the alternate screen, hide the cursor
+	mainScreen  = "\x1b[?25h\x1b[?1049l"
+	home        = "\x1b[H"
+	clearLine   = "\x1b[K"
+	clearBelow  = "\x1b[J"
+	bold        = "\x1b[1m"
+	dim         = "\x1b[2m"
+	red         = "\x1b[31m"
+	green       = "\x1b[32m"
+	yellow      = "\x1b[33m"
+	reverse     = "\x1b[7m"
+	resetColors = "\x1b[0m"
+)
+
+// topRow is a service as lsm top shows it.
+type topRow struct {
+	db.Service
+	Restarts int       // In the last 24h
+	Next     time.Time // Next scheduled run, zero if none
+	NextWhat string    // Action of the next run
+}
+
+// topView is what lsm top reads from the store every second.
+type topView struct {
+	Time       time.Time
+	Rows       []topRow
+	Events     []db.HistoryEntry // Newest first
+	SmartPause bool
+	UserActive bool
+	Leader     string // Holder of the leader lease, with --leader-lock or --leader-db
+	Err        error
+}
+
+// actionResult is the outcome of a key press, shown in the message line.
+type actionResult struct {
+	service string
+	message string
+}
+
+// runTop shows the services and the latest events, refreshed every second,
+// until q is pressed. It reads what the daemon records in the store, and acts
+// on the selected service itself.
+func runTop(args []string) {
+	cmd := flag.NewFlagSet("top", flag.ExitOnError)
+	events := cmd.Int("events", 100, "Number of events to read for the feed")
+	cmd.Parse(args)
+
+	in, out := int(os.Stdin.Fd()), int(os.Stdout.Fd())
+	saved, err := unix.IoctlGetTermios(in, unix.TCGETS)
+	if err != nil {
+		fmt.Println("Error: lsm top needs a terminal.")
+		os.Exit(1)
+	}
+	raw := *saved
+	raw.Lflag &^= unix.ECHO | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Iflag &^= unix.IXON | unix.ICRNL
+	raw.Cc[unix.VMIN], raw.Cc[unix.VTIME] = 1, 0
+	if err := unix.IoctlSetTermios(in, unix.TCSETS, &raw); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Print(altScreen)
+	defer func() {
+		fmt.Print(mainScreen)
+		unix.IoctlSetTermios(in, unix.TCSETS, saved)
+	}()
+
+	// Log lines would garble the screen. What the actions do shows up in the
+	// event feed, which is their history.
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	keys := make(chan string)
+	go readKeys(os.Stdin, keys)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGWINCH)
+
+	ctx, interrupt := context.WithCancel(context.Background())
+	defer interrupt()
+	var actions sync.WaitGroup
+	results := make(chan actionResult)
+	busy := map[string]string{} // Actions in progress by service
+	act := func(s db.Service, what string, fn func() string) {
+		busy[s.Name] = what
+		actions.Add(1)
+		go func() {
+			defer actions.Done()
+			results <- actionResult{s.Name, fn()}
+		}()
+	}
+	// stop interrupts the actions in progress and waits for them
+	stop := func() {
+		interrupt()
+		drained := make(chan struct{})
+		go func() {
+			defer close(drained)
+			for range results {
+			}
+		}()
+		actions.Wait()
+		close(results)
+		<-drained
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	view := loadTop(*events)
+	selected, message, confirm, quitting := "", "", "", false
+	for {
+		width, height := 80, 24
+		if ws, err := unix.IoctlGetWinsize(out, unix.TIOCGWINSZ); err == nil && ws.Col > 0 {
+			width, height = int(ws.Col), int(ws.Row)
+		}
+		selected = keepSelection(view.Rows, selected)
+		prompt := message
+		if confirm != "" {
+			prompt = fmt.Sprintf("Restart %s? (y/n)", confirm)
+		}
+		fmt.Print(renderTop(view, selected, busy, prompt, width, height))
+
+		if quitting && len(busy) == 0 {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+			view = loadTop(*events)
+		case sig := <-sigs:
+			if sig != syscall.SIGWINCH {
+				stop()
+				return
+			}
+		case r := <-results:
+			delete(busy, r.service)
+			message = r.message
+			view = loadTop(*events)
+		case key := <-keys:
+			row, ok := findRow(view.Rows, selected)
+			if confirm != "" {
+				if key == "y" && ok && row.Name == confirm {
+					act(row.Service, "restarting", func() string { return topRestart(ctx, row.Service) })
+					message = ""
+				}
+				confirm = ""
+				continue
+			}
+			switch key {
+			case "q", "ctrl-c":
+				if quitting || len(busy) == 0 {
+					// Again: interrupt what is still running
+					stop()
+					return
+				}
+				quitting = true
+				message = fmt.Sprintf("Waiting for %d action(s), press q again to interrupt them", len(busy))
+			case "up", "k":
+				selected = moveSelection(view.Rows, selected, -1)
+			case "down", "j":
+				selected = moveSelection(view.Rows, selected, 1)
+			case "c", "r", "t", "s":
+				if !ok {
+					continue
+				}
+				if what, running := busy[row.Name]; running {
+					message = fmt.Sprintf("%s: still %s", row.Name, what)
+					continue
+				}
+				switch key {
+				case "c":
+					act(row.Service, "checking", func() string { return topCheck(ctx, row.Service) })
+				case "r":
+					if refused := topNotLeader(row.Service); refused != "" {
+						message = refused
+						continue
+					}
+					confirm = row.Name
+				case "t":
+					message = topToggle(row.Service)
+					view = loadTop(*events)
+				case "s":
+					message = topSilence(row.Service)
+					view = loadTop(*events)
+				}
+			}
+		}
+	}
+}
+
+// readKeys sends the keys read from r, with arrows as "up" and "down". Keys
+// typed quickly arrive in one read.
+func readKeys(r io.Reader, keys chan<- string) {
+	arrows := map[string]string{"\x1b[A": "up", "\x1bOA": "up", "\x1b[B": "down", "\x1bOB": "down"}
+	buf := make([]byte, 64)
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			return
+		}
+		for in := string(buf[:n]); in != ""; {
+			if len(in) >= 3 && arrows[in[:3]] != "" {
+				keys <- arrows[in[:3]]
+				in = in[3:]
+				continue
+			}
+			if in[0] == '\x1b' {
+				// Another escape sequence, e.g. a function key
+				break
+			}
+			if in[0] == 0x03 {
+				keys <- "ctrl-c"
+			} else {
+				keys <- strings.ToLower(in[:1])
+			}
+			in = in[1:]
+		}
+	}
+}
+
+// loadTop reads the services, their schedules and the latest events.
+func loadTop(events int) topView {
+	v := topView{Time: time.Now()}
+	services, err := store.ListServices()
+	if err != nil {
+		v.Err = err
+		return v
+	}
+	schedules, err := store.ListSchedules("")
+	if err != nil {
+		v.Err = err
+		return v
+	}
+	if v.Events, err = store.ListHistory("", events); err != nil {
+		v.Err = err
+		return v
+	}
+	if v.SmartPause, err = store.GetPauseConfig(); err != nil {
+		v.Err = err
+		return v
+	}
+	if v.SmartPause {
+		v.UserActive = monitor.IsUserActive()
+	}
+	if lease, err := openLease(); err == nil && lease != nil {
+		v.Leader, _ = lease.Holder()
+		lease.Close()
+	}
+
+	for _, s := range services {
+		row := topRow{Service: s}
+		row.Restarts, _ = store.CountHistory(s.Name, db.EventRestarted, v.Time.Add(-24*time.Hour))
+		if s.Enabled && s.CronSchedule != "" {
+			row.nextRun(s.CronSchedule, "", db.ActionRestart, v.Time)
+		}
+		for _, sc := range schedules {
+			if s.Enabled && sc.Enabled && sc.ServiceID == s.ID {
+				row.nextRun(sc.CronSchedule, sc.Timezone, sc.Action, v.Time)
+			}
+		}
+		v.Rows = append(v.Rows, row)
+	}
+	return v
+}
+
+// nextRun keeps the run of spec after now if it is the next of the row.
+func (r *topRow) nextRun(spec, tz, action string, now time.Time) {
+	parsed, err := scheduler.Parse(spec, tz)
+	if err != nil {
+		return
+	}
+	if next := parsed.Next(now); !next.IsZero() && (r.Next.IsZero() || next.Before(r.Next)) {
+		r.Next, r.NextWhat = next, action
+	}
+}
+
+// renderTop draws the screen: a summary line, the services, the event feed
+// and the key bindings.
+func renderTop(v topView, selected string, busy map[string]string, message string, width, height int) string {
+	var b strings.Builder
+	line := func(color, text string) {
+		text = truncate(text, width)
+		if color != "" {
+			text = color + text + resetColors
+		}
+		b.WriteString(text + clearLine + "\r\n")
+	}
+	b.WriteString(home)
+
+	failing := 0
+	for _, r := range v.Rows {
+		if r.Enabled && r.Failing {
+			failing++
+		}
+	}
+	summary := fmt.Sprintf("lsm top - %s - %d services, %d failing", v.Time.Format("15:04:05"), len(v.Rows), failing)
+	switch {
+	case v.SmartPause && v.UserActive:
+		summary += " - Smart Pause: checks paused (user logged in)"
+	case v.SmartPause:
+		summary += " - Smart Pause: on"
+	}
+	if v.Leader != "" {
+		summary += " - leader " + v.Leader
+	}
+	line(bold, summary)
+	if v.Err != nil {
+		line(red, "Error: "+v.Err.Error())
+	} else {
+		line("", "")
+	}
+
+	nameWidth := 4
+	for _, r := range v.Rows {
+		nameWidth = max(nameWidth, min(utf8.RuneCountInString(r.Name), 24))
+	}
+	format := fmt.Sprintf("%%-%d.%ds  %%-8s  %%-9s  %%-8s  %%-8s  %%-22s  %%s", nameWidth, nameWidth)
+	line(reverse, fmt.Sprintf(format, "NAME", "HEALTH", "CHECKED", "LATENCY", "RESTARTS", "NEXT RUN", "STATE"))
+
+	// The feed gets the lines the services, the headings and the 2 lines of
+	// keys leave
+	feed := height - len(v.Rows) - 7
+	for _, r := range v.Rows {
+		health, color := "ok", green
+		switch {
+		case !r.Enabled:
+			health, color = "disabled", dim
+		case r.LastChecked == nil:
+			health, color = "unknown", ""
+		case r.Failing:
+			health, color = "FAILING", red
+		}
+		checked, latency := "-", "-"
+		if r.LastChecked != nil {
+			checked = shortDuration(v.Time.Sub(*r.LastChecked)) + " ago"
+			latency = r.LastCheckDuration.Round(time.Millisecond).String()
+		}
+		next := "-"
+		if !r.Next.IsZero() {
+			next = fmt.Sprintf("%s in %s", r.NextWhat, shortDuration(r.Next.Sub(v.Time)))
+		}
+
+		var state []string
+		if what, ok := busy[r.Name]; ok {
+			state = append(state, what+"...")
+		}
+		if r.Silenced() {
+			state = append(state, "silenced for "+shortDuration(r.SilencedUntil.Sub(v.Time)))
+			if color == green {
+				color = yellow
+			}
+		}
+		if r.Enabled && v.SmartPause && v.UserActive {
+			state = append(state, "paused")
+		}
+
+		if r.Name == selected {
+			color = reverse + color
+		}
+		line(color, fmt.Sprintf(format, r.Name, health, checked, latency, fmt.Sprint(r.Restarts), next, strings.Join(state, ", ")))
+	}
+
+	line("", "")
+	line(bold, "EVENTS")
+	for i := 0; i < feed && i < len(v.Events); i++ {
+		h := v.Events[i]
+		color := ""
+		switch h.Event {
+		case db.EventFailing, db.EventRestartFailed, db.EventVerifyFailed, db.EventInterrupted:
+			color = red
+		case db.EventRecovered, db.EventRestarted:
+			color = green
+		}
+		line(color, fmt.Sprintf("%s  %-*s  %-15s %s", h.CreatedAt.Local().Format("Jan 02 15:04:05"), nameWidth, h.ServiceName, h.Event,
+			strings.ReplaceAll(h.Detail, "\n", " ")))
+	}
+	b.WriteString(clearBelow)
+
+	// Keys and the message on the last lines
+	fmt.Fprintf(&b, "\x1b[%d;1H", max(height-1, 1))
+	line(bold, message)
+	b.WriteString(truncate(fmt.Sprintf("up/down select  c check  r restart  t toggle  s silence %s  q quit", shortDuration(silenceFor)), width) + clearLine)
+	return b.String()
+}
+
+// topCheck runs the checks of s, like lsm check.
+func topCheck(ctx context.Context, s db.Service) string {
+	start := time.Now()
+	h := lifecycle.RunChecks(ctx, s)
+	took := time.Since(start).Round(time.Millisecond)
+	switch {
+	case len(h.Results) == 0:
+		return fmt.Sprintf("%s: no checks", s.Name)
+	case h.Healthy:
+		return fmt.Sprintf("%s: healthy (%d/%d passed, %v)", s.Name, h.Passed, h.Needed, took)
+	}
+	return fmt.Sprintf("%s: UNHEALTHY, %s (%v)", s.Name, h.Summary(), took)
+}
+
+// topRestart restarts s like the monitor does, with its hooks and verification.
+func topRestart(ctx context.Context, s db.Service) string {
+	if refused := topNotLeader(s); refused != "" {
+		return refused
+	}
+	if err := lifecycle.Restart(ctx, store, s, lifecycle.NewEvent(lifecycle.TriggerManual)); err != nil {
+		return fmt.Sprintf("%s: restart failed: %v", s.Name, err)
+	}
+	return fmt.Sprintf("%s: restarted", s.Name)
+}
+
+// topNotLeader says why s isn't restarted from here if the daemons elect a
+// leader and one on another host holds the lease: only the leader restarts
+// services. It returns "" otherwise.
+func topNotLeader(s db.Service) string {
+	lease, err := openLease()
+	if err != nil {
+		return fmt.Sprintf("%s: not restarting, the leader is unknown: %v", s.Name, err)
+	}
+	if lease == nil {
+		return ""
+	}
+	defer lease.Close()
+	holder, err := lease.Holder()
+	if err != nil {
+		return fmt.Sprintf("%s: not restarting, the leader is unknown: %v", s.Name, err)
+	}
+	if holder != "" && !leader.OnThisHost(holder) {
+		return fmt.Sprintf("%s: not restarting, %s is the leader; restart it there", s.Name, holder)
+	}
+	return ""
+}
+
+func topToggle(s db.Service) string {
+	if err := store.ToggleService(s.Name, !s.Enabled); err != nil {
+		return fmt.Sprintf("%s: %v", s.Name, err)
+	}
+	if s.Enabled {
+		return fmt.Sprintf("%s: disabled", s.Name)
+	}
+	return fmt.Sprintf("%s: enabled", s.Name)
+}
+
+// topSilence silences s for silenceFor, or ends its silence.
+func topSilence(s db.Service) string {
+	if s.Silenced() {
+		if err := store.SilenceService(s.Name, nil); err != nil {
+			return fmt.Sprintf("%s: %v", s.Name, err)
+		}
+		return fmt.Sprintf("%s: no longer silenced", s.Name)
+	}
+	until := time.Now().Add(silenceFor)
+	if err := store.SilenceService(s.Name, &until); err != nil {
+		return fmt.Sprintf("%s: %v", s.Name, err)
+	}
+	return fmt.Sprintf("%s: silenced until %s", s.Name, until.Format("15:04"))
+}
+
+// findRow returns the row of the service named name.
+func findRow(rows []topRow, name string) (topRow, bool) {
+	for _, r := range rows {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return topRow{}, false
+}
+
+// keepSelection returns selected if it is still a service, else the first.
+func keepSelection(rows []topRow, selected string) string {
+	if _, ok := findRow(rows, selected); ok || len(rows) == 0 {
+		return selected
+	}
+	return rows[0].Name
+}
+
+// moveSelection returns the service by steps rows away from selected.
+func moveSelection(rows []topRow, selected string, by int) string {
+	for i, r := range rows {
+		if r.Name == selected {
+			return rows[max(0, min(len(rows)-1, i+by))].Name
+		}
+	}
+	return selected
+}
+
+// shortDuration formats d with one or two units, e.g. "45s", "3m20s" or "2h5m".
+func shortDuration(d time.Duration) string {
+	d = max(d, 0).Round(time.Second)
+	switch {
+	case d < time.Minute:
+		return d.String()
+	case d < time.Hour:
+		return fmt.Sprintf("%dm%02ds", int(d.Minutes()), int(d.Seconds())%60)
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return fmt.Sprintf("%dd", int(d.Hours())/24)
+}
+
+// truncate cuts s to width runes.
+func truncate(s string, width int) string {
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	return string([]rune(s)[:max(width, 0)])
+}
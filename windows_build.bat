@@ -6,7 +6,7 @@ set CGO_ENABLED=0
 set GOOS=linux
 set GOARCH=amd64
 
-go build -o lsm-linux main.go
+go build -o lsm-linux .
 
 if %errorlevel% neq 0 (
     echo Build failed!